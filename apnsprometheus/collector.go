@@ -0,0 +1,127 @@
+//Package apnsprometheus exports go-libapns connection metrics through
+//Prometheus' client_golang
+//
+//A Collector is both an apns.Metrics, to be set as APNSConfig.Metrics, and a
+//prometheus.Collector, to be registered with a prometheus.Registerer, so the
+//metrics are served alongside the rest of an application's metrics.
+//It collects the same metrics as apns.PrometheusTextMetrics and keeps
+//the client_golang dependency out of the apns package.
+package apnsprometheus
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/joekarl/go-libapns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//apns.Metrics that is also a prometheus.Collector
+//One Collector can be shared by many connections
+type Collector struct {
+	payloadsBuffered   prometheus.Counter
+	payloadsMarshalled prometheus.Counter
+	payloadsTruncated  prometheus.Counter
+	payloadsDropped    prometheus.Counter
+	payloadsFlushed    prometheus.Counter
+	frameBytes         prometheus.Histogram
+	flushSeconds       prometheus.Histogram
+	inFlightDepth      prometheus.Gauge
+	appleErrors        *prometheus.CounterVec
+}
+
+var _ apns.Metrics = (*Collector)(nil)
+
+//Create a Collector with every metric name prefixed by namespace,
+//defaults to "apns"
+func NewCollector(namespace string) *Collector {
+	if namespace == "" {
+		namespace = "apns"
+	}
+	counter := func(name, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{Namespace: namespace, Name: name, Help: help})
+	}
+	histogram := func(name, help string, buckets []float64) prometheus.Histogram {
+		return prometheus.NewHistogram(prometheus.HistogramOpts{Namespace: namespace, Name: name, Help: help, Buckets: buckets})
+	}
+
+	return &Collector{
+		payloadsBuffered:   counter("payloads_buffered_total", "Payloads framed into the outbound TCP frame buffer."),
+		payloadsMarshalled: counter("payloads_marshalled_total", "Payloads marshalled to JSON."),
+		payloadsTruncated:  counter("payloads_truncated_total", "Payloads that were truncated to fit the max payload size."),
+		payloadsDropped:    counter("payloads_dropped_total", "Payloads dropped because they couldn't be framed."),
+		payloadsFlushed:    counter("payloads_flushed_total", "Payloads written to the socket."),
+		frameBytes: histogram("frame_bytes", "Size of TCP frames written to the socket in bytes.",
+			apns.PROMETHEUS_FRAME_BYTES_BUCKETS),
+		flushSeconds: histogram("flush_duration_seconds", "Time taken to write a TCP frame to the socket.",
+			apns.PROMETHEUS_FLUSH_SECONDS_BUCKETS),
+		inFlightDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "in_flight_buffer_depth",
+			Help:      "Payloads held in the in flight payload buffers of every connection for replay.",
+		}),
+		appleErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "apple_error_responses_total",
+			Help:      "Error responses received from Apple by code.",
+		}, []string{"code", "reason"}),
+	}
+}
+
+//every metric, in the order they're described and collected
+func (c *Collector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.payloadsBuffered,
+		c.payloadsMarshalled,
+		c.payloadsTruncated,
+		c.payloadsDropped,
+		c.payloadsFlushed,
+		c.frameBytes,
+		c.flushSeconds,
+		c.inFlightDepth,
+		c.appleErrors,
+	}
+}
+
+//Send the description of every metric to ch, part of prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+//Send the current value of every metric to ch, part of prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+func (c *Collector) PayloadBuffered() {
+	c.payloadsBuffered.Inc()
+}
+
+func (c *Collector) PayloadMarshalled(truncated bool) {
+	c.payloadsMarshalled.Inc()
+	if truncated {
+		c.payloadsTruncated.Inc()
+	}
+}
+
+func (c *Collector) PayloadDropped() {
+	c.payloadsDropped.Inc()
+}
+
+func (c *Collector) FrameFlushed(bytes int, payloads int, latency time.Duration) {
+	c.payloadsFlushed.Add(float64(payloads))
+	c.frameBytes.Observe(float64(bytes))
+	c.flushSeconds.Observe(latency.Seconds())
+}
+
+func (c *Collector) InFlightBufferDepthChanged(delta int) {
+	c.inFlightDepth.Add(float64(delta))
+}
+
+func (c *Collector) AppleErrorResponse(code uint8) {
+	c.appleErrors.WithLabelValues(strconv.Itoa(int(code)), apns.APPLE_PUSH_RESPONSES[code]).Inc()
+}
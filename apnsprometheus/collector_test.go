@@ -0,0 +1,74 @@
+package apnsprometheus
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollectorShouldRecordMetrics(t *testing.T) {
+	c := NewCollector("")
+	c.PayloadMarshalled(false)
+	c.PayloadMarshalled(true)
+	c.PayloadBuffered()
+	c.PayloadBuffered()
+	c.PayloadDropped()
+	c.FrameFlushed(512, 2, time.Millisecond)
+	c.InFlightBufferDepthChanged(3)
+	c.InFlightBufferDepthChanged(-1)
+	c.AppleErrorResponse(8)
+
+	if testutil.ToFloat64(c.payloadsMarshalled) != 2 || testutil.ToFloat64(c.payloadsTruncated) != 1 {
+		t.Errorf("Expected 2 marshalled and 1 truncated but got %v and %v",
+			testutil.ToFloat64(c.payloadsMarshalled), testutil.ToFloat64(c.payloadsTruncated))
+	}
+	if got := testutil.ToFloat64(c.payloadsBuffered); got != 2 {
+		t.Errorf("Expected 2 buffered but got %v", got)
+	}
+	if got := testutil.ToFloat64(c.payloadsDropped); got != 1 {
+		t.Errorf("Expected 1 dropped but got %v", got)
+	}
+	if got := testutil.ToFloat64(c.payloadsFlushed); got != 2 {
+		t.Errorf("Expected 2 flushed but got %v", got)
+	}
+	if got := testutil.ToFloat64(c.inFlightDepth); got != 2 {
+		t.Errorf("Expected in flight depth of 2 but got %v", got)
+	}
+	if got := testutil.ToFloat64(c.appleErrors.WithLabelValues("8", "INVALID_TOKEN")); got != 1 {
+		t.Errorf("Expected one error 8 response but got %v", got)
+	}
+}
+
+func TestCollectorShouldRegister(t *testing.T) {
+	c := NewCollector("push")
+	c.FrameFlushed(512, 1, time.Millisecond)
+	c.AppleErrorResponse(8)
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		t.Fatal(err)
+	}
+
+	err := testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP push_apple_error_responses_total Error responses received from Apple by code.
+# TYPE push_apple_error_responses_total counter
+push_apple_error_responses_total{code="8",reason="INVALID_TOKEN"} 1
+# HELP push_payloads_flushed_total Payloads written to the socket.
+# TYPE push_payloads_flushed_total counter
+push_payloads_flushed_total 1
+`), "push_apple_error_responses_total", "push_payloads_flushed_total")
+	if err != nil {
+		t.Error(err)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 9 {
+		t.Errorf("Expected 9 metric families but got %v", len(families))
+	}
+}
@@ -0,0 +1,218 @@
+package apnstest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+//Error returned by a FaultConn once it has injected a fault
+var ErrInjectedFault = errors.New("Injected fault")
+
+//Faults injected by a FaultConn
+//Byte counts are from when the faults were set, so setting them after
+//SocketAPNSConnection returns leaves the TLS handshake alone
+type Faults struct {
+	//fail the write that takes the bytes written past this, 0 never fails
+	FailWriteAfter int
+	//write the bytes up to FailWriteAfter before failing, rather than none of the write
+	PartialWrite bool
+	//reset the connection once this many bytes have been read, 0 never resets
+	ResetReadAfter int
+	//hold every read for this long before returning it, delaying error responses
+	//Closing the connection cuts the delay short
+	ReadDelay time.Duration
+	//wait this long before every write
+	WriteDelay time.Duration
+	//discard everything read, reads only return once the read deadline passes
+	//or the connection is closed, so a TLS handshake hangs until TlsTimeout
+	StallReads bool
+	//chance (0 - 1) that each read or write fails, failed writes are partial
+	FaultRate float64
+	//seed for FaultRate, the same seed and sequence of reads and writes
+	//always fails at the same point
+	Seed int64
+}
+
+//net.Conn wrapper that injects faults on a schedule
+//Pass one wrapping a raw connection to an apnstest Server (or Apple) to
+//apns.SocketAPNSConnection
+//Once a fault is injected the connection is broken, the wrapped connection is
+//closed and every read and write returns an error wrapping ErrInjectedFault
+type FaultConn struct {
+	net.Conn
+
+	//Mutex to sync access to the fields below
+	lock   *sync.Mutex
+	faults Faults
+	random *rand.Rand
+	//bytes written and read since the faults were set
+	written int
+	read    int
+	//set once a fault has been injected
+	broken bool
+	//number of faults injected
+	injected int
+	//closed when the connection is closed to release delayed reads and writes
+	closeChannel chan bool
+	closeOnce    *sync.Once
+}
+
+//Wrap conn, injecting faults
+func NewFaultConn(conn net.Conn, faults Faults) *FaultConn {
+	c := &FaultConn{
+		Conn:         conn,
+		lock:         new(sync.Mutex),
+		closeChannel: make(chan bool),
+		closeOnce:    new(sync.Once),
+	}
+	c.SetFaults(faults)
+	return c
+}
+
+//Replace the faults to inject and restart the byte counts
+//A connection that is already broken stays broken
+func (c *FaultConn) SetFaults(faults Faults) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.faults = faults
+	c.random = rand.New(rand.NewSource(faults.Seed))
+	c.written = 0
+	c.read = 0
+}
+
+//Number of faults injected so far
+func (c *FaultConn) Injected() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.injected
+}
+
+//Write b to the wrapped connection unless a write fault is due
+func (c *FaultConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	faults := c.faults
+	c.lock.Unlock()
+
+	if faults.WriteDelay > 0 && !c.wait(faults.WriteDelay) {
+		return 0, net.ErrClosed
+	}
+
+	c.lock.Lock()
+	if c.broken {
+		c.lock.Unlock()
+		return 0, c.injectedError("write")
+	}
+	//bytes to write before failing, -1 doesn't fail
+	failAt := -1
+	if faults.FailWriteAfter > 0 && c.written+len(b) > faults.FailWriteAfter {
+		failAt = 0
+		if faults.PartialWrite {
+			failAt = faults.FailWriteAfter - c.written
+		}
+	} else if faults.FaultRate > 0 && len(b) > 0 && c.random.Float64() < faults.FaultRate {
+		failAt = c.random.Intn(len(b))
+	}
+	c.lock.Unlock()
+
+	if failAt < 0 {
+		n, err := c.Conn.Write(b)
+		c.lock.Lock()
+		c.written += n
+		c.lock.Unlock()
+		return n, err
+	}
+
+	n := 0
+	if failAt > 0 {
+		n, _ = c.Conn.Write(b[:failAt])
+	}
+	c.inject()
+	return n, c.injectedError("write")
+}
+
+//Read from the wrapped connection unless a read fault is due
+func (c *FaultConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	faults := c.faults
+	c.lock.Unlock()
+
+	for {
+		n, err := c.Conn.Read(b)
+
+		c.lock.Lock()
+		if c.broken {
+			c.lock.Unlock()
+			return 0, c.injectedError("read")
+		}
+		if err != nil {
+			c.lock.Unlock()
+			return n, err
+		}
+		if faults.StallReads {
+			//discard and keep waiting for the deadline or a close
+			c.lock.Unlock()
+			continue
+		}
+		reset := (faults.ResetReadAfter > 0 && c.read+n >= faults.ResetReadAfter) ||
+			(faults.FaultRate > 0 && c.random.Float64() < faults.FaultRate)
+		c.read += n
+		c.lock.Unlock()
+
+		if reset {
+			c.inject()
+			return 0, c.injectedError("read")
+		}
+
+		if faults.ReadDelay > 0 {
+			//the bytes have arrived, so closing only cuts the delay short
+			c.wait(faults.ReadDelay)
+		}
+		return n, nil
+	}
+}
+
+//Close the wrapped connection, releasing any delayed reads and writes
+func (c *FaultConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChannel)
+	})
+	return c.Conn.Close()
+}
+
+//Wait for duration
+//Returns false if the connection was closed while waiting
+func (c *FaultConn) wait(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closeChannel:
+		return false
+	}
+}
+
+//Break the connection
+func (c *FaultConn) inject() {
+	c.lock.Lock()
+	if !c.broken {
+		c.broken = true
+		c.injected++
+	}
+	c.lock.Unlock()
+	c.Close()
+}
+
+func (c *FaultConn) injectedError(op string) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    "tcp",
+		Source: c.LocalAddr(),
+		Addr:   c.RemoteAddr(),
+		Err:    ErrInjectedFault,
+	}
+}
@@ -0,0 +1,238 @@
+package apnstest_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+func testFaultConfig(server *apnstest.Server) *apns.APNSConfig {
+	return &apns.APNSConfig{
+		CertificateBytes: server.CertificateBytes,
+		KeyBytes:         server.KeyBytes,
+		GatewayHost:      server.Host,
+		GatewayPort:      server.Port,
+		RootCAs:          server.RootCAs,
+	}
+}
+
+//Connect to server through a FaultConn, faults are set once the handshake completes
+func newFaultConnection(t *testing.T, server *apnstest.Server, faults apnstest.Faults) (*apns.APNSConnection, *apnstest.FaultConn) {
+	socket, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	faultConn := apnstest.NewFaultConn(socket, apnstest.Faults{})
+	conn, err := apns.SocketAPNSConnection(faultConn, testFaultConfig(server))
+	if err != nil {
+		socket.Close()
+		t.Fatal(err)
+	}
+	faultConn.SetFaults(faults)
+	return conn, faultConn
+}
+
+func TestFaultConnShouldHangHandshake(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	socket, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	config := testFaultConfig(server)
+	config.TlsTimeout = 1
+
+	start := time.Now()
+	_, err = apns.SocketAPNSConnection(apnstest.NewFaultConn(socket, apnstest.Faults{StallReads: true}), config)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected handshake timeout but got %v", err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("Expected handshake to give up after TlsTimeout but took %v", time.Since(start))
+	}
+}
+
+func TestFaultConnShouldFailWriteAfterBytes(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	conn, faultConn := newFaultConnection(t, server, apnstest.Faults{FailWriteAfter: 20, PartialWrite: true})
+	defer conn.Disconnect()
+
+	conn.SendChannel <- &apns.Payload{AlertText: "Testing", Token: testToken(1)}
+
+	connectionClose := waitForClose(t, conn)
+	if connectionClose.Error == nil || connectionClose.Error.ErrorCode != apns.CONNECTION_CLOSED_UNKNOWN {
+		t.Errorf("Expected unknown close but got %v", connectionClose.Error)
+	}
+	if faultConn.Injected() != 1 {
+		t.Errorf("Expected 1 fault but got %v", faultConn.Injected())
+	}
+	if len(server.Notifications()) != 0 {
+		t.Errorf("Expected no notifications but got %v", len(server.Notifications()))
+	}
+}
+
+func TestFaultConnShouldResetReads(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	server.RejectToken(testToken(1), apnstest.STATUS_INVALID_TOKEN)
+	conn, _ := newFaultConnection(t, server, apnstest.Faults{ResetReadAfter: 1})
+	defer conn.Disconnect()
+
+	conn.SendChannel <- &apns.Payload{AlertText: "Testing", Token: testToken(1)}
+
+	//the error response is lost to the reset
+	connectionClose := waitForClose(t, conn)
+	if connectionClose.Error == nil || connectionClose.Error.ErrorCode != apns.CONNECTION_CLOSED_UNKNOWN {
+		t.Errorf("Expected unknown close but got %v", connectionClose.Error)
+	}
+}
+
+func TestFaultConnShouldBeReproducibleWithSeed(t *testing.T) {
+	//writes a byte at a time until a fault, returns the bytes written
+	run := func(seed int64) int {
+		client, server := net.Pipe()
+		defer client.Close()
+		go io.Copy(io.Discard, server)
+
+		faultConn := apnstest.NewFaultConn(client, apnstest.Faults{FaultRate: 0.05, Seed: seed})
+		written := 0
+		for i := 0; i < 10000; i++ {
+			n, err := faultConn.Write([]byte{1, 2, 3, 4})
+			written += n
+			if err != nil {
+				if !errors.Is(err, apnstest.ErrInjectedFault) {
+					t.Errorf("Expected injected fault but got %v", err)
+				}
+				return written
+			}
+		}
+		t.Error("Expected a fault")
+		return written
+	}
+
+	for seed := int64(1); seed <= 5; seed++ {
+		if first, second := run(seed), run(seed); first != second {
+			t.Errorf("Expected seed %v to fail at the same byte but got %v and %v", seed, first, second)
+		}
+	}
+}
+
+//Supervised connection to server that dials through FaultConns
+//Returns the connection and the count of each rejected token reported,
+//which is safe to read once the connection is disconnected
+func newFaultSupervisedConnection(t *testing.T, server *apnstest.Server, faults func(dial int) apnstest.Faults) (*apns.SupervisedAPNSConnection, map[string]int) {
+	errorPayloads := map[string]int{}
+	dials := 0
+	supervised, err := apns.NewSupervisedAPNSConnection(&apns.SupervisedAPNSConfig{
+		InitialBackoff: 1,
+		MaxBackoff:     10,
+		ErrorPayloadCallback: func(payload *apns.Payload, appleError *apns.AppleError) {
+			errorPayloads[payload.Token]++
+		},
+		Dial: func() (*apns.APNSConnection, error) {
+			socket, err := net.Dial("tcp", server.Addr())
+			if err != nil {
+				return nil, err
+			}
+			faultConn := apnstest.NewFaultConn(socket, apnstest.Faults{})
+			conn, err := apns.SocketAPNSConnection(faultConn, testFaultConfig(server))
+			if err != nil {
+				socket.Close()
+				return nil, err
+			}
+			dials++
+			faultConn.SetFaults(faults(dials))
+			return conn, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return supervised, errorPayloads
+}
+
+func TestFaultConnReplayShouldSendEachPayloadOnce(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	count := 200
+	rejected := []int{7, 50, 51, 120, 199}
+	for _, i := range rejected {
+		server.RejectToken(testToken(i), apnstest.STATUS_INVALID_TOKEN)
+	}
+	supervised, errorPayloads := newFaultSupervisedConnection(t, server, func(dial int) apnstest.Faults {
+		//late error responses mean more payloads are in flight when apple closes
+		return apnstest.Faults{ReadDelay: 20 * time.Millisecond, WriteDelay: time.Millisecond}
+	})
+
+	for i := 1; i <= count; i++ {
+		supervised.SendChannel <- &apns.Payload{AlertText: "Testing", Token: testToken(i)}
+	}
+	notifications, err := server.WaitForNotifications(count, 10*time.Second)
+	if unsent := supervised.Disconnect(); unsent.Len() != 0 {
+		t.Errorf("Expected every payload to be sent but %v were not", unsent.Len())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := map[string]int{}
+	for _, notification := range notifications {
+		if notification.Accepted() {
+			accepted[notification.Token]++
+		}
+	}
+
+	isRejected := map[string]bool{}
+	for _, i := range rejected {
+		isRejected[testToken(i)] = true
+		if errorPayloads[testToken(i)] != 1 {
+			t.Errorf("Expected payload %v to be reported rejected once but was %v times", i, errorPayloads[testToken(i)])
+		}
+	}
+	for i := 1; i <= count; i++ {
+		token := testToken(i)
+		if !isRejected[token] && accepted[token] != 1 {
+			t.Errorf("Expected payload %v to be accepted once but was %v times", i, accepted[token])
+		}
+	}
+	if server.Connections() != len(rejected)+1 {
+		t.Errorf("Expected %v connections but got %v", len(rejected)+1, server.Connections())
+	}
+}
+
+func TestFaultConnReplayShouldNeverDuplicatePayloads(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	server.RejectToken(testToken(30), apnstest.STATUS_INVALID_TOKEN)
+	supervised, _ := newFaultSupervisedConnection(t, server, func(dial int) apnstest.Faults {
+		return apnstest.Faults{FaultRate: 0.2, Seed: int64(dial), WriteDelay: time.Millisecond}
+	})
+
+	for i := 1; i <= 200; i++ {
+		supervised.SendChannel <- &apns.Payload{AlertText: "Testing", Token: testToken(i)}
+	}
+	//payloads in flight when the socket fails are lost,
+	//so fewer than 200 may ever arrive, but nothing is sent twice
+	notifications, _ := server.WaitForNotifications(200, time.Second)
+	supervised.Disconnect()
+
+	accepted := map[string]int{}
+	for _, notification := range notifications {
+		if notification.Accepted() {
+			accepted[notification.Token]++
+			if accepted[notification.Token] > 1 {
+				t.Errorf("Payload %v was accepted more than once", notification.Token)
+			}
+		}
+	}
+}
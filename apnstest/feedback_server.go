@@ -0,0 +1,260 @@
+package apnstest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+)
+
+//Size of a feedback tuple header, timestamp is 4 bytes, token length is 2 bytes
+const FEEDBACK_HEADER_SIZE = 6
+
+//A (timestamp, token) tuple served by a FeedbackServer
+type FeedbackTuple struct {
+	//Seconds since the epoch when the app was found to be uninstalled
+	Timestamp uint32
+	//Device token, hex encoded
+	Token string
+}
+
+//In-process APNS feedback service
+//Every client connection is served the same tuples, then closed
+type FeedbackServer struct {
+	//Host to set as APNSFeedbackServiceConfig.GatewayHost
+	Host string
+	//Port to set as APNSFeedbackServiceConfig.GatewayPort
+	Port string
+	//Pool trusting the server certificate, to set as APNSFeedbackServiceConfig.RootCAs
+	RootCAs *x509.CertPool
+	//Client certificate and key to set as APNSFeedbackServiceConfig.CertificateBytes/KeyBytes,
+	//the server accepts any client certificate
+	CertificateBytes []byte
+	KeyBytes         []byte
+
+	listener net.Listener
+	//Mutex to sync access to the fields below
+	lock *sync.Mutex
+	//tuples served to each connection
+	tuples []FeedbackTuple
+	//max bytes per write, 0 writes everything at once
+	segmentSize int
+	//wait between writes
+	segmentDelay time.Duration
+	//bytes written before stalling, -1 never stalls
+	stallAfter int
+	//bytes written before resetting the connection, -1 never resets
+	resetAfter int
+	//open client connections
+	conns map[net.Conn]bool
+	//number of client connections accepted
+	accepted int
+	//closed to release stalled connections
+	closeChannel chan bool
+	//tracks running go-routines
+	waitGroup *sync.WaitGroup
+}
+
+//Start a feedback server listening on localhost that serves tuples
+//Close should be called when finished
+func NewFeedbackServer(tuples ...FeedbackTuple) (*FeedbackServer, error) {
+	endpoint, err := listenTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FeedbackServer{
+		Host:             endpoint.host,
+		Port:             endpoint.port,
+		RootCAs:          endpoint.rootCAs,
+		CertificateBytes: endpoint.client.CertificateBytes,
+		KeyBytes:         endpoint.client.KeyBytes,
+		listener:         endpoint.listener,
+		lock:             new(sync.Mutex),
+		tuples:           tuples,
+		stallAfter:       -1,
+		resetAfter:       -1,
+		conns:            make(map[net.Conn]bool),
+		closeChannel:     make(chan bool),
+		waitGroup:        new(sync.WaitGroup),
+	}
+
+	s.waitGroup.Add(1)
+	go s.acceptListener()
+
+	return s, nil
+}
+
+//Address the server is listening on (host:port)
+func (s *FeedbackServer) Addr() string {
+	return net.JoinHostPort(s.Host, s.Port)
+}
+
+//Replace the tuples served to new connections
+func (s *FeedbackServer) SetTuples(tuples ...FeedbackTuple) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tuples = tuples
+}
+
+//Write at most size bytes at a time, waiting delay between writes,
+//so tuples are split across TCP segments
+//A size of 0 writes everything at once
+func (s *FeedbackServer) SplitSegments(size int, delay time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.segmentSize = size
+	s.segmentDelay = delay
+}
+
+//Stop writing after n bytes and hold the connection open until the
+//client gives up or the server is closed
+//A negative n never stalls
+func (s *FeedbackServer) StallAfter(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stallAfter = n
+}
+
+//Reset the connection (TCP RST) after writing n bytes
+//A negative n never resets
+func (s *FeedbackServer) ResetAfter(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.resetAfter = n
+}
+
+//Number of client connections accepted so far
+func (s *FeedbackServer) Connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accepted
+}
+
+//Stop listening, close every client connection and wait for them to finish
+func (s *FeedbackServer) Close() error {
+	err := s.listener.Close()
+
+	s.lock.Lock()
+	close(s.closeChannel)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+
+	s.waitGroup.Wait()
+	return err
+}
+
+//go-routine to accept client connections
+func (s *FeedbackServer) acceptListener() {
+	defer s.waitGroup.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		select {
+		case <-s.closeChannel:
+			s.lock.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.conns[conn] = true
+		s.accepted++
+		s.lock.Unlock()
+
+		s.waitGroup.Add(1)
+		go s.serve(conn.(*tls.Conn))
+	}
+}
+
+//go-routine to write the tuples to a client
+func (s *FeedbackServer) serve(conn *tls.Conn) {
+	defer s.waitGroup.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	s.lock.Lock()
+	response := encodeFeedbackTuples(s.tuples)
+	segmentSize := s.segmentSize
+	segmentDelay := s.segmentDelay
+	stallAfter := s.stallAfter
+	resetAfter := s.resetAfter
+	s.lock.Unlock()
+
+	//complete the handshake before applying any write limits
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+
+	stall := false
+	if stallAfter >= 0 && stallAfter < len(response) {
+		response = response[:stallAfter]
+		stall = true
+	}
+	reset := false
+	if resetAfter >= 0 && resetAfter < len(response) {
+		response = response[:resetAfter]
+		reset = true
+		stall = false
+	}
+
+	for len(response) > 0 {
+		n := len(response)
+		if segmentSize > 0 && segmentSize < n {
+			n = segmentSize
+		}
+		if _, err := conn.Write(response[:n]); err != nil {
+			return
+		}
+		response = response[n:]
+
+		if len(response) > 0 && segmentDelay > 0 {
+			select {
+			case <-time.After(segmentDelay):
+			case <-s.closeChannel:
+				return
+			}
+		}
+	}
+
+	if reset {
+		if tcpConn, ok := conn.NetConn().(*net.TCPConn); ok {
+			//discard unsent data and send RST on close
+			tcpConn.SetLinger(0)
+			tcpConn.Close()
+		}
+		return
+	}
+
+	if stall {
+		//wait for the client to give up
+		conn.Read(make([]byte, 1))
+	}
+}
+
+//Encode tuples in the feedback service wire format
+func encodeFeedbackTuples(tuples []FeedbackTuple) []byte {
+	response := []byte{}
+	for _, tuple := range tuples {
+		token, _ := hex.DecodeString(tuple.Token)
+		header := make([]byte, FEEDBACK_HEADER_SIZE)
+		binary.BigEndian.PutUint32(header[0:4], tuple.Timestamp)
+		binary.BigEndian.PutUint16(header[4:6], uint16(len(token)))
+		response = append(response, header...)
+		response = append(response, token...)
+	}
+	return response
+}
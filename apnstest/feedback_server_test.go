@@ -0,0 +1,129 @@
+package apnstest_test
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+//Size of a tuple with a 32 byte token
+const tupleSize = apnstest.FEEDBACK_HEADER_SIZE + 32
+
+func newTestFeedbackServer(t *testing.T) (*apnstest.FeedbackServer, []apnstest.FeedbackTuple) {
+	tuples := []apnstest.FeedbackTuple{
+		{Timestamp: 1700000001, Token: testToken(1)},
+		{Timestamp: 1700000002, Token: testToken(2)},
+		{Timestamp: 1700000003, Token: testToken(3)},
+	}
+	server, err := apnstest.NewFeedbackServer(tuples...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, tuples
+}
+
+func testFeedbackConfig(server *apnstest.FeedbackServer) *apns.APNSFeedbackServiceConfig {
+	return &apns.APNSFeedbackServiceConfig{
+		CertificateBytes: server.CertificateBytes,
+		KeyBytes:         server.KeyBytes,
+		GatewayHost:      server.Host,
+		GatewayPort:      server.Port,
+		RootCAs:          server.RootCAs,
+	}
+}
+
+func checkFeedbackResponses(t *testing.T, responses *list.List, tuples []apnstest.FeedbackTuple) {
+	if responses.Len() != len(tuples) {
+		t.Fatalf("Expected %v responses but got %v", len(tuples), responses.Len())
+	}
+	i := 0
+	for e := responses.Front(); e != nil; e = e.Next() {
+		response := e.Value.(*apns.FeedbackResponse)
+		if response.Token != tuples[i].Token || response.Timestamp != tuples[i].Timestamp {
+			t.Errorf("Expected response %+v but got %+v", tuples[i], response)
+		}
+		i++
+	}
+}
+
+func TestFeedbackServerShouldServeTuples(t *testing.T) {
+	server, tuples := newTestFeedbackServer(t)
+	defer server.Close()
+
+	responses, err := apns.ConnectToFeedbackService(testFeedbackConfig(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFeedbackResponses(t, responses, tuples)
+
+	server.SetTuples()
+	responses, err = apns.ConnectToFeedbackService(testFeedbackConfig(server))
+	if err != nil || responses.Len() != 0 {
+		t.Errorf("Expected no responses but got %v with %v", responses.Len(), err)
+	}
+	if server.Connections() != 2 {
+		t.Errorf("Expected 2 connections but got %v", server.Connections())
+	}
+}
+
+func TestFeedbackServerShouldSplitTuplesAcrossSegments(t *testing.T) {
+	server, tuples := newTestFeedbackServer(t)
+	defer server.Close()
+	//split headers and tokens
+	server.SplitSegments(5, time.Millisecond)
+
+	responses, err := apns.ConnectToFeedbackService(testFeedbackConfig(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFeedbackResponses(t, responses, tuples)
+}
+
+func TestFeedbackServerShouldResetMidStream(t *testing.T) {
+	server, tuples := newTestFeedbackServer(t)
+	defer server.Close()
+	server.ResetAfter(tupleSize + 10)
+
+	responses, err := apns.ConnectToFeedbackService(testFeedbackConfig(server))
+	if err == nil {
+		t.Error("Expected error after reset")
+	}
+	checkFeedbackResponses(t, responses, tuples[:1])
+}
+
+func TestFeedbackServerShouldStallUntilContextDeadline(t *testing.T) {
+	server, tuples := newTestFeedbackServer(t)
+	defer server.Close()
+	server.StallAfter(2*tupleSize + 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	responses, err := apns.ConnectToFeedbackServiceContext(ctx, testFeedbackConfig(server))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded but got %v", err)
+	}
+	checkFeedbackResponses(t, responses, tuples[:2])
+}
+
+func TestFeedbackServerShouldStallUntilTimeout(t *testing.T) {
+	server, tuples := newTestFeedbackServer(t)
+	defer server.Close()
+	server.StallAfter(tupleSize)
+
+	config := testFeedbackConfig(server)
+	config.TlsTimeout = 1
+
+	responses, err := apns.ConnectToFeedbackService(config)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected timeout error but got %v", err)
+	}
+	checkFeedbackResponses(t, responses, tuples[:1])
+}
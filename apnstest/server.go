@@ -0,0 +1,310 @@
+//Package apnstest provides an in-process APNS binary gateway for testing
+//code that sends push notifications with go-libapns
+//
+//A Server listens on localhost with a self-signed certificate, decodes the
+//notifications it is sent (in any apns.WireFormat) with apns.ReadFrame and
+//records each one.
+//It can be scripted to respond with an error (see apns.APPLE_PUSH_RESPONSES)
+//for a chosen message ID or device token, after which it closes the
+//connection just as Apple does.
+//
+//A FeedbackServer serves scripted (timestamp, token) tuples the way the
+//feedback service does, optionally split across segments, stalled or reset
+//partway through.
+//
+//A FaultConn wraps the raw connection handed to apns.SocketAPNSConnection and
+//injects write failures, read resets, delays and handshake hangs on a schedule
+//or at a seeded random rate.
+package apnstest
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+const (
+	//Command byte of an error response
+	COMMAND_ERROR_RESPONSE = 8
+	//Size of an error response
+	ERROR_RESPONSE_SIZE = 6
+
+	//Status codes the server responds with on its own
+	STATUS_NO_ERRORS             = 0
+	STATUS_PROCESSING_ERROR      = 1
+	STATUS_MISSING_DEVICE_TOKEN  = 2
+	STATUS_MISSING_PAYLOAD       = 4
+	STATUS_INVALID_TOKEN_SIZE    = 5
+	STATUS_INVALID_PAYLOAD_SIZE  = 7
+	STATUS_INVALID_TOKEN         = 8
+	STATUS_SHUTDOWN              = 10
+	STATUS_INVALID_FRAME_ITEM_ID = 128
+
+	//Default max payload size, see Server.MaxPayloadSize
+	DEFAULT_MAX_PAYLOAD_SIZE = 2048
+)
+
+//Notification decoded from a frame
+type Notification struct {
+	//Device token, hex encoded
+	Token string
+	//Raw JSON payload
+	Payload []byte
+	//Notification identifier, returned in error responses
+	ID uint32
+	//UNIX time in seconds when the notification expires, 0 if not sent
+	Expiry uint32
+	//Priority, 0 if not sent
+	Priority uint8
+	//Status the server responded with, STATUS_NO_ERRORS if it was accepted
+	Status uint8
+}
+
+//Accepted is true if the server didn't respond with an error for the notification
+func (n Notification) Accepted() bool {
+	return n.Status == STATUS_NO_ERRORS
+}
+
+//In-process APNS binary gateway
+type Server struct {
+	//Host to set as APNSConfig.GatewayHost
+	Host string
+	//Port to set as APNSConfig.GatewayPort
+	Port string
+	//Pool trusting the server certificate, to set as APNSConfig.RootCAs
+	RootCAs *x509.CertPool
+	//Client certificate and key to set as APNSConfig.CertificateBytes/KeyBytes,
+	//the server accepts any client certificate
+	CertificateBytes []byte
+	KeyBytes         []byte
+	//Payloads larger than this are rejected with STATUS_INVALID_PAYLOAD_SIZE,
+	//defaults to DEFAULT_MAX_PAYLOAD_SIZE
+	MaxPayloadSize int
+
+	listener net.Listener
+	//Mutex to sync access to the fields below
+	lock *sync.Mutex
+	//every decoded notification in the order it was read
+	notifications []Notification
+	//closed and replaced whenever a notification is recorded
+	recorded chan bool
+	//scripted error responses
+	rejectIDs    map[uint32]uint8
+	rejectTokens map[string]uint8
+	//open client connections
+	conns map[net.Conn]bool
+	//number of client connections accepted
+	accepted int
+	//tracks running go-routines
+	waitGroup *sync.WaitGroup
+}
+
+//Start a server listening on localhost
+//Close should be called when finished
+func NewServer() (*Server, error) {
+	endpoint, err := listenTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Host:             endpoint.host,
+		Port:             endpoint.port,
+		RootCAs:          endpoint.rootCAs,
+		CertificateBytes: endpoint.client.CertificateBytes,
+		KeyBytes:         endpoint.client.KeyBytes,
+		MaxPayloadSize:   DEFAULT_MAX_PAYLOAD_SIZE,
+		listener:         endpoint.listener,
+		lock:             new(sync.Mutex),
+		recorded:         make(chan bool),
+		rejectIDs:        make(map[uint32]uint8),
+		rejectTokens:     make(map[string]uint8),
+		conns:            make(map[net.Conn]bool),
+		waitGroup:        new(sync.WaitGroup),
+	}
+
+	s.waitGroup.Add(1)
+	go s.acceptListener()
+
+	return s, nil
+}
+
+//Address the server is listening on (host:port)
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.Host, s.Port)
+}
+
+//Respond with status the next time a notification with id is sent
+//IDs restart at 1 on every connection, so the rule is removed once it fires
+func (s *Server) RejectID(id uint32, status uint8) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rejectIDs[id] = status
+}
+
+//Respond with status whenever a notification for token (hex encoded) is sent
+func (s *Server) RejectToken(token string, status uint8) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rejectTokens[token] = status
+}
+
+//Every notification read so far in the order it was read,
+//including those the server responded to with an error
+func (s *Server) Notifications() []Notification {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Notification{}, s.notifications...)
+}
+
+//Wait until at least n notifications have been read
+//Returns the notifications read so far and an error if that takes longer than timeout
+func (s *Server) WaitForNotifications(n int, timeout time.Duration) ([]Notification, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.lock.Lock()
+		notifications := append([]Notification{}, s.notifications...)
+		recorded := s.recorded
+		s.lock.Unlock()
+
+		if len(notifications) >= n {
+			return notifications, nil
+		}
+
+		select {
+		case <-recorded:
+		case <-timer.C:
+			return notifications, fmt.Errorf("Timed out waiting for %v notifications, read %v", n, len(notifications))
+		}
+	}
+}
+
+//Number of client connections accepted so far
+func (s *Server) Connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accepted
+}
+
+//Close every client connection without an error response
+func (s *Server) CloseClientConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+//Stop listening, close every client connection and wait for them to finish
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.CloseClientConnections()
+	s.waitGroup.Wait()
+	return err
+}
+
+//go-routine to accept client connections
+func (s *Server) acceptListener() {
+	defer s.waitGroup.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		s.conns[conn] = true
+		s.accepted++
+		s.lock.Unlock()
+
+		s.waitGroup.Add(1)
+		go s.serve(conn)
+	}
+}
+
+//go-routine to read notification frames from a client until it disconnects
+//or is sent an error response
+func (s *Server) serve(conn net.Conn) {
+	defer s.waitGroup.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		frame, err := apns.ReadFrame(reader)
+		var frameErr *apns.FrameError
+		if err != nil && !errors.As(err, &frameErr) {
+			return
+		}
+
+		notification := s.respond(newNotification(frame, frameErr, s.MaxPayloadSize))
+		if !notification.Accepted() {
+			writeErrorResponse(conn, notification.Status, notification.ID)
+			//apple ignores anything sent after the error and closes the connection
+			return
+		}
+	}
+}
+
+//Apply any scripted error response to notification and record it
+func (s *Server) respond(notification Notification) Notification {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if notification.Accepted() {
+		if status, ok := s.rejectIDs[notification.ID]; ok {
+			notification.Status = status
+			delete(s.rejectIDs, notification.ID)
+		} else if status, ok := s.rejectTokens[notification.Token]; ok {
+			notification.Status = status
+		}
+	}
+
+	s.notifications = append(s.notifications, notification)
+	close(s.recorded)
+	s.recorded = make(chan bool)
+
+	return notification
+}
+
+//Notification for a decoded frame
+//Status is set if the frame is not a valid notification
+func newNotification(frame *apns.Frame, frameErr *apns.FrameError, maxPayloadSize int) Notification {
+	notification := Notification{
+		Token:    hex.EncodeToString(frame.Token),
+		Payload:  frame.Payload,
+		ID:       frame.ID,
+		Expiry:   frame.Expiration,
+		Priority: frame.Priority,
+	}
+	if frameErr != nil {
+		notification.Status = frameErr.Status
+	} else if len(frame.Payload) > maxPayloadSize {
+		notification.Status = STATUS_INVALID_PAYLOAD_SIZE
+	}
+	return notification
+}
+
+//Write an error response for id to conn
+func writeErrorResponse(conn net.Conn, status uint8, id uint32) {
+	response := make([]byte, ERROR_RESPONSE_SIZE)
+	response[0] = COMMAND_ERROR_RESPONSE
+	response[1] = status
+	binary.BigEndian.PutUint32(response[2:], id)
+	conn.Write(response)
+}
@@ -0,0 +1,239 @@
+package apnstest_test
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+func newTestServer(t *testing.T) *apnstest.Server {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+//Connect to server with go-libapns
+func newTestConnection(t *testing.T, server *apnstest.Server) *apns.APNSConnection {
+	conn, err := apns.NewAPNSConnection(&apns.APNSConfig{
+		CertificateBytes: server.CertificateBytes,
+		KeyBytes:         server.KeyBytes,
+		GatewayHost:      server.Host,
+		GatewayPort:      server.Port,
+		RootCAs:          server.RootCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func testToken(i int) string {
+	return fmt.Sprintf("4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede2139%04x", i)
+}
+
+func waitForClose(t *testing.T, conn *apns.APNSConnection) *apns.ConnectionClose {
+	select {
+	case connectionClose := <-conn.CloseChannel:
+		return connectionClose
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for connection close")
+	}
+	return nil
+}
+
+func TestServerShouldRecordNotifications(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	conn := newTestConnection(t, server)
+
+	conn.SendChannel <- &apns.Payload{
+		AlertText:      "Testing",
+		Token:          testToken(1),
+		ExpirationTime: 1700000000,
+	}
+	conn.SendChannel <- &apns.Payload{AlertText: "Testing 2", Token: testToken(2), Priority: apns.PRIORITY_CONSERVE_POWER}
+
+	notifications, err := server.WaitForNotifications(2, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Disconnect()
+
+	if notifications[0].Token != testToken(1) || notifications[0].ID != 1 ||
+		notifications[0].Expiry != 1700000000 || !notifications[0].Accepted() {
+		t.Errorf("Unexpected first notification %+v", notifications[0])
+	}
+	if notifications[1].Token != testToken(2) || notifications[1].ID != 2 || notifications[1].Expiry != 0 ||
+		notifications[1].Priority != apns.PRIORITY_CONSERVE_POWER || !notifications[1].Accepted() {
+		t.Errorf("Unexpected second notification %+v", notifications[1])
+	}
+
+	payload := map[string]map[string]interface{}{}
+	if err := json.Unmarshal(notifications[0].Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["aps"]["alert"] != "Testing" {
+		t.Errorf("Expected alert Testing but got payload %s", notifications[0].Payload)
+	}
+
+	connectionClose := waitForClose(t, conn)
+	if connectionClose.Error != nil {
+		t.Errorf("Expected clean close but got %v", connectionClose.Error)
+	}
+	if server.Connections() != 1 {
+		t.Errorf("Expected 1 connection but got %v", server.Connections())
+	}
+}
+
+func TestServerShouldRejectToken(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	server.RejectToken(testToken(2), apnstest.STATUS_INVALID_TOKEN)
+	conn := newTestConnection(t, server)
+	defer conn.Disconnect()
+
+	for i := 1; i <= 4; i++ {
+		conn.SendChannel <- &apns.Payload{AlertText: "Testing", Token: testToken(i)}
+	}
+
+	connectionClose := waitForClose(t, conn)
+	if connectionClose.Error == nil || connectionClose.Error.ErrorCode != apnstest.STATUS_INVALID_TOKEN ||
+		connectionClose.Error.MessageID != 2 {
+		t.Fatalf("Expected INVALID_TOKEN for message 2 but got %v", connectionClose.Error)
+	}
+	if connectionClose.ErrorPayload == nil || connectionClose.ErrorPayload.Token != testToken(2) {
+		t.Errorf("Expected error payload for %v but got %v", testToken(2), connectionClose.ErrorPayload)
+	}
+	if connectionClose.UnsentPayloads.Len() != 2 ||
+		connectionClose.UnsentPayloads.Front().Value.(*apns.Payload).Token != testToken(3) {
+		t.Errorf("Expected payloads 3 and 4 to be unsent but got %v", connectionClose.UnsentPayloads.Len())
+	}
+
+	notifications := server.Notifications()
+	if len(notifications) != 2 || !notifications[0].Accepted() ||
+		notifications[1].Status != apnstest.STATUS_INVALID_TOKEN {
+		t.Errorf("Expected one accepted and one rejected notification but got %+v", notifications)
+	}
+}
+
+func TestServerShouldReplayEnhancedNotifications(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	server.RejectToken(testToken(2), apnstest.STATUS_INVALID_TOKEN)
+
+	conn, err := apns.NewAPNSConnection(&apns.APNSConfig{
+		CertificateBytes: server.CertificateBytes,
+		KeyBytes:         server.KeyBytes,
+		GatewayHost:      server.Host,
+		GatewayPort:      server.Port,
+		RootCAs:          server.RootCAs,
+		WireFormat:       apns.WIRE_FORMAT_ENHANCED,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	for i := 1; i <= 3; i++ {
+		conn.SendChannel <- &apns.Payload{AlertText: "Testing", Token: testToken(i), ExpirationTime: 1700000000}
+	}
+
+	//enhanced notifications carry ids, so the error response finds the payload
+	connectionClose := waitForClose(t, conn)
+	if connectionClose.Error == nil || connectionClose.Error.MessageID != 2 ||
+		connectionClose.ErrorPayload == nil || connectionClose.ErrorPayload.Token != testToken(2) {
+		t.Fatalf("Expected INVALID_TOKEN for message 2 but got %v", connectionClose.Error)
+	}
+	if connectionClose.UnsentPayloads.Len() != 1 {
+		t.Errorf("Expected payload 3 to be unsent but got %v", connectionClose.UnsentPayloads.Len())
+	}
+
+	notifications := server.Notifications()
+	if len(notifications) != 2 || notifications[0].ID != 1 || notifications[0].Expiry != 1700000000 {
+		t.Errorf("Unexpected notifications %+v", notifications)
+	}
+}
+
+func TestServerShouldRejectIDOnce(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	server.RejectID(1, apnstest.STATUS_SHUTDOWN)
+
+	conn := newTestConnection(t, server)
+	conn.SendChannel <- &apns.Payload{AlertText: "Testing", Token: testToken(1)}
+	connectionClose := waitForClose(t, conn)
+	conn.Disconnect()
+	if connectionClose.Error == nil || connectionClose.Error.ErrorCode != apnstest.STATUS_SHUTDOWN {
+		t.Fatalf("Expected SHUTDOWN but got %v", connectionClose.Error)
+	}
+
+	//the rule has fired, so a new connection is accepted
+	conn = newTestConnection(t, server)
+	conn.SendChannel <- &apns.Payload{AlertText: "Testing", Token: testToken(1)}
+	notifications, err := server.WaitForNotifications(2, 5*time.Second)
+	conn.Disconnect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !notifications[1].Accepted() || notifications[1].ID != 1 {
+		t.Errorf("Expected second notification 1 to be accepted but got %+v", notifications[1])
+	}
+}
+
+func TestServerShouldRejectMalformedFrames(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	certificate, err := tls.X509KeyPair(server.CertificateBytes, server.KeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := []struct {
+		Items    []byte
+		Expected uint8
+	}{
+		//id only
+		{[]byte{3, 0, 4, 0, 0, 0, 7}, apnstest.STATUS_MISSING_DEVICE_TOKEN},
+		//short token and id
+		{[]byte{1, 0, 2, 0xab, 0xcd, 3, 0, 4, 0, 0, 0, 7}, apnstest.STATUS_INVALID_TOKEN_SIZE},
+		//unknown item
+		{[]byte{9, 0, 1, 0}, apnstest.STATUS_INVALID_FRAME_ITEM_ID},
+		//item overruns frame
+		{[]byte{5, 0, 4, 10}, apnstest.STATUS_PROCESSING_ERROR},
+	}
+
+	for i, frame := range frames {
+		conn, err := tls.Dial("tcp", server.Addr(), &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			RootCAs:      server.RootCAs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := make([]byte, apns.NOTIFICATION_HEADER_SIZE)
+		header[0] = apns.NOTIFICATION_COMMAND
+		binary.BigEndian.PutUint32(header[1:], uint32(len(frame.Items)))
+		conn.Write(append(header, frame.Items...))
+
+		response := make([]byte, apnstest.ERROR_RESPONSE_SIZE)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			t.Fatalf("Expected error response for frame %v but got %v", i, err)
+		}
+		if response[0] != apnstest.COMMAND_ERROR_RESPONSE || response[1] != frame.Expected {
+			t.Errorf("Expected status %v for frame %v but got %v", frame.Expected, i, response[1])
+		}
+		conn.Close()
+	}
+}
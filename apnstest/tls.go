@@ -0,0 +1,128 @@
+package apnstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+)
+
+//Self-signed certificate and key in PEM form
+type certificatePEM struct {
+	CertificateBytes []byte
+	KeyBytes         []byte
+}
+
+//Generate a self-signed certificate valid for a day
+//Server certificates are valid for localhost and 127.0.0.1
+func generateCertificate(commonName string, server bool) (*certificatePEM, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	}
+
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certificatePEM{
+		CertificateBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}),
+		KeyBytes:         pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}, nil
+}
+
+//Create a tls config that serves a fresh self-signed certificate and
+//accepts any client certificate, along with a pool trusting the certificate
+func newServerTLSConfig() (*tls.Config, *x509.CertPool, error) {
+	serverPEM, err := generateCertificate("apnstest gateway", true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certificate, err := tls.X509KeyPair(serverPEM.CertificateBytes, serverPEM.KeyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(serverPEM.CertificateBytes)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		//like apple, a client certificate is required
+		ClientAuth: tls.RequireAnyClientCert,
+	}, rootCAs, nil
+}
+
+//TLS listener on localhost along with what a client needs to connect to it
+type tlsEndpoint struct {
+	listener net.Listener
+	host     string
+	port     string
+	rootCAs  *x509.CertPool
+	client   *certificatePEM
+}
+
+//Listen on a free localhost port with a fresh self-signed certificate
+func listenTLS() (*tlsEndpoint, error) {
+	tlsConf, rootCAs, err := newServerTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	clientPEM, err := generateCertificate("Apple Push Services: apnstest", false)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConf)
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &tlsEndpoint{
+		listener: listener,
+		host:     host,
+		port:     port,
+		rootCAs:  rootCAs,
+		client:   clientPEM,
+	}, nil
+}
@@ -81,6 +81,6 @@ func TestBadgeNumberUnmarshalJSON(t *testing.T) {
 		t.Error("Resulting BadgeNumber should be set")
 	}
 	if ts.Number.Number() != 11 {
-		t.Error("Expected number to be 11, got %d", ts.Number.Number())
+		t.Errorf("Expected number to be 11, got %d", ts.Number.Number())
 	}
 }
@@ -0,0 +1,202 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+)
+
+//Iterates over the device tokens a payload is broadcast to
+//Only called from the go-routine calling Broadcast
+type TokenIterator interface {
+	//Returns the next token, false once there are none left
+	Next() (string, bool)
+}
+
+//TokenIterator over a slice of tokens
+type SliceTokenIterator struct {
+	tokens []string
+}
+
+//Create a TokenIterator over tokens
+func NewSliceTokenIterator(tokens []string) *SliceTokenIterator {
+	return &SliceTokenIterator{tokens: tokens}
+}
+
+func (i *SliceTokenIterator) Next() (string, bool) {
+	if len(i.tokens) == 0 {
+		return "", false
+	}
+	token := i.tokens[0]
+	i.tokens = i.tokens[1:]
+	return token, true
+}
+
+//Error returned when a broadcast stops before every token was handed off
+//Tokens not yet taken from the TokenIterator are left in it
+type BroadcastError struct {
+	//Tokens taken from the TokenIterator that weren't handed off
+	UnsentTokens []string
+	//ErrConnectionClosed or the error from the context
+	Err error
+}
+
+func (e *BroadcastError) Error() string {
+	return fmt.Sprintf("Broadcast stopped with %v tokens unsent : %v", len(e.UnsentTokens), e.Err)
+}
+
+func (e *BroadcastError) Unwrap() error {
+	return e.Err
+}
+
+//Tokens for sendListener to frame with a broadcast template's json
+type broadcastBatch struct {
+	//The template payload
+	template *Payload
+	//Template marshalled once for every token
+	json *[]byte
+	//up to MAX_MARSHAL_BATCH_SIZE device tokens
+	tokens []string
+	//receives once sendListener has framed every token
+	done chan bool
+}
+
+func newBroadcastBatch(template *Payload, json *[]byte) *broadcastBatch {
+	return &broadcastBatch{
+		template: template,
+		json:     json,
+		tokens:   make([]string, 0, MAX_MARSHAL_BATCH_SIZE),
+		done:     make(chan bool, 1),
+	}
+}
+
+//Refill the batch from tokens
+//Returns false once tokens is empty
+func (b *broadcastBatch) fill(tokens TokenIterator) bool {
+	b.tokens = b.tokens[:0]
+	for len(b.tokens) < cap(b.tokens) {
+		token, ok := tokens.Next()
+		if !ok {
+			break
+		}
+		b.tokens = append(b.tokens, token)
+	}
+	return len(b.tokens) > 0
+}
+
+//Copy of the template for each token in the batch, in order
+func (b *broadcastBatch) payloads() []*Payload {
+	payloads := make([]*Payload, len(b.tokens))
+	for i, token := range b.tokens {
+		payloads[i] = b.template.withToken(token)
+	}
+	return payloads
+}
+
+//Copy of a broadcast template for one device token
+func (p *Payload) withToken(token string) *Payload {
+	payload := *p
+	payload.Token = token
+	return &payload
+}
+
+//Send template to every token from tokens, waiting until each has been
+//handed off or ctx is done
+//The template is marshalled once, then each token is framed with its own ID
+//template.Token is ignored, results, error payloads and unsent payloads
+//are reported as copies of template with Token set
+//Returns an *InvalidPayloadError (without taking any tokens) if template can't be marshalled
+//Returns a *BroadcastError if the connection closes or ctx is done first
+func (c *APNSConnection) Broadcast(ctx context.Context, template *Payload, tokens TokenIterator) error {
+	err := template.validateBinary()
+	if err != nil {
+		return newInvalidPayloadError(template, err)
+	}
+
+	json := payloadBufferPool.Get().(*[]byte)
+	defer payloadBufferPool.Put(json)
+
+	jsonStr, truncation, err := template.appendJSON((*json)[:0], c.config.MaxPayloadSize, c.config.TruncationPolicy)
+	if err != nil {
+		return newInvalidPayloadError(template, err)
+	}
+	*json = jsonStr
+	c.payloadMarshalled(template, truncation)
+
+	//fill one batch while sendListener frames the other
+	batches := [2]*broadcastBatch{newBroadcastBatch(template, json), newBroadcastBatch(template, json)}
+	var framing *broadcastBatch
+	defer func() {
+		if framing != nil {
+			<-framing.done
+		}
+	}()
+
+	for i := 0; ; i++ {
+		batch := batches[i%2]
+		more := batch.fill(tokens)
+		if framing != nil {
+			<-framing.done
+			framing = nil
+		}
+		if !more {
+			return nil
+		}
+
+		err := c.handOffBroadcast(ctx, batch)
+		if err != nil {
+			return &BroadcastError{UnsentTokens: batch.tokens, Err: err}
+		}
+		framing = batch
+	}
+}
+
+//Hand batch to sendListener, the same way Send hands off a payload
+//batch.done receives once it's framed if no error is returned
+func (c *APNSConnection) handOffBroadcast(ctx context.Context, batch *broadcastBatch) error {
+	select {
+	case <-c.closedChannel:
+		return ErrConnectionClosed
+	case <-c.disconnectChannel:
+		return ErrConnectionClosed
+	default:
+	}
+
+	select {
+	case c.broadcastChannel <- batch:
+		return nil
+	case <-c.closedChannel:
+		return ErrConnectionClosed
+	case <-c.disconnectChannel:
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Frame the template's json for each token in batch
+//Tokens that can't be decoded are dropped
+func (c *APNSConnection) bufferBroadcast(batch *broadcastBatch) {
+	m := &c.marshalBatch[0]
+	m.Payload = batch.template
+	m.JSON = batch.json
+	defer func() {
+		//the json belongs to the broadcast, not payloadBufferPool
+		m.JSON = nil
+		m.Payload = nil
+		m.BroadcastToken = ""
+	}()
+
+	for _, token := range batch.tokens {
+		err := decodeToken(&m.Token, token)
+		if err != nil {
+			c.dropPayload(newInvalidPayloadError(batch.template.withToken(token), err))
+			continue
+		}
+
+		m.BroadcastToken = token
+		invalidErr := c.bufferPayload(m)
+		if invalidErr != nil {
+			c.dropPayload(invalidErr)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+//Custom field that counts how often it's marshalled
+type countingField struct {
+	count *int32
+}
+
+func (f countingField) MarshalJSON() ([]byte, error) {
+	atomic.AddInt32(f.count, 1)
+	return []byte(`"counted"`), nil
+}
+
+func testTokens(from int, to int) []string {
+	tokens := []string{}
+	for i := from; i <= to; i++ {
+		tokens = append(tokens, testToken(i))
+	}
+	return tokens
+}
+
+func TestBroadcastShouldFrameEachTokenWithOneMarshal(t *testing.T) {
+	socket := newRecordingConn(false)
+	apn := newPipelineTestConnection(socket, 1)
+
+	marshals := int32(0)
+	template := &Payload{
+		AlertText:    "Breaking news",
+		Priority:     PRIORITY_IMMEDIATE,
+		CustomFields: map[string]interface{}{"counter": countingField{&marshals}},
+	}
+	tokens := testTokens(1, 3*MAX_MARSHAL_BATCH_SIZE+5)
+
+	err := apn.Broadcast(context.Background(), template, NewSliceTokenIterator(tokens))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apn.Disconnect()
+
+	if marshals != 1 {
+		t.Errorf("Expected template to be marshalled once but was %v times", marshals)
+	}
+	expectedPayload, _ := template.Marshal(2048)
+	frames := readWrittenFrames(t, socket)
+	if len(frames) != len(tokens) {
+		t.Fatalf("Expected %v frames but got %v", len(tokens), len(frames))
+	}
+	for i, frame := range frames {
+		token, _ := hex.DecodeString(tokens[i])
+		if frame.ID != uint32(i+1) || !bytes.Equal(frame.Token, token) ||
+			!bytes.Equal(frame.Payload, expectedPayload) || frame.Priority != PRIORITY_IMMEDIATE {
+			t.Fatalf("Unexpected frame %v: %+v", i, frame)
+		}
+	}
+}
+
+func TestBroadcastShouldReportRejectedToken(t *testing.T) {
+	tokens := testTokens(1, 4)
+	socket := newMockConnRejectToken(tokens[1], make(chan writtenNotification, 100))
+	apn, results := newResultTestConnection(socket, 10000)
+
+	template := &Payload{AlertText: "Testing", Token: "ignored"}
+	err := apn.Broadcast(context.Background(), template, NewSliceTokenIterator(tokens))
+	if err != nil && !errors.Is(err, ErrConnectionClosed) {
+		t.Fatal(err)
+	}
+	connectionClose := <-apn.CloseChannel
+
+	if connectionClose.ErrorPayload == nil || connectionClose.ErrorPayload.Token != tokens[1] ||
+		connectionClose.ErrorPayload.AlertText != "Testing" {
+		t.Errorf("Expected error payload for %v but got %+v", tokens[1], connectionClose.ErrorPayload)
+	}
+	if connectionClose.UnsentPayloads.Len() != 2 ||
+		connectionClose.UnsentPayloads.Front().Value.(*Payload).Token != tokens[2] {
+		t.Errorf("Expected the last 2 tokens to be unsent but got %v", connectionClose.UnsentPayloads.Len())
+	}
+
+	expected := []PayloadStatus{PAYLOAD_ACCEPTED, PAYLOAD_REJECTED, PAYLOAD_UNSENT, PAYLOAD_UNSENT}
+	for i, status := range expected {
+		result := waitForPayloadResult(t, results)
+		if result.ID != uint32(i+1) || result.Payload.Token != tokens[i] || result.Status != status {
+			t.Errorf("Expected result %v for %v but got %v for %v", status, tokens[i], result.Status, result.Payload.Token)
+		}
+	}
+	if template.Token != "ignored" {
+		t.Errorf("Expected template to be left alone but token is %v", template.Token)
+	}
+}
+
+func TestBroadcastShouldDropInvalidTokens(t *testing.T) {
+	socket := newRecordingConn(false)
+	apn, results := newResultTestConnection(socket, 10000)
+
+	tokens := []string{testToken(1), "not a token", testToken(2)}
+	err := apn.Broadcast(context.Background(), &Payload{AlertText: "Testing"}, NewSliceTokenIterator(tokens))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := waitForPayloadResult(t, results)
+	if result.Status != PAYLOAD_DROPPED || result.Payload.Token != tokens[1] ||
+		!errors.Is(result.Error, ErrInvalidTokenEncoding) {
+		t.Errorf("Expected %v to be dropped but got %v for %v", tokens[1], result.Status, result.Payload.Token)
+	}
+	apn.Disconnect()
+
+	frames := readWrittenFrames(t, socket)
+	if len(frames) != 2 || frames[1].ID != 2 {
+		t.Errorf("Expected 2 frames with consecutive ids but got %v", len(frames))
+	}
+}
+
+func TestBroadcastShouldRejectInvalidTemplate(t *testing.T) {
+	socket := newRecordingConn(false)
+	apn := newPipelineTestConnection(socket, 1)
+	defer apn.Disconnect()
+
+	background := NewBackgroundPayload("", nil)
+	background.AlertText = "Testing"
+	templates := []struct {
+		template *Payload
+		expected error
+	}{
+		{&Payload{AlertText: "Testing", CustomFields: map[string]interface{}{"aps": 1}}, ErrApsCustomField},
+		{background, ErrInvalidBackgroundPayload},
+	}
+
+	for _, c := range templates {
+		tokens := NewSliceTokenIterator(testTokens(1, 2))
+		err := apn.Broadcast(context.Background(), c.template, tokens)
+
+		var invalidErr *InvalidPayloadError
+		if !errors.As(err, &invalidErr) || !errors.Is(err, c.expected) {
+			t.Errorf("Expected %v but got %v", c.expected, err)
+		}
+		if token, _ := tokens.Next(); token != testToken(1) {
+			t.Errorf("Expected no tokens to be taken but next was %v", token)
+		}
+	}
+}
+
+func TestBroadcastShouldReturnUnsentTokensOnceClosed(t *testing.T) {
+	socket := newRecordingConn(false)
+	apn := newPipelineTestConnection(socket, 1)
+	apn.Disconnect()
+
+	tokens := NewSliceTokenIterator(testTokens(1, MAX_MARSHAL_BATCH_SIZE+1))
+	err := apn.Broadcast(context.Background(), &Payload{AlertText: "Testing"}, tokens)
+
+	var broadcastErr *BroadcastError
+	if !errors.As(err, &broadcastErr) || !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("Expected BroadcastError with ErrConnectionClosed but got %v", err)
+	}
+	if len(broadcastErr.UnsentTokens) != MAX_MARSHAL_BATCH_SIZE || broadcastErr.UnsentTokens[0] != testToken(1) {
+		t.Errorf("Expected the first batch of tokens to be unsent but got %v", len(broadcastErr.UnsentTokens))
+	}
+	if token, _ := tokens.Next(); token != testToken(MAX_MARSHAL_BATCH_SIZE+1) {
+		t.Errorf("Expected the rest of the tokens to be left but next was %v", token)
+	}
+}
+
+func TestPoolBroadcastShouldSendEachTokenOnce(t *testing.T) {
+	tp := newTestPool(t, 3, POOL_ROUND_ROBIN, "")
+	sockets := tp.waitForDials(t, 3)
+
+	tokens := testTokens(1, 150)
+	err := tp.Pool.Broadcast(context.Background(), &Payload{AlertText: "Testing"}, NewSliceTokenIterator(tokens))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForNotifications(t, sockets, len(tokens))
+	tp.Pool.Disconnect()
+
+	sent := map[string]int{}
+	for i, socket := range sockets {
+		if len(socket.Notifications) != 50 {
+			t.Errorf("Expected member %v to send 50 notifications but sent %v", i, len(socket.Notifications))
+		}
+		for len(socket.Notifications) > 0 {
+			sent[(<-socket.Notifications).Token]++
+		}
+	}
+	for _, token := range tokens {
+		if sent[token] != 1 {
+			t.Errorf("Expected %v to be sent once but was sent %v times", token, sent[token])
+		}
+	}
+}
+
+func TestPoolBroadcastShouldKeepTokenOnItsMember(t *testing.T) {
+	tp := newTestPool(t, 4, POOL_TOKEN_HASH, "")
+	sockets := tp.waitForDials(t, 4)
+
+	tokens := testTokens(1, 40)
+	err := tp.Pool.Broadcast(context.Background(), &Payload{AlertText: "Testing"}, NewSliceTokenIterator(tokens))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the same tokens sent individually
+	for _, token := range tokens {
+		tp.Pool.SendChannel <- &Payload{AlertText: "Testing", Token: token}
+	}
+	waitForNotifications(t, sockets, 2*len(tokens))
+	tp.Pool.Disconnect()
+
+	for i, socket := range sockets {
+		sent := map[string]int{}
+		for len(socket.Notifications) > 0 {
+			sent[(<-socket.Notifications).Token]++
+		}
+		for token, count := range sent {
+			if count != 2 {
+				t.Errorf("Expected %v to be broadcast and sent on member %v but was sent there %v times", token, i, count)
+			}
+		}
+	}
+}
+
+func TestPoolBroadcastShouldReturnUnsentTokensOnceDisconnected(t *testing.T) {
+	tp := newTestPool(t, 2, POOL_ROUND_ROBIN, "")
+	tp.waitForDials(t, 2)
+	tp.Pool.Disconnect()
+
+	tokens := testTokens(1, 3)
+	err := tp.Pool.Broadcast(context.Background(), &Payload{AlertText: "Testing"}, NewSliceTokenIterator(tokens))
+
+	var broadcastErr *BroadcastError
+	if !errors.As(err, &broadcastErr) || !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("Expected BroadcastError with ErrConnectionClosed but got %v", err)
+	}
+	if len(broadcastErr.UnsentTokens) != 1 || broadcastErr.UnsentTokens[0] != tokens[0] {
+		t.Errorf("Expected the first token to be unsent but got %v", broadcastErr.UnsentTokens)
+	}
+}
+
+func TestPoolBroadcastShouldUseMemberMaxPayloadSize(t *testing.T) {
+	pool, err := NewAPNSConnectionPool(&APNSConnectionPoolConfig{
+		Dial: func() (*APNSConnection, error) {
+			config := testAPNSConfig()
+			config.MaxPayloadSize = 64
+			socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+			return socketAPNSConnection(socket, config), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+
+	//fits in 2048 bytes but can't be truncated to 64
+	template := &Payload{AlertText: "Testing", CustomFields: map[string]interface{}{"data": strings.Repeat("a", 100)}}
+	err = pool.Broadcast(context.Background(), template, NewSliceTokenIterator(testTokens(1, 2)))
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Expected ErrPayloadTooLarge with the member's max payload size but got %v", err)
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	socket := newRecordingConn(true)
+	apn := newPipelineTestConnection(socket, 1)
+	template := &Payload{AlertText: "Breaking news", Badge: NewBadgeNumber(1), Sound: NewSound("default")}
+	tokens := make([]string, b.N)
+	for i := range tokens {
+		tokens[i] = testToken(i % 0xffff)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	err := apn.Broadcast(context.Background(), template, NewSliceTokenIterator(tokens))
+	apn.Disconnect()
+	b.StopTimer()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "payloads/s")
+}
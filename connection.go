@@ -3,14 +3,14 @@
 package apns
 
 import (
-	"bytes"
 	"container/list"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
-	"fmt"
 	"net"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -23,6 +23,8 @@ type APNSConfig struct {
 	FramingTimeout int
 	//max number of bytes allowed in payload, defaults to 2048
 	MaxPayloadSize int
+	//how payloads over MaxPayloadSize are truncated, defaults to DefaultTruncationPolicy
+	TruncationPolicy *TruncationPolicy
 	//bytes for cert.pem : required
 	CertificateBytes []byte
 	//bytes for key.pem : required
@@ -38,6 +40,32 @@ type APNSConfig struct {
 	SocketTimeout int
 	//number of seconds to wait for Tls handshake to complete before bailing, defaults to no timeout
 	TlsTimeout int
+	//root certificates used to verify the gateway, defaults to the system roots
+	RootCAs *x509.CertPool
+	//called with the result of each payload sent, defaults to no reporting
+	//called from the connection's go-routines so it should not block
+	PayloadResultCallback func(*PayloadResult)
+	//called with each payload that is dropped because it can't be framed
+	//(bad token, failed to marshal), defaults to silently dropping them
+	//called from the connection's go-routines so it should not block
+	InvalidPayloadCallback func(*InvalidPayloadError)
+	//number of milliseconds after a payload is flushed without an error response
+	//before it is reported as accepted, defaults to 1000
+	//if Apple's error response arrives later the payload is also reported as rejected
+	PayloadAcceptedTimeout int
+	//receives connection log events, defaults to no logging
+	Logger Logger
+	//minimum level of events sent to Logger, defaults to LOG_INFO
+	LogLevel LogLevel
+	//receives connection measurements, defaults to no metrics
+	//see NewPrometheusTextMetrics for a Prometheus adapter
+	Metrics Metrics
+	//format notifications are written in, defaults to WIRE_FORMAT_FRAME
+	//only for gateways that don't understand frames, see WireFormat
+	WireFormat WireFormat
+	//number of go-routines marshalling payloads in parallel, defaults to GOMAXPROCS
+	//payloads are still written in the order they're sent
+	MarshalWorkers int
 }
 
 //Object returned on a connection close or connection error
@@ -67,18 +95,22 @@ type APNSConnection struct {
 	//Channel to send payloads on
 	SendChannel chan *Payload
 	//Channel that connection close is received on
+	//Receives exactly one *ConnectionClose and is then closed
 	CloseChannel chan *ConnectionClose
 	//raw socket connection
 	socket net.Conn
 	//config
 	config *APNSConfig
 	//Buffer to hold payloads for replay
-	inFlightPayloadBuffer *list.List
-	//Stateful buffer to hold framed byte data
-	inFlightFrameByteBuffer *bytes.Buffer
-	//Stateful buffer to hold data while generating item bytes
-	inFlightItemByteBuffer *bytes.Buffer
-	//Mutex to sync access to Frame byte buffer
+	inFlightPayloadBuffer *inFlightBuffer
+	//Frames buffered since the last flush, from frameChunkPool
+	//only touched by sendListener
+	frameChunk *[]byte
+	//Number of payloads in frameChunk
+	frameChunkPayloadCount int
+	//ID of the last payload in frameChunk
+	frameChunkLastID uint32
+	//Mutex to sync access to inFlightPayloadBuffer
 	inFlightBufferLock *sync.Mutex
 	//Stateful counter to identify payloads for replay
 	payloadIdCounter uint32
@@ -86,14 +118,67 @@ type APNSConnection struct {
 	disconnectLock *sync.Mutex
 	// Boolean saying we're disconnecting
 	disconnecting bool
+	//logger filtered to config.LogLevel
+	logger Logger
+	//config.Metrics or nopMetrics
+	metrics Metrics
+	//closed once the connection stops accepting payloads
+	closedChannel chan bool
+	//closed to ask sendListener to flush and close the socket
+	disconnectChannel chan bool
+	//closed once sendListener has flushed and closed the socket for Disconnect
+	flushedChannel chan bool
+	//guards against disconnecting twice
+	disconnectOnce *sync.Once
+	//guards against closing the socket twice
+	socketCloseOnce *sync.Once
+	//closed to stop discarding payloads sent after the connection closed
+	stopDrainChannel chan bool
+	//guards against stopping the drain twice
+	stopDrainOnce *sync.Once
+	//closed once drainListener has returned
+	drainDoneChannel chan bool
+	//first InFlightPayloadBufferSize payloads sent after the connection closed,
+	//only touched by drainListener until drainDoneChannel is closed
+	drainedPayloads *list.List
+	//payloads being marshalled, only touched by sendListener and marshalListeners
+	marshalBatch []marshalledPayload
+	//number of go-routines (counting sendListener) marshalling a batch
+	marshalWorkers int
+	//parts of a batch for the marshalListeners, closed when sendListener returns
+	marshalChannel chan marshalJob
+	//waits for the marshalListeners to finish a batch
+	marshalWaitGroup *sync.WaitGroup
+	//batches of broadcast tokens to frame
+	broadcastChannel chan *broadcastBatch
+	//chunks flushed for writeListener, closed to stop writeListener
+	writeChannel chan pendingWrite
+	//guards against closing writeChannel twice
+	stopWriterOnce *sync.Once
+	//closed once writeListener has returned
+	writerDoneChannel chan bool
 }
 
 //Wrapper for associating an ID with a Payload object
 type idPayload struct {
-	//The Payload object
+	//The Payload object, the template for broadcasts
 	Payload *Payload
+	//Device token the template was broadcast to, empty if not a broadcast
+	BroadcastToken string
 	//The numerical id (from payloadIdCounter) for replay identification
 	ID uint32
+	//Time the payload was flushed to the socket, zero if not yet flushed
+	FlushedAt time.Time
+	//Whether a PayloadResult has been reported for the payload
+	Resolved bool
+}
+
+//The Payload that was sent, a copy of the template with the token for broadcasts
+func (p *idPayload) payload() *Payload {
+	if p.BroadcastToken == "" {
+		return p.Payload
+	}
+	return p.Payload.withToken(p.BroadcastToken)
 }
 
 const (
@@ -149,6 +234,15 @@ func applyConfigDefaults(config *APNSConfig) error {
 	if config.MaxPayloadSize < 0 {
 		errorStrs += "Invalid MaxPayloadSize. Should be greater than 0.\n"
 	}
+	if config.PayloadAcceptedTimeout < 0 {
+		errorStrs += "Invalid PayloadAcceptedTimeout. Should be greater than 0.\n"
+	}
+	if config.WireFormat < WIRE_FORMAT_FRAME || config.WireFormat > WIRE_FORMAT_SIMPLE {
+		errorStrs += "Invalid WireFormat. Should be WIRE_FORMAT_FRAME, WIRE_FORMAT_ENHANCED or WIRE_FORMAT_SIMPLE\n"
+	}
+	if config.MarshalWorkers < 0 {
+		errorStrs += "Invalid MarshalWorkers. Should be greater than 0.\n"
+	}
 
 	if errorStrs != "" {
 		return errors.New(errorStrs)
@@ -175,6 +269,12 @@ func applyConfigDefaults(config *APNSConfig) error {
 	if config.TlsTimeout == 0 {
 		config.TlsTimeout = 5
 	}
+	if config.PayloadAcceptedTimeout == 0 {
+		config.PayloadAcceptedTimeout = 1000
+	}
+	if config.MarshalWorkers == 0 {
+		config.MarshalWorkers = runtime.GOMAXPROCS(0)
+	}
 	return nil
 }
 
@@ -182,23 +282,39 @@ func applyConfigDefaults(config *APNSConfig) error {
 //If invalid config an error will be returned
 //See APNSConfig object for defaults
 func NewAPNSConnection(config *APNSConfig) (*APNSConnection, error) {
+	return NewAPNSConnectionContext(context.Background(), config)
+}
+
+//Create a new apns connection with supplied config
+//Connecting and the Tls handshake are abandoned if ctx is done first,
+//SocketTimeout and TlsTimeout still apply if ctx has a later deadline
+//If invalid config an error will be returned
+//See APNSConfig object for defaults
+func NewAPNSConnectionContext(ctx context.Context, config *APNSConfig) (*APNSConnection, error) {
 	err := applyConfigDefaults(config)
 
 	if err != nil {
 		return nil, err
 	}
 
-	tcpSocket, err := net.DialTimeout("tcp",
-		config.GatewayHost+":"+config.GatewayPort,
-		time.Duration(config.SocketTimeout)*time.Second)
+	logger := newLevelLogger(config.Logger, config.LogLevel)
+
+	dialer := &net.Dialer{Timeout: time.Duration(config.SocketTimeout) * time.Second}
+	tcpSocket, err := dialer.DialContext(ctx, "tcp",
+		net.JoinHostPort(config.GatewayHost, config.GatewayPort))
 	if err != nil {
 		//failed to connect to gateway
+		logger.Log(LOG_ERROR, "Failed to connect to APNS gateway",
+			"host", config.GatewayHost, "port", config.GatewayPort, "error", err)
 		return nil, err
 	}
+	logger.Log(LOG_INFO, "Connected to APNS gateway",
+		"host", config.GatewayHost, "port", config.GatewayPort)
 
-	tlsSocket, err := createTLSClient(tcpSocket, config)
+	tlsSocket, err := createTLSClient(ctx, tcpSocket, config)
 
 	if err != nil {
+		tcpSocket.Close()
 		return nil, err
 	}
 
@@ -213,7 +329,7 @@ func SocketAPNSConnection(socket net.Conn, config *APNSConfig) (*APNSConnection,
 		return nil, err
 	}
 
-	tlsSocket, err := createTLSClient(socket, config)
+	tlsSocket, err := createTLSClient(context.Background(), socket, config)
 
 	if err != nil {
 		return nil, err
@@ -222,21 +338,48 @@ func SocketAPNSConnection(socket net.Conn, config *APNSConfig) (*APNSConnection,
 	return socketAPNSConnection(tlsSocket, config), nil
 }
 
-func createTLSClient(socket net.Conn, config *APNSConfig) (net.Conn, error) {
-	x509Cert, err := tls.X509KeyPair(config.CertificateBytes, config.KeyBytes)
+func createTLSClient(ctx context.Context, socket net.Conn, config *APNSConfig) (net.Conn, error) {
+	logger := newLevelLogger(config.Logger, config.LogLevel)
+
+	tlsConf, err := createTLSConfig(config.CertificateBytes, config.KeyBytes, config.GatewayHost)
+	if err != nil {
+		logger.Log(LOG_ERROR, "Invalid certificate/key", "error", err)
+		return nil, err
+	}
+	tlsConf.RootCAs = config.RootCAs
+
+	start := time.Now()
+	tlsSocket, err := handshakeTLSClient(ctx, socket, tlsConf, config.TlsTimeout)
+	if err != nil {
+		logger.Log(LOG_ERROR, "TLS handshake failed", "host", config.GatewayHost, "error", err)
+		return nil, err
+	}
+	logger.Log(LOG_DEBUG, "TLS handshake complete",
+		"host", config.GatewayHost, "duration", time.Since(start))
+
+	return tlsSocket, nil
+}
+
+//Load the cert/key pem pair into a tls config for connecting to serverName
+func createTLSConfig(certificateBytes, keyBytes []byte, serverName string) (*tls.Config, error) {
+	x509Cert, err := tls.X509KeyPair(certificateBytes, keyBytes)
 	if err != nil {
 		//failed to validate key pair
 		return nil, err
 	}
 
-	tlsConf := &tls.Config{
+	return &tls.Config{
 		Certificates: []tls.Certificate{x509Cert},
-		ServerName:   config.GatewayHost,
-	}
+		ServerName:   serverName,
+	}, nil
+}
 
+//Wrap socket in a tls client and complete the handshake within tlsTimeout seconds
+//or before ctx is done, whichever is first
+func handshakeTLSClient(ctx context.Context, socket net.Conn, tlsConf *tls.Config, tlsTimeout int) (*tls.Conn, error) {
 	tlsSocket := tls.Client(socket, tlsConf)
-	tlsSocket.SetDeadline(time.Now().Add(time.Duration(config.TlsTimeout) * time.Second))
-	err = tlsSocket.Handshake()
+	tlsSocket.SetDeadline(time.Now().Add(time.Duration(tlsTimeout) * time.Second))
+	err := tlsSocket.HandshakeContext(ctx)
 	if err != nil {
 		//failed to handshake with tls information
 		return nil, err
@@ -255,39 +398,160 @@ func socketAPNSConnection(socket net.Conn, config *APNSConfig) *APNSConnection {
 	c := new(APNSConnection)
 	//TODO(karl): maybe should copy the config to prevent tampering?
 	c.config = config
-	c.inFlightPayloadBuffer = list.New()
+	c.inFlightPayloadBuffer = newInFlightBuffer(config.InFlightPayloadBufferSize)
 	c.socket = socket
 	c.SendChannel = make(chan *Payload)
-	c.CloseChannel = make(chan *ConnectionClose)
-	c.inFlightFrameByteBuffer = new(bytes.Buffer)
-	c.inFlightItemByteBuffer = new(bytes.Buffer)
+	c.CloseChannel = make(chan *ConnectionClose, 1)
+	c.frameChunk = frameChunkPool.Get().(*[]byte)
+	*c.frameChunk = (*c.frameChunk)[:0]
 	c.inFlightBufferLock = new(sync.Mutex)
 	c.disconnectLock = new(sync.Mutex)
+	c.closedChannel = make(chan bool)
+	c.disconnectChannel = make(chan bool)
+	c.flushedChannel = make(chan bool)
+	c.disconnectOnce = new(sync.Once)
+	c.socketCloseOnce = new(sync.Once)
+	c.stopDrainChannel = make(chan bool)
+	c.stopDrainOnce = new(sync.Once)
+	c.drainDoneChannel = make(chan bool)
+	c.drainedPayloads = list.New()
 	c.payloadIdCounter = 1
-	errCloseChannel := make(chan *AppleError)
+	c.logger = newLevelLogger(config.Logger, config.LogLevel)
+	c.metrics = config.Metrics
+	if c.metrics == nil {
+		c.metrics = nopMetrics{}
+	}
+	c.marshalBatch = make([]marshalledPayload, MAX_MARSHAL_BATCH_SIZE)
+	c.marshalWorkers = config.MarshalWorkers
+	if c.marshalWorkers < 1 {
+		c.marshalWorkers = 1
+	}
+	c.marshalChannel = make(chan marshalJob, c.marshalWorkers)
+	c.marshalWaitGroup = new(sync.WaitGroup)
+	c.broadcastChannel = make(chan *broadcastBatch)
+	c.writeChannel = make(chan pendingWrite, WRITE_QUEUE_SIZE)
+	c.stopWriterOnce = new(sync.Once)
+	c.writerDoneChannel = make(chan bool)
+	//buffered so closeListener never blocks if sendListener has already returned
+	errCloseChannel := make(chan *AppleError, 1)
 
 	go c.closeListener(errCloseChannel)
 	go c.sendListener(errCloseChannel)
+	go c.writeListener()
+	//sendListener marshals a share of each batch itself
+	for i := 1; i < c.marshalWorkers; i++ {
+		go c.marshalListener()
+	}
 
 	return c
 }
 
+//Send payload on the connection, waiting until it has been handed off or ctx is done
+//Returns ErrConnectionClosed once the connection has closed or Disconnect
+//has been called, the reason is still received on CloseChannel
+//Returns ctx.Err() if ctx is done before the payload is handed off
+func (c *APNSConnection) Send(ctx context.Context, payload *Payload) error {
+	select {
+	case <-c.closedChannel:
+		return ErrConnectionClosed
+	case <-c.disconnectChannel:
+		return ErrConnectionClosed
+	default:
+	}
+
+	select {
+	case c.SendChannel <- payload:
+		return nil
+	case <-c.closedChannel:
+		return ErrConnectionClosed
+	case <-c.disconnectChannel:
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 //Disconnect from the Apns Gateway
 //Flushes any currently unsent messages before disconnecting from the socket
+//The *ConnectionClose is received on CloseChannel once the socket has closed
+//Payloads written to SendChannel after calling Disconnect are discarded until
+//SendChannel is closed (Send returns ErrConnectionClosed instead)
+//Safe to call more than once and from multiple go-routines
 func (c *APNSConnection) Disconnect() {
-	c.disconnectLock.Lock()
-	c.disconnecting = true
-	c.disconnectLock.Unlock()
-	//flush on disconnect
-	c.inFlightBufferLock.Lock()
-	c.flushBufferToSocket()
-	c.inFlightBufferLock.Unlock()
-	c.noFlushDisconnect()
+	c.disconnectOnce.Do(func() {
+		c.disconnectLock.Lock()
+		c.disconnecting = true
+		c.disconnectLock.Unlock()
+		//sendListener flushes what it has buffered and closes the socket
+		close(c.disconnectChannel)
+		select {
+		case <-c.flushedChannel:
+		case <-c.closedChannel:
+			//sendListener has already returned
+			c.noFlushDisconnect()
+		}
+	})
 }
 
 //internal close socket
 func (c *APNSConnection) noFlushDisconnect() {
-	c.socket.Close()
+	c.socketCloseOnce.Do(func() {
+		c.socket.Close()
+	})
+}
+
+//Close the socket and stop discarding payloads sent after the connection closed
+//Returns the discarded payloads in send order, up to InFlightPayloadBufferSize of them
+//Should only be called once the connection has closed
+func (c *APNSConnection) release() *list.List {
+	c.noFlushDisconnect()
+	c.stopDraining()
+	<-c.drainDoneChannel
+	return c.drainedPayloads
+}
+
+//Stop discarding payloads sent after the connection closed
+func (c *APNSConnection) stopDraining() {
+	c.stopDrainOnce.Do(func() {
+		close(c.stopDrainChannel)
+	})
+}
+
+//Stop accepting payloads
+//Anything sent on SendChannel from now until it's closed (or the connection
+//is released) is discarded so senders don't block forever
+func (c *APNSConnection) markClosed() {
+	close(c.closedChannel)
+	go c.drainListener()
+}
+
+//go-routine to discard payloads sent after the connection closed
+//Discarded payloads are reported as PAYLOAD_UNSENT, only the first
+//InFlightPayloadBufferSize are kept for release
+func (c *APNSConnection) drainListener() {
+	defer close(c.drainDoneChannel)
+
+	for {
+		select {
+		case payload := <-c.SendChannel:
+			if payload == nil {
+				//channel was closed
+				return
+			}
+			if c.drainedPayloads.Len() < c.config.InFlightPayloadBufferSize {
+				c.drainedPayloads.PushBack(payload)
+			}
+			c.logger.Log(LOG_DEBUG, "Discarded payload sent after connection closed",
+				"token", payload.Token)
+			c.reportPayloadResults([]*PayloadResult{{
+				Payload: payload,
+				Status:  PAYLOAD_UNSENT,
+				Error:   ErrConnectionClosed,
+			}})
+		case <-c.stopDrainChannel:
+			return
+		}
+	}
 }
 
 //go-routine to listen for socket closes or apple response information
@@ -329,59 +593,115 @@ func (c *APNSConnection) sendListener(errCloseChannel chan *AppleError) {
 	zeroTimeoutDuration := 0 * time.Millisecond
 	timeoutTimer := time.NewTimer(longTimeoutDuration)
 
+	//only sweep for accepted payloads if someone is listening for results
+	var acceptedTickerChannel <-chan time.Time
+	if c.config.PayloadResultCallback != nil {
+		acceptedTicker := time.NewTicker(time.Duration(c.config.PayloadAcceptedTimeout) * time.Millisecond)
+		defer acceptedTicker.Stop()
+		acceptedTickerChannel = acceptedTicker.C
+	}
+
+	//stop receiving payloads once asked to disconnect
+	sendChannel := c.SendChannel
+	broadcastChannel := c.broadcastChannel
+	disconnectChannel := c.disconnectChannel
+
+	//flush what's buffered, close the socket and stop receiving payloads,
+	//the close is then read by closeListener
+	disconnect := func() {
+		c.disconnectLock.Lock()
+		c.disconnecting = true
+		c.disconnectLock.Unlock()
+		c.flushBufferToSocket()
+		c.stopWriter()
+		<-c.writerDoneChannel
+		c.noFlushDisconnect()
+		close(c.flushedChannel)
+		sendChannel = nil
+		broadcastChannel = nil
+		disconnectChannel = nil
+	}
+
+	//flush after FramingTimeout, or straight away if there isn't one
+	scheduleFlush := func() {
+		if shortTimeoutDuration > zeroTimeoutDuration {
+			//schedule short timeout
+			timeoutTimer.Reset(shortTimeoutDuration)
+		} else {
+			//flush buffer to socket
+			c.flushBufferToSocket()
+			timeoutTimer.Reset(longTimeoutDuration)
+		}
+	}
+
+	//marshalListeners stop once sendListener does, writeListener
+	//finishes whatever has already been flushed
+	defer close(c.marshalChannel)
+	defer func() {
+		c.stopWriter()
+		frameChunkPool.Put(c.frameChunk)
+
+		//nothing is replayed from a closed connection's buffer
+		c.inFlightBufferLock.Lock()
+		depth := c.inFlightPayloadBuffer.Len()
+		c.inFlightBufferLock.Unlock()
+		c.metrics.InFlightBufferDepthChanged(-depth)
+	}()
+
 	for {
 		if appleError != nil {
 			break
 		}
 		select {
-		case sendPayload := <-c.SendChannel:
+		case sendPayload := <-sendChannel:
 			if sendPayload == nil {
-				//channel was closed
-				return
+				//channel was closed, disconnect once what's already framed is written
+				disconnect()
+				break
 			}
-			idPayloadObj := &idPayload{
-				Payload: sendPayload,
-				ID:      c.payloadIdCounter,
+			batch, open := c.receiveBatch(sendPayload, sendChannel)
+			c.marshalPayloads(batch)
+			for i := range batch {
+				c.bufferMarshalledPayload(&batch[i])
+				batch[i].release()
 			}
-
-			// increment payload id counter but don't allow
-			// 0 as valid id as it is the null value
-			// only a problem if we overflow a uint32
-			c.payloadIdCounter++
-
-			if c.payloadIdCounter == 0 {
-				c.payloadIdCounter = 1
-			}
-
-			err := c.bufferPayload(idPayloadObj)
-			if err != nil {
-				fmt.Print(err)
+			if !open {
+				disconnect()
 				break
 			}
-
-			if shortTimeoutDuration > zeroTimeoutDuration {
-				//schedule short timeout
-				timeoutTimer.Reset(shortTimeoutDuration)
-			} else {
-				//flush buffer to socket
-				c.inFlightBufferLock.Lock()
-				c.flushBufferToSocket()
-				c.inFlightBufferLock.Unlock()
-				timeoutTimer.Reset(longTimeoutDuration)
-			}
+			scheduleFlush()
+			break
+		case batch := <-broadcastChannel:
+			c.bufferBroadcast(batch)
+			batch.done <- true
+			scheduleFlush()
 			break
 		case <-timeoutTimer.C:
 			//flush buffer to socket
-			c.inFlightBufferLock.Lock()
 			c.flushBufferToSocket()
-			c.inFlightBufferLock.Unlock()
 			timeoutTimer.Reset(longTimeoutDuration)
 			break
+		case <-acceptedTickerChannel:
+			c.reportAcceptedPayloads()
+			break
+		case <-disconnectChannel:
+			//flush on disconnect, then wait for the socket close to be read
+			disconnect()
+			break
 		case appleError = <-errCloseChannel:
 			break
 		}
 	}
 
+	//no longer accepting payloads
+	timeoutTimer.Stop()
+	c.markClosed()
+
+	c.inFlightBufferLock.Lock()
+	results := c.resolveInFlightPayloads(appleError)
+	c.inFlightBufferLock.Unlock()
+	c.reportPayloadResults(results)
+
 	// gather unsent payload objs
 	unsentPayloads := list.New()
 	var errorPayload *Payload
@@ -389,125 +709,249 @@ func (c *APNSConnection) sendListener(errCloseChannel chan *AppleError) {
 	if appleError.ErrorCode != 0 &&
 			appleError.ErrorCode != CONNECTION_CLOSED_DISCONNECT &&
 			appleError.MessageID != 0 {
-		for e := c.inFlightPayloadBuffer.Front(); e != nil; e = e.Next() {
-			idPayloadObj := e.Value.(*idPayload)
-			if idPayloadObj.ID == appleError.MessageID {
-				//found error payload, keep track of it and remove from send buffer
-				errorPayload = idPayloadObj.Payload
-				break
-			}
-			unsentPayloads.PushFront(idPayloadObj.Payload)
+		//everything newer than the error payload is unsent, if the error
+		//payload isn't in the buffer anymore everything in it is unsent
+		errorIndex := c.inFlightPayloadBuffer.indexOf(appleError.MessageID)
+		if errorIndex >= 0 {
+			errorPayload = c.inFlightPayloadBuffer.at(errorIndex).payload()
+		}
+		for i := errorIndex + 1; i < c.inFlightPayloadBuffer.Len(); i++ {
+			unsentPayloads.PushBack(c.inFlightPayloadBuffer.at(i).payload())
 		}
 	}
 
 	// clear error information if we closed the connection
 	if appleError.ErrorCode == CONNECTION_CLOSED_DISCONNECT {
+		c.logger.Log(LOG_INFO, "Disconnected from APNS gateway")
 		appleError = nil
 		errorPayload = nil
+	} else if appleError.ErrorCode == CONNECTION_CLOSED_UNKNOWN {
+		c.logger.Log(LOG_ERROR, "Connection to APNS gateway closed unexpectedly",
+			"error", appleError.ErrorString)
+	} else {
+		c.metrics.AppleErrorResponse(appleError.ErrorCode)
+		c.logger.Log(LOG_WARN, "Apple error response",
+			"code", appleError.ErrorCode, "error", appleError.ErrorString,
+			"id", appleError.MessageID, "unsent", unsentPayloads.Len())
 	}
 
-	//connection close channel write and close
-	go func() {
-		c.CloseChannel <- &ConnectionClose{
-			Error:                       appleError,
-			UnsentPayloads:              unsentPayloads,
-			ErrorPayload:                errorPayload,
-			UnsentPayloadBufferOverflow: (unsentPayloads.Len() > 0 && errorPayload == nil),
-		}
+	if unsentPayloads.Len() > 0 && errorPayload == nil {
+		c.logger.Log(LOG_WARN, "Error payload not found in in flight payload buffer, unsent payloads were lost",
+			"id", appleError.MessageID, "buffer_size", c.config.InFlightPayloadBufferSize)
+	}
 
-		close(c.CloseChannel)
-	}()
+	//connection close channel write and close
+	//CloseChannel is buffered so this never blocks
+	c.CloseChannel <- &ConnectionClose{
+		Error:                       appleError,
+		UnsentPayloads:              unsentPayloads,
+		ErrorPayload:                errorPayload,
+		UnsentPayloadBufferOverflow: (unsentPayloads.Len() > 0 && errorPayload == nil),
+	}
+	close(c.CloseChannel)
 }
 
-//Write buffer payload to tcp frame buffer and flush if tcp frame buffer full
-//THREADSAFE (with regard to interaction with the frameBuffer using frameBufferLock)
-func (c *APNSConnection) bufferPayload(idPayloadObj *idPayload) error {
-	token, err := hex.DecodeString(idPayloadObj.Payload.Token)
+//Frame a marshalled payload, reporting it as dropped if it can't be framed
+func (c *APNSConnection) bufferMarshalledPayload(m *marshalledPayload) {
+	err := m.Err
+	if err == nil {
+		c.payloadMarshalled(m.Payload, m.Truncation)
+		err = c.bufferPayload(m)
+	}
 	if err != nil {
-		return fmt.Errorf("Error decoding token for payload %+v : %v\n", idPayloadObj.Payload, err)
+		c.dropPayload(err)
 	}
+}
 
-	if len(token) != APNS_TOKEN_SIZE {
-		return fmt.Errorf("Invalid token length. Was %v bytes but should have been %v bytes\n", len(token), APNS_TOKEN_SIZE)
+//Record a marshalled payload, logging what was truncated if anything
+func (c *APNSConnection) payloadMarshalled(payload *Payload, truncation *TruncationResult) {
+	c.metrics.PayloadMarshalled(truncation != nil)
+	if truncation != nil {
+		c.logger.Log(LOG_DEBUG, "Truncated payload to fit",
+			"token", payload.Token, "shortened", truncation.Shortened,
+			"dropped", truncation.DroppedCustomFields)
 	}
+}
 
-	payloadBytes, err := idPayloadObj.Payload.Marshal(c.config.MaxPayloadSize)
-	if err != nil {
-		return fmt.Errorf("Error marshalling payload %+v : %v\n", idPayloadObj.Payload, err)
-	}
+//Report a payload that can't be framed as dropped
+func (c *APNSConnection) dropPayload(err *InvalidPayloadError) {
+	c.logger.Log(LOG_WARN, "Dropped invalid payload",
+		"token", err.Payload.Token, "error", err.Err)
+	c.metrics.PayloadDropped()
+	if c.config.InvalidPayloadCallback != nil {
+		c.config.InvalidPayloadCallback(err)
+	}
+	c.reportPayloadResults([]*PayloadResult{{
+		Payload: err.Payload,
+		Status:  PAYLOAD_DROPPED,
+		Error:   err,
+	}})
+}
+
+//Write marshalled payload to the frame chunk and flush if the chunk is full
+//Only called from sendListener
+//Returns an *InvalidPayloadError if the payload can't be framed
+//Only payloads that are buffered use up an ID, so IDs in the in flight buffer are consecutive
+func (c *APNSConnection) bufferPayload(m *marshalledPayload) *InvalidPayloadError {
+	payload := m.Payload
 
-	c.inFlightPayloadBuffer.PushFront(idPayloadObj)
-	//check to see if we've overrun our buffer
-	//if so, remove one from the buffer
-	if c.inFlightPayloadBuffer.Len() > c.config.InFlightPayloadBufferSize {
-		c.inFlightPayloadBuffer.Remove(c.inFlightPayloadBuffer.Back())
+	idPayloadObj := idPayload{
+		Payload:        payload,
+		BroadcastToken: m.BroadcastToken,
+		ID:             c.payloadIdCounter,
+	}
+	frame := Frame{
+		Token:      m.Token[:],
+		Payload:    *m.JSON,
+		ID:         idPayloadObj.ID,
+		Expiration: payload.ExpirationTime,
+		Priority:   payload.sendPriority(),
 	}
 
-	//acquire lock to tcp buffer to do length checking, buffer writing,
-	//and potentially flush buffer
-	c.inFlightBufferLock.Lock()
-	defer c.inFlightBufferLock.Unlock()
+	//check to see if we should flush the frame chunk
+	if len(*c.frameChunk)+frame.LenWireFormat(c.config.WireFormat) > TCP_FRAME_MAX {
+		c.flushBufferToSocket()
+	}
+	//a bad frame leaves the chunk alone
+	frameBytes, err := frame.AppendWireFormat(*c.frameChunk, c.config.WireFormat)
+	if err != nil {
+		return newInvalidPayloadError(idPayloadObj.payload(), err)
+	}
+	*c.frameChunk = frameBytes
+	c.frameChunkPayloadCount++
+	c.frameChunkLastID = idPayloadObj.ID
 
-	//write token
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(1))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(APNS_TOKEN_SIZE))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, token)
+	// increment payload id counter but don't allow
+	// 0 as valid id as it is the null value
+	// only a problem if we overflow a uint32
+	c.payloadIdCounter++
 
-	//write payload
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(2))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(len(payloadBytes)))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, payloadBytes)
+	if c.payloadIdCounter == 0 {
+		c.payloadIdCounter = 1
+	}
 
-	//write id
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(3))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(4))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, idPayloadObj.ID)
+	c.inFlightBufferLock.Lock()
+	//if we've filled our buffer the oldest payload is evicted
+	evicted, wasFull := c.inFlightPayloadBuffer.push(idPayloadObj)
+	c.inFlightBufferLock.Unlock()
 
-	//write expire date if set
-	if idPayloadObj.Payload.ExpirationTime != 0 {
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(4))
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(4))
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, idPayloadObj.Payload.ExpirationTime)
+	if wasFull && !evicted.Resolved {
+		//can no longer be replayed or rejected, it's only accepted
+		//if its timeout has passed
+		result := &PayloadResult{
+			ID:      evicted.ID,
+			Payload: evicted.payload(),
+			Status:  PAYLOAD_UNKNOWN,
+			Error:   ErrPayloadEvicted,
+		}
+		if c.acceptedByNow(&evicted) {
+			result.Status = PAYLOAD_ACCEPTED
+			result.Error = nil
+		}
+		c.reportPayloadResults([]*PayloadResult{result})
 	}
-
-	//write priority if set correctly
-	if idPayloadObj.Payload.Priority == 10 || idPayloadObj.Payload.Priority == 5 {
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(5))
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(4))
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, idPayloadObj.Payload.Priority)
+	if !wasFull {
+		c.metrics.InFlightBufferDepthChanged(1)
 	}
+	c.metrics.PayloadBuffered()
 
-	//check to see if we should flush inFlightFrameByteBuffer
-	if c.inFlightFrameByteBuffer.Len()+c.inFlightItemByteBuffer.Len()+NOTIFICATION_HEADER_SIZE > TCP_FRAME_MAX {
-		c.flushBufferToSocket()
-	}
+	return nil
+}
 
-	//write header info and item info
-	binary.Write(c.inFlightFrameByteBuffer, binary.BigEndian, uint8(2))
-	binary.Write(c.inFlightFrameByteBuffer, binary.BigEndian, uint32(c.inFlightItemByteBuffer.Len()))
-	c.inFlightItemByteBuffer.WriteTo(c.inFlightFrameByteBuffer)
+//Whether the payload was flushed more than PayloadAcceptedTimeout ago
+func (c *APNSConnection) acceptedByNow(idPayloadObj *idPayload) bool {
+	acceptedBefore := time.Now().Add(-time.Duration(c.config.PayloadAcceptedTimeout) * time.Millisecond)
+	return !idPayloadObj.FlushedAt.IsZero() && !idPayloadObj.FlushedAt.After(acceptedBefore)
+}
 
-	c.inFlightItemByteBuffer.Reset()
+//Report payloads flushed more than PayloadAcceptedTimeout ago as accepted
+func (c *APNSConnection) reportAcceptedPayloads() {
+	results := []*PayloadResult{}
 
-	return nil
+	c.inFlightBufferLock.Lock()
+	//oldest payloads first
+	for i := 0; i < c.inFlightPayloadBuffer.Len(); i++ {
+		idPayloadObj := c.inFlightPayloadBuffer.at(i)
+		if idPayloadObj.Resolved {
+			continue
+		}
+		if !c.acceptedByNow(idPayloadObj) {
+			break
+		}
+		idPayloadObj.Resolved = true
+		results = append(results, &PayloadResult{
+			ID:      idPayloadObj.ID,
+			Payload: idPayloadObj.payload(),
+			Status:  PAYLOAD_ACCEPTED,
+		})
+	}
+	c.inFlightBufferLock.Unlock()
+
+	c.reportPayloadResults(results)
 }
 
 //NOT THREADSAFE (need to acquire inFlightBufferLock before calling)
-//Write tcp frame buffer to socket and reset when done
-//Close on error
-func (c *APNSConnection) flushBufferToSocket() {
-	//if buffer not created, or zero length, do nothing
-	if c.inFlightFrameByteBuffer == nil || c.inFlightFrameByteBuffer.Len() == 0 {
-		return
+//Resolve every unresolved in flight payload once the connection has closed with appleError
+func (c *APNSConnection) resolveInFlightPayloads(appleError *AppleError) []*PayloadResult {
+	if c.config.PayloadResultCallback == nil {
+		return nil
+	}
+
+	results := []*PayloadResult{}
+	//payloads newer than the error payload were never processed by apple,
+	//the error payload was rejected and anything older was accepted
+	//without an error payload (including Disconnect) we can't know, so only
+	//payloads flushed more than PayloadAcceptedTimeout ago are accepted
+	newerStatus := PAYLOAD_UNKNOWN
+	olderStatus := PAYLOAD_UNKNOWN
+	var newerError error = appleError
+	if appleError.ErrorCode != 0 && appleError.MessageID != 0 {
+		newerStatus = PAYLOAD_UNSENT
+		newerError = nil
+		olderStatus = PAYLOAD_ACCEPTED
+	}
+
+	errorIndex := -1
+	if newerStatus == PAYLOAD_UNSENT {
+		errorIndex = c.inFlightPayloadBuffer.indexOf(appleError.MessageID)
+	}
+
+	//report in send order
+	for i := 0; i < c.inFlightPayloadBuffer.Len(); i++ {
+		idPayloadObj := c.inFlightPayloadBuffer.at(i)
+		resultStatus := olderStatus
+		var resultErr error
+		if i == errorIndex {
+			resultStatus = PAYLOAD_REJECTED
+			resultErr = appleError
+		} else if idPayloadObj.Resolved {
+			//a late rejection is still reported even if the payload
+			//was already reported as accepted
+			continue
+		} else if newerStatus == PAYLOAD_UNKNOWN && c.acceptedByNow(idPayloadObj) {
+			resultStatus = PAYLOAD_ACCEPTED
+		} else if i > errorIndex {
+			resultStatus = newerStatus
+			resultErr = newerError
+		}
+		idPayloadObj.Resolved = true
+		results = append(results, &PayloadResult{
+			ID:      idPayloadObj.ID,
+			Payload: idPayloadObj.payload(),
+			Status:  resultStatus,
+			Error:   resultErr,
+		})
 	}
 
-	bufBytes := c.inFlightFrameByteBuffer.Bytes()
+	return results
+}
 
-	//write to socket
-	_, writeErr := c.socket.Write(bufBytes)
-	if writeErr != nil {
-		fmt.Printf("Error while writing to socket \n%v\n", writeErr)
-		defer c.noFlushDisconnect()
+//Hand results to the PayloadResultCallback if there is one
+func (c *APNSConnection) reportPayloadResults(results []*PayloadResult) {
+	if c.config.PayloadResultCallback == nil {
+		return
+	}
+	for _, result := range results {
+		c.config.PayloadResultCallback(result)
 	}
-	c.inFlightFrameByteBuffer.Reset()
 }
@@ -0,0 +1,584 @@
+package apns
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Strategy for choosing which pool member a payload is sent on
+type PoolStrategy int
+
+const (
+	//Send each payload on the next member in turn
+	POOL_ROUND_ROBIN PoolStrategy = iota
+	//Send every payload for a device token on the same member
+	//so notifications to a device keep their order
+	POOL_TOKEN_HASH
+)
+
+//Config for creating an APNSConnectionPool
+type APNSConnectionPoolConfig struct {
+	//config used to dial each member : required unless Dial is supplied
+	APNSConfig *APNSConfig
+	//number of connections to keep open, defaults to 1
+	Size int
+	//how payloads are spread across members, defaults to POOL_ROUND_ROBIN
+	Strategy PoolStrategy
+	//number of milliseconds to wait after a member fails to dial, defaults to 100
+	InitialBackoff int
+	//max number of milliseconds to wait between redials, defaults to 30000
+	MaxBackoff int
+	//creates each member connection, defaults to calling NewAPNSConnection with APNSConfig
+	Dial func() (*APNSConnection, error)
+	//called (from the member's go-routine) with the error from each failed dial
+	//before waiting to redial, failures are also logged to APNSConfig's Logger
+	DialErrorCallback func(error)
+}
+
+//Pool of APNS connections sharing one config
+//Dead members are redialed, their ConnectionClose is reported on the pool's CloseChannel
+type APNSConnectionPool struct {
+	//Channel to send payloads on
+	SendChannel chan *Payload
+	//Channel every member's connection close is received on, in the order they're reported
+	//Clean closes caused by Disconnect or Resize are only reported
+	//if they left payloads unsent
+	//Closes are queued until received so members never block on it,
+	//it's closed after Disconnect once every close has been received
+	CloseChannel chan *ConnectionClose
+	//config
+	config *APNSConnectionPoolConfig
+	//logger filtered to APNSConfig.LogLevel
+	logger Logger
+	//current members
+	members []*poolMember
+	//Mutex to sync access to members
+	membersLock *sync.RWMutex
+	//round robin position
+	nextMember uint32
+	//closed to stop dispatching payloads
+	stopChannel chan bool
+	//closed once the dispatch go-routine has handed off its last payload
+	dispatchDoneChannel chan bool
+	//guards against stopping twice
+	stopOnce *sync.Once
+	//tracks running member go-routines
+	memberWaitGroup *sync.WaitGroup
+	//closed once a member has dialed and dialedConfig is set
+	dialedChannel chan bool
+	//guards against closing dialedChannel twice
+	dialedOnce *sync.Once
+	//config of the first connection dialed, templates are broadcast with it
+	dialedConfig *APNSConfig
+	//closes waiting to be sent on CloseChannel, in the order they were reported
+	reports *list.List
+	//Mutex to sync access to reports and reportsFinished
+	reportsLock *sync.Mutex
+	//signalled when a close is queued or reportsFinished is set
+	reportSignal chan bool
+	//set once Disconnect has stopped every member, so nothing more is reported
+	reportsFinished bool
+}
+
+//One connection slot in the pool
+type poolMember struct {
+	//pool this member belongs to
+	pool *APNSConnectionPool
+	//payloads dispatched to this member
+	inputChannel chan *Payload
+	//broadcast tokens dispatched to this member
+	broadcastChannel chan *broadcastBatch
+	//closed when the member is removed from the pool
+	stopChannel chan bool
+	//wait between redials
+	backoff *backoff
+}
+
+// Apply config defaults to given APNSConnectionPoolConfig
+func applyPoolConfigDefaults(config *APNSConnectionPoolConfig) error {
+	errorStrs := ""
+
+	if config.APNSConfig == nil && config.Dial == nil {
+		errorStrs += "Invalid APNSConfig. Required when Dial isn't supplied\n"
+	}
+	if config.Size < 0 {
+		errorStrs += "Invalid Size. Should be > 0\n"
+	}
+	if config.Strategy != POOL_ROUND_ROBIN && config.Strategy != POOL_TOKEN_HASH {
+		errorStrs += "Invalid Strategy. Should be POOL_ROUND_ROBIN or POOL_TOKEN_HASH\n"
+	}
+	if config.InitialBackoff < 0 || config.MaxBackoff < 0 {
+		errorStrs += "Invalid InitialBackoff/MaxBackoff. Should be >= 0\n"
+	}
+
+	if errorStrs != "" {
+		return errors.New(errorStrs)
+	}
+
+	if config.Size == 0 {
+		config.Size = 1
+	}
+	if config.InitialBackoff == 0 {
+		config.InitialBackoff = 100
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = 30000
+	}
+	if config.MaxBackoff < config.InitialBackoff {
+		config.MaxBackoff = config.InitialBackoff
+	}
+	if config.Dial == nil {
+		apnsConfig := config.APNSConfig
+		config.Dial = func() (*APNSConnection, error) {
+			return NewAPNSConnection(apnsConfig)
+		}
+	}
+	return nil
+}
+
+//Create a new connection pool with supplied config
+//If invalid config an error will be returned
+//Members are dialed in the background
+func NewAPNSConnectionPool(config *APNSConnectionPoolConfig) (*APNSConnectionPool, error) {
+	err := applyPoolConfigDefaults(config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := new(APNSConnectionPool)
+	p.config = config
+	p.SendChannel = make(chan *Payload)
+	p.CloseChannel = make(chan *ConnectionClose)
+	p.logger = nopLogger{}
+	if config.APNSConfig != nil {
+		p.logger = newLevelLogger(config.APNSConfig.Logger, config.APNSConfig.LogLevel)
+	}
+	p.membersLock = new(sync.RWMutex)
+	p.stopChannel = make(chan bool)
+	p.dispatchDoneChannel = make(chan bool)
+	p.stopOnce = new(sync.Once)
+	p.memberWaitGroup = new(sync.WaitGroup)
+	p.dialedChannel = make(chan bool)
+	p.dialedOnce = new(sync.Once)
+	p.reports = list.New()
+	p.reportsLock = new(sync.Mutex)
+	p.reportSignal = make(chan bool, 1)
+
+	p.Resize(config.Size)
+
+	go p.dispatchListener()
+	go p.reportListener()
+
+	return p, nil
+}
+
+//Number of members in the pool
+func (p *APNSConnectionPool) Size() int {
+	p.membersLock.RLock()
+	defer p.membersLock.RUnlock()
+
+	return len(p.members)
+}
+
+//Grow or shrink the pool to size members
+//Removed members are flushed and disconnected
+//With POOL_TOKEN_HASH resizing changes which member a token maps to
+func (p *APNSConnectionPool) Resize(size int) error {
+	if size < 1 {
+		return errors.New("Invalid size. Should be > 0")
+	}
+
+	p.membersLock.Lock()
+	defer p.membersLock.Unlock()
+
+	select {
+	case <-p.stopChannel:
+		return errors.New("Pool is disconnected")
+	default:
+	}
+
+	for len(p.members) < size {
+		member := &poolMember{
+			pool:             p,
+			inputChannel:     make(chan *Payload),
+			broadcastChannel: make(chan *broadcastBatch),
+			stopChannel:      make(chan bool),
+			backoff:          newBackoff(p.config.InitialBackoff, p.config.MaxBackoff, 2, 0),
+		}
+		p.members = append(p.members, member)
+		p.memberWaitGroup.Add(1)
+		go member.run()
+	}
+
+	for len(p.members) > size {
+		member := p.members[len(p.members)-1]
+		p.members = p.members[:len(p.members)-1]
+		close(member.stopChannel)
+	}
+
+	return nil
+}
+
+//Disconnect every member from the Apns Gateway
+//Flushes any currently unsent messages before returning
+//CloseChannel is closed once the closes still queued have been received
+func (p *APNSConnectionPool) Disconnect() {
+	p.stopOnce.Do(func() {
+		//let any payload being dispatched reach its member first
+		close(p.stopChannel)
+		<-p.dispatchDoneChannel
+
+		p.membersLock.Lock()
+		for _, member := range p.members {
+			close(member.stopChannel)
+		}
+		p.members = nil
+		p.membersLock.Unlock()
+
+		//members report their last close before stopping
+		p.memberWaitGroup.Wait()
+		p.reportsLock.Lock()
+		p.reportsFinished = true
+		p.reportsLock.Unlock()
+		p.signalReports()
+	})
+
+	p.memberWaitGroup.Wait()
+}
+
+//go-routine to hand payloads from SendChannel to members
+func (p *APNSConnectionPool) dispatchListener() {
+	defer close(p.dispatchDoneChannel)
+
+	for {
+		select {
+		case payload := <-p.SendChannel:
+			p.dispatch(payload)
+		case <-p.stopChannel:
+			return
+		}
+	}
+}
+
+//Hand payload to a member, picking again if that member is removed first
+func (p *APNSConnectionPool) dispatch(payload *Payload) {
+	for {
+		member := p.pickMember(payload.Token)
+		if member == nil {
+			//pool has been disconnected
+			unsentPayloads := list.New()
+			unsentPayloads.PushBack(payload)
+			p.report(&ConnectionClose{UnsentPayloads: unsentPayloads})
+			return
+		}
+
+		select {
+		case member.inputChannel <- payload:
+			return
+		case <-member.stopChannel:
+		}
+	}
+}
+
+//Choose the member a payload for token should be sent on according to the pool strategy
+func (p *APNSConnectionPool) pickMember(token string) *poolMember {
+	p.membersLock.RLock()
+	defer p.membersLock.RUnlock()
+
+	if len(p.members) == 0 {
+		return nil
+	}
+
+	var index uint32
+	if p.config.Strategy == POOL_TOKEN_HASH {
+		hash := fnv.New32a()
+		hash.Write([]byte(token))
+		index = hash.Sum32()
+	} else {
+		index = atomic.AddUint32(&p.nextMember, 1) - 1
+	}
+
+	return p.members[index%uint32(len(p.members))]
+}
+
+//Send template to every token from tokens, spread across members by the pool strategy
+//Waits until each token has been handed to a member or ctx is done
+//The template is marshalled once with the MaxPayloadSize and TruncationPolicy of
+//the first connection dialed (waiting for it if need be), then each token is
+//framed with its own ID by the member's connection
+//template.Token is ignored, tokens that can't be sent because their member's
+//connection closed are reported on CloseChannel as copies of template with Token set
+//Returns an *InvalidPayloadError (without taking any tokens) if template can't be marshalled
+//Returns a *BroadcastError if the pool is disconnected or ctx is done first
+func (p *APNSConnectionPool) Broadcast(ctx context.Context, template *Payload, tokens TokenIterator) error {
+	err := template.validateBinary()
+	if err != nil {
+		return newInvalidPayloadError(template, err)
+	}
+
+	select {
+	case <-p.dialedChannel:
+	default:
+		//no member has dialed yet
+		select {
+		case <-p.dialedChannel:
+		case <-p.stopChannel:
+			return &BroadcastError{Err: ErrConnectionClosed}
+		case <-ctx.Done():
+			return &BroadcastError{Err: ctx.Err()}
+		}
+	}
+	config := p.dialedConfig
+
+	//shared by every member, so not pooled
+	jsonStr, _, err := template.appendJSON(nil, config.MaxPayloadSize, config.TruncationPolicy)
+	if err != nil {
+		return newInvalidPayloadError(template, err)
+	}
+
+	//tokens are batched per member
+	batches := map[*poolMember]*broadcastBatch{}
+	//members with a batch, in the order their batches were started
+	batchMembers := []*poolMember{}
+	removeBatch := func(member *poolMember) *broadcastBatch {
+		batch := batches[member]
+		delete(batches, member)
+		for i, m := range batchMembers {
+			if m == member {
+				batchMembers = append(batchMembers[:i], batchMembers[i+1:]...)
+				break
+			}
+		}
+		return batch
+	}
+	//tokens followed by every token taken but not handed off,
+	//batch by batch in the order the batches were started
+	unsentTokens := func(tokens ...string) []string {
+		for _, member := range batchMembers {
+			tokens = append(tokens, batches[member].tokens...)
+		}
+		return tokens
+	}
+
+	for {
+		token, ok := tokens.Next()
+		if !ok {
+			break
+		}
+
+		member := p.pickMember(token)
+		if member == nil {
+			return &BroadcastError{UnsentTokens: unsentTokens(token), Err: ErrConnectionClosed}
+		}
+		batch := batches[member]
+		if batch == nil {
+			batch = newBroadcastBatch(template, &jsonStr)
+			batches[member] = batch
+			batchMembers = append(batchMembers, member)
+		}
+		batch.tokens = append(batch.tokens, token)
+		if len(batch.tokens) < cap(batch.tokens) {
+			continue
+		}
+
+		removeBatch(member)
+		err := p.dispatchBroadcast(ctx, member, batch)
+		if err != nil {
+			return &BroadcastError{UnsentTokens: unsentTokens(batch.tokens...), Err: err}
+		}
+	}
+
+	for len(batchMembers) > 0 {
+		member := batchMembers[0]
+		batch := removeBatch(member)
+		err := p.dispatchBroadcast(ctx, member, batch)
+		if err != nil {
+			return &BroadcastError{UnsentTokens: unsentTokens(batch.tokens...), Err: err}
+		}
+	}
+	return nil
+}
+
+//Hand a broadcast batch to member, picking again if that member is removed first
+func (p *APNSConnectionPool) dispatchBroadcast(ctx context.Context, member *poolMember, batch *broadcastBatch) error {
+	for {
+		select {
+		case member.broadcastChannel <- batch:
+			return nil
+		case <-member.stopChannel:
+			//with POOL_TOKEN_HASH the batch stays together on the first token's new member
+			member = p.pickMember(batch.tokens[0])
+			if member == nil {
+				return ErrConnectionClosed
+			}
+		case <-p.stopChannel:
+			return ErrConnectionClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//Queue a member's connection close to be sent on CloseChannel without blocking the member
+func (p *APNSConnectionPool) report(connectionClose *ConnectionClose) {
+	if connectionClose.Error == nil && connectionClose.UnsentPayloads.Len() == 0 {
+		//clean close, nothing to report
+		return
+	}
+
+	p.reportsLock.Lock()
+	p.reports.PushBack(connectionClose)
+	p.reportsLock.Unlock()
+	p.signalReports()
+}
+
+//Wake reportListener without blocking, a pending signal already wakes it
+func (p *APNSConnectionPool) signalReports() {
+	select {
+	case p.reportSignal <- true:
+	default:
+	}
+}
+
+//go-routine to send queued closes on CloseChannel in the order they were reported
+//Closes CloseChannel once Disconnect has finished and the queue is empty
+func (p *APNSConnectionPool) reportListener() {
+	defer close(p.CloseChannel)
+
+	for {
+		p.reportsLock.Lock()
+		front := p.reports.Front()
+		if front != nil {
+			p.reports.Remove(front)
+		}
+		finished := p.reportsFinished
+		p.reportsLock.Unlock()
+
+		if front != nil {
+			p.CloseChannel <- front.Value.(*ConnectionClose)
+		} else if finished {
+			return
+		} else {
+			<-p.reportSignal
+		}
+	}
+}
+
+//go-routine to keep a connection open and send it dispatched payloads
+//With POOL_TOKEN_HASH payloads left unsent by a dead connection are replayed
+//on the next one before anything new, so notifications to a device keep their order
+func (m *poolMember) run() {
+	defer m.pool.memberWaitGroup.Done()
+
+	replay := m.pool.config.Strategy == POOL_TOKEN_HASH
+	//payloads waiting to be replayed, in send order
+	pendingPayloads := list.New()
+
+	var conn *APNSConnection
+	for {
+		if conn == nil {
+			conn = m.dial()
+			if conn == nil {
+				//removed while dialing
+				m.pool.report(&ConnectionClose{UnsentPayloads: pendingPayloads})
+				return
+			}
+		}
+
+		if pendingPayloads.Len() > 0 {
+			select {
+			case conn.SendChannel <- pendingPayloads.Front().Value.(*Payload):
+				pendingPayloads.Remove(pendingPayloads.Front())
+			case connectionClose := <-conn.CloseChannel:
+				m.closed(conn, connectionClose, pendingPayloads, replay)
+				conn = nil
+			case <-m.stopChannel:
+				conn.Disconnect()
+				m.closed(conn, <-conn.CloseChannel, pendingPayloads, false)
+				return
+			}
+			continue
+		}
+
+		select {
+		case payload := <-m.inputChannel:
+			//if conn has closed the payload is returned by release
+			conn.SendChannel <- payload
+		case batch := <-m.broadcastChannel:
+			err := conn.handOffBroadcast(context.Background(), batch)
+			if err != nil {
+				//conn has closed, its close is received next time round
+				unsentPayloads := list.New()
+				for _, payload := range batch.payloads() {
+					unsentPayloads.PushBack(payload)
+				}
+				if replay {
+					pendingPayloads.PushBackList(unsentPayloads)
+				} else {
+					m.pool.report(&ConnectionClose{UnsentPayloads: unsentPayloads})
+				}
+				break
+			}
+			<-batch.done
+		case connectionClose := <-conn.CloseChannel:
+			m.closed(conn, connectionClose, pendingPayloads, replay)
+			conn = nil
+		case <-m.stopChannel:
+			conn.Disconnect()
+			m.closed(conn, <-conn.CloseChannel, pendingPayloads, false)
+			return
+		}
+	}
+}
+
+//Release a dead connection and report its close
+//Its unsent payloads and anything handed to it after it closed are either
+//queued ahead of pendingPayloads for replay or reported along with pendingPayloads
+func (m *poolMember) closed(conn *APNSConnection, connectionClose *ConnectionClose, pendingPayloads *list.List, replay bool) {
+	unsentPayloads := connectionClose.UnsentPayloads
+	unsentPayloads.PushBackList(conn.release())
+
+	if replay {
+		//sent before anything still pending
+		pendingPayloads.PushFrontList(unsentPayloads)
+		connectionClose.UnsentPayloads = list.New()
+	} else {
+		unsentPayloads.PushBackList(pendingPayloads)
+		pendingPayloads.Init()
+	}
+	m.pool.report(connectionClose)
+}
+
+//Dial until a connection is made, waiting between failed attempts
+//Returns nil if the member is removed first
+func (m *poolMember) dial() *APNSConnection {
+	for {
+		conn, err := m.pool.config.Dial()
+		if err == nil {
+			m.backoff.Reset()
+			m.pool.dialedOnce.Do(func() {
+				m.pool.dialedConfig = conn.config
+				close(m.pool.dialedChannel)
+			})
+			return conn
+		}
+
+		m.pool.logger.Log(LOG_WARN, "Pool member failed to dial, redialing", "error", err)
+		if m.pool.config.DialErrorCallback != nil {
+			m.pool.config.DialErrorCallback(err)
+		}
+
+		timer := time.NewTimer(m.backoff.Next())
+		select {
+		case <-timer.C:
+		case <-m.stopChannel:
+			timer.Stop()
+			return nil
+		}
+	}
+}
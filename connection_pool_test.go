@@ -0,0 +1,343 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+//Pool whose members are mock sockets, each recording to its own Notifications channel
+type testPool struct {
+	Pool    *APNSConnectionPool
+	Sockets chan MockConnRejectToken
+}
+
+func newTestPool(t *testing.T, size int, strategy PoolStrategy, rejectToken string) *testPool {
+	tp := &testPool{
+		Sockets: make(chan MockConnRejectToken, 100),
+	}
+
+	pool, err := NewAPNSConnectionPool(&APNSConnectionPoolConfig{
+		Size:     size,
+		Strategy: strategy,
+		Dial: func() (*APNSConnection, error) {
+			notifications := make(chan writtenNotification, 100)
+			socket := newMockConnRejectToken(rejectToken, notifications)
+			tp.Sockets <- socket
+			return socketAPNSConnection(socket, testAPNSConfig()), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.Pool = pool
+
+	return tp
+}
+
+//Wait for n members to be dialed
+func (tp *testPool) waitForDials(t *testing.T, n int) []MockConnRejectToken {
+	sockets := []MockConnRejectToken{}
+	for i := 0; i < n; i++ {
+		select {
+		case socket := <-tp.Sockets:
+			sockets = append(sockets, socket)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for dial %v", i+1)
+		}
+	}
+	return sockets
+}
+
+//Wait for n notifications to be written across sockets
+func waitForNotifications(t *testing.T, sockets []MockConnRejectToken, n int) {
+	timeout := time.Now().Add(5 * time.Second)
+	for {
+		written := 0
+		for _, socket := range sockets {
+			written += len(socket.Notifications)
+		}
+		if written == n {
+			return
+		}
+		if time.Now().After(timeout) {
+			t.Fatalf("Timed out waiting for %v notifications, %v were written", n, written)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testToken(i int) string {
+	return fmt.Sprintf("4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede2139%04x", i)
+}
+
+func TestPoolShouldRoundRobinPayloads(t *testing.T) {
+	tp := newTestPool(t, 3, POOL_ROUND_ROBIN, "")
+	sockets := tp.waitForDials(t, 3)
+
+	for i := 0; i < 6; i++ {
+		tp.Pool.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(i)}
+	}
+	waitForNotifications(t, sockets, 6)
+	tp.Pool.Disconnect()
+
+	for i, socket := range sockets {
+		if len(socket.Notifications) != 2 {
+			t.Errorf("Expected member %v to send 2 notifications but sent %v", i, len(socket.Notifications))
+		}
+	}
+}
+
+func TestPoolShouldKeepTokenOnOneMember(t *testing.T) {
+	tp := newTestPool(t, 4, POOL_TOKEN_HASH, "")
+	sockets := tp.waitForDials(t, 4)
+
+	for i := 0; i < 20; i++ {
+		tp.Pool.SendChannel <- &Payload{AlertText: fmt.Sprintf("Testing %v", i), Token: testToken(i % 2)}
+	}
+	waitForNotifications(t, sockets, 20)
+	tp.Pool.Disconnect()
+
+	membersByToken := map[string]int{}
+	for i, socket := range sockets {
+		for len(socket.Notifications) > 0 {
+			notification := <-socket.Notifications
+			member, ok := membersByToken[notification.Token]
+			if ok && member != i {
+				t.Fatalf("Token %v was sent on members %v and %v", notification.Token, member, i)
+			}
+			membersByToken[notification.Token] = i
+		}
+	}
+	if len(membersByToken) != 2 {
+		t.Errorf("Expected 2 tokens to be sent but got %v", len(membersByToken))
+	}
+}
+
+func TestPoolShouldReplaceDeadMember(t *testing.T) {
+	tp := newTestPool(t, 2, POOL_ROUND_ROBIN, "")
+	sockets := tp.waitForDials(t, 2)
+
+	sockets[0].Close()
+
+	select {
+	case connectionClose := <-tp.Pool.CloseChannel:
+		if connectionClose.Error == nil || connectionClose.Error.ErrorCode != CONNECTION_CLOSED_UNKNOWN {
+			t.Errorf("Expected CONNECTION_CLOSED_UNKNOWN but got %v", connectionClose.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for member close")
+	}
+
+	replacement := tp.waitForDials(t, 1)[0]
+
+	for i := 0; i < 4; i++ {
+		tp.Pool.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(i)}
+	}
+	waitForNotifications(t, []MockConnRejectToken{replacement, sockets[1]}, 4)
+	tp.Pool.Disconnect()
+
+	if tp.Pool.Size() != 0 {
+		t.Errorf("Expected no members after Disconnect but got %v", tp.Pool.Size())
+	}
+}
+
+func TestPoolShouldReportMemberErrors(t *testing.T) {
+	rejectToken := testToken(1)
+	tp := newTestPool(t, 2, POOL_TOKEN_HASH, rejectToken)
+	tp.waitForDials(t, 2)
+
+	tp.Pool.SendChannel <- &Payload{AlertText: "Testing", Token: rejectToken}
+
+	select {
+	case connectionClose := <-tp.Pool.CloseChannel:
+		if connectionClose.Error == nil || connectionClose.Error.ErrorCode != 8 {
+			t.Errorf("Expected error 8 but got %v", connectionClose.Error)
+		}
+		if connectionClose.ErrorPayload == nil || connectionClose.ErrorPayload.Token != rejectToken {
+			t.Errorf("Expected error payload for %v but got %v", rejectToken, connectionClose.ErrorPayload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for member error")
+	}
+
+	//rejecting member is redialed
+	tp.waitForDials(t, 1)
+	tp.Pool.Disconnect()
+}
+
+func TestPoolShouldReplayUnsentPayloadsBeforeNewOnes(t *testing.T) {
+	rejectToken := testToken(1)
+	tp := newTestPool(t, 1, POOL_TOKEN_HASH, rejectToken)
+	tp.waitForDials(t, 1)
+
+	//everything after the rejected payload is left unsent
+	tp.Pool.SendChannel <- &Payload{AlertText: "Testing", Token: rejectToken}
+	for i := 2; i < 5; i++ {
+		tp.Pool.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(i)}
+	}
+
+	replacement := tp.waitForDials(t, 1)[0]
+	tp.Pool.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(5)}
+	waitForNotifications(t, []MockConnRejectToken{replacement}, 4)
+
+	for i := 2; i < 6; i++ {
+		notification := <-replacement.Notifications
+		if notification.Token != testToken(i) {
+			t.Errorf("Expected %v to be sent next but got %v", testToken(i), notification.Token)
+		}
+	}
+
+	connectionClose := <-tp.Pool.CloseChannel
+	if connectionClose.Error == nil || connectionClose.Error.ErrorCode != 8 {
+		t.Errorf("Expected error 8 but got %v", connectionClose.Error)
+	}
+	if connectionClose.UnsentPayloads.Len() != 0 {
+		t.Errorf("Expected unsent payloads to be replayed but %v were reported", connectionClose.UnsentPayloads.Len())
+	}
+	tp.Pool.Disconnect()
+}
+
+func TestPoolShouldQueueClosesUntilReceived(t *testing.T) {
+	sockets := make(chan MockConnRejectToken, 10)
+	pool, err := NewAPNSConnectionPool(&APNSConnectionPoolConfig{
+		Dial: func() (*APNSConnection, error) {
+			socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+			sockets <- socket
+			return socketAPNSConnection(socket, testAPNSConfig()), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//nobody reads CloseChannel while the member dies three times
+	for i := 0; i < 3; i++ {
+		socket := <-sockets
+		socket.Close()
+	}
+	//the member reports its close before redialing
+	<-sockets
+	pool.Disconnect()
+
+	closes := 0
+	for connectionClose := range pool.CloseChannel {
+		if connectionClose.Error == nil || connectionClose.Error.ErrorCode != CONNECTION_CLOSED_UNKNOWN {
+			t.Errorf("Expected CONNECTION_CLOSED_UNKNOWN but got %v", connectionClose.Error)
+		}
+		closes++
+	}
+	if closes != 3 {
+		t.Errorf("Expected 3 closes before CloseChannel closed but got %v", closes)
+	}
+}
+
+func TestPoolShouldReportDialErrors(t *testing.T) {
+	dialErrors := make(chan error, 10)
+	pool, err := NewAPNSConnectionPool(&APNSConnectionPoolConfig{
+		InitialBackoff: 1,
+		Dial: func() (*APNSConnection, error) {
+			return nil, errors.New("Connection refused")
+		},
+		DialErrorCallback: func(err error) {
+			select {
+			case dialErrors <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-dialErrors:
+			if err.Error() != "Connection refused" {
+				t.Errorf("Expected the dial error but got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for dial error")
+		}
+	}
+}
+
+func TestPoolShouldResize(t *testing.T) {
+	tp := newTestPool(t, 1, POOL_ROUND_ROBIN, "")
+	tp.waitForDials(t, 1)
+
+	if err := tp.Pool.Resize(3); err != nil {
+		t.Fatal(err)
+	}
+	grown := tp.waitForDials(t, 2)
+	if tp.Pool.Size() != 3 {
+		t.Errorf("Expected 3 members but got %v", tp.Pool.Size())
+	}
+
+	if err := tp.Pool.Resize(1); err != nil {
+		t.Fatal(err)
+	}
+	if tp.Pool.Size() != 1 {
+		t.Errorf("Expected 1 member but got %v", tp.Pool.Size())
+	}
+
+	//removed members are disconnected
+	for _, socket := range grown {
+		select {
+		case <-socket.CloseChannel:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for removed member to disconnect")
+		}
+	}
+
+	if err := tp.Pool.Resize(0); err == nil {
+		t.Error("Expected error resizing to 0")
+	}
+
+	tp.Pool.Disconnect()
+	if err := tp.Pool.Resize(2); err == nil {
+		t.Error("Expected error resizing a disconnected pool")
+	}
+}
+
+func TestPoolShouldRedialFailedMembers(t *testing.T) {
+	dials := make(chan bool, 10)
+	pool, err := NewAPNSConnectionPool(&APNSConnectionPoolConfig{
+		InitialBackoff: 1,
+		Dial: func() (*APNSConnection, error) {
+			select {
+			case dials <- true:
+			default:
+			}
+			return nil, errors.New("Connection refused")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-dials:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for redial")
+		}
+	}
+	pool.Disconnect()
+}
+
+func TestPoolConfigShouldValidate(t *testing.T) {
+	configs := []*APNSConnectionPoolConfig{
+		{},
+		{APNSConfig: &APNSConfig{}, Size: -1},
+		{APNSConfig: &APNSConfig{}, Strategy: PoolStrategy(5)},
+	}
+
+	for _, config := range configs {
+		if _, err := NewAPNSConnectionPool(config); err == nil {
+			t.Errorf("Expected config error for %+v", config)
+		}
+	}
+}
@@ -2,10 +2,12 @@ package apns
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -138,8 +140,9 @@ func TestConnectionShouldCloseOnReadError(t *testing.T) {
 			case connectionClose := <-apn.CloseChannel:
 				if connectionClose.Error.ErrorCode != CONNECTION_CLOSED_UNKNOWN {
 					fmt.Printf("Should have received error CONNECTION_CLOSED_UNKNOWN for closed socket but received %v\n", connectionClose.Error)
+					t.Fail()
 					syncChan <- true
-					t.FailNow()
+					return
 				}
 				syncChan <- true
 				return
@@ -330,15 +333,17 @@ func TestConnectionShouldCloseAndReturnUnsentOnAppleResponse(t *testing.T) {
 			case connectionClose := <-apn.CloseChannel:
 				if connectionClose.Error.ErrorCode != 8 {
 					fmt.Printf("Should have received error 8 for closed socket but received %v\n", connectionClose.Error)
+					t.Fail()
 					syncChan <- true
-					t.FailNow()
+					return
 				}
 
 				if connectionClose.ErrorPayload == nil ||
 					connectionClose.ErrorPayload.Token != token2 {
 					fmt.Printf("Should have returned payload object but received %v\n", connectionClose.ErrorPayload)
+					t.Fail()
 					syncChan <- true
-					t.FailNow()
+					return
 				}
 
 				for e := connectionClose.UnsentPayloads.Front(); e != nil; e = e.Next() {
@@ -348,21 +353,24 @@ func TestConnectionShouldCloseAndReturnUnsentOnAppleResponse(t *testing.T) {
 				if connectionClose.UnsentPayloads == nil ||
 					connectionClose.UnsentPayloads.Len() != 2 {
 					fmt.Printf("Should have returned 2 unsent payload objects but received %v len %v\n", connectionClose.UnsentPayloads, connectionClose.UnsentPayloads.Len())
+					t.Fail()
 					syncChan <- true
-					t.FailNow()
+					return
 				}
 
 				if connectionClose.UnsentPayloads.Front().Value.(*Payload).Token != token3 &&
 					connectionClose.UnsentPayloads.Back().Value.(*Payload).Token != token4 {
 					fmt.Printf("Expected to receive specific unsent payloads but received %v len %v\n", connectionClose.UnsentPayloads, connectionClose.UnsentPayloads.Len())
+					t.Fail()
 					syncChan <- true
-					t.FailNow()
+					return
 				}
 
 				if connectionClose.UnsentPayloadBufferOverflow {
 					fmt.Printf("Expected to NOT get buffer overflow indication but did\n")
+					t.Fail()
 					syncChan <- true
-					t.FailNow()
+					return
 				}
 
 				syncChan <- true
@@ -480,14 +488,16 @@ func TestConnectionShouldCloseAndReturnUnsentUpToBufferSizeOnAppleResponse(t *te
 			case connectionClose := <-apn.CloseChannel:
 				if connectionClose.Error.ErrorCode != 8 {
 					fmt.Printf("Should have received error 8 for closed socket but received %v\n", connectionClose.Error)
+					t.Fail()
 					syncChan <- true
-					t.FailNow()
+					return
 				}
 
 				if connectionClose.ErrorPayload != nil {
 					fmt.Printf("Should have returned payload object but received %v\n", connectionClose.ErrorPayload)
+					t.Fail()
 					syncChan <- true
-					t.FailNow()
+					return
 				}
 
 				for e := connectionClose.UnsentPayloads.Front(); e != nil; e = e.Next() {
@@ -497,20 +507,23 @@ func TestConnectionShouldCloseAndReturnUnsentUpToBufferSizeOnAppleResponse(t *te
 				if connectionClose.UnsentPayloads == nil ||
 					connectionClose.UnsentPayloads.Len() != 1 {
 					fmt.Printf("Should have returned 1 unsent payload objects but received %v len %v\n", connectionClose.UnsentPayloads, connectionClose.UnsentPayloads.Len())
+					t.Fail()
 					syncChan <- true
-					t.FailNow()
+					return
 				}
 
 				if connectionClose.UnsentPayloads.Front().Value.(*Payload).Token != token4 {
 					fmt.Printf("Expected to receive specific unsent payloads but received %v len %v\n", connectionClose.UnsentPayloads, connectionClose.UnsentPayloads.Len())
+					t.Fail()
 					syncChan <- true
-					t.FailNow()
+					return
 				}
 
 				if !connectionClose.UnsentPayloadBufferOverflow {
 					fmt.Printf("Expected to get buffer overflow indication but didn't\n")
+					t.Fail()
 					syncChan <- true
-					t.FailNow()
+					return
 				}
 
 				syncChan <- true
@@ -726,3 +739,569 @@ func TestShouldNotWritePayloadIfUnableToMarshall(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+/**
+ * Tests related to per payload results
+ */
+func newResultTestConnection(socket net.Conn, acceptedTimeout int) (*APNSConnection, chan *PayloadResult) {
+	results := make(chan *PayloadResult, 100)
+	config := testAPNSConfig()
+	config.PayloadAcceptedTimeout = acceptedTimeout
+	config.PayloadResultCallback = func(result *PayloadResult) {
+		results <- result
+	}
+	applyConfigDefaults(config)
+
+	return socketAPNSConnection(socket, config), results
+}
+
+func waitForPayloadResult(t *testing.T, results chan *PayloadResult) *PayloadResult {
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for payload result")
+	}
+	return nil
+}
+
+func TestConnectionShouldReportResultsAroundAppleError(t *testing.T) {
+	tokens := []string{testToken(1), testToken(2), testToken(3), testToken(4)}
+	socket := newMockConnRejectToken(tokens[1], make(chan writtenNotification, 100))
+	apn, results := newResultTestConnection(socket, 10000)
+
+	for _, token := range tokens {
+		select {
+		case apn.SendChannel <- &Payload{AlertText: "Testing", Token: token}:
+		case <-apn.CloseChannel:
+			t.Fatal("Connection closed before all payloads were buffered")
+		}
+	}
+	<-apn.CloseChannel
+
+	expected := []PayloadStatus{PAYLOAD_ACCEPTED, PAYLOAD_REJECTED, PAYLOAD_UNSENT, PAYLOAD_UNSENT}
+	for i, status := range expected {
+		result := waitForPayloadResult(t, results)
+		if result.ID != uint32(i+1) || result.Payload.Token != tokens[i] || result.Status != status {
+			t.Errorf("Expected result %v for payload %v but got %v for %v", status, i+1, result.Status, result.ID)
+		}
+		if status == PAYLOAD_REJECTED {
+			appleError, ok := result.Error.(*AppleError)
+			if !ok || appleError.ErrorCode != 8 {
+				t.Errorf("Expected rejection with error 8 but got %v", result.Error)
+			}
+		} else if result.Error != nil {
+			t.Errorf("Expected no error for %v result but got %v", status, result.Error)
+		}
+	}
+}
+
+func TestConnectionShouldNotUseIDsForDroppedPayloads(t *testing.T) {
+	tokens := []string{testToken(1), "not a token", testToken(2), testToken(3)}
+	socket := newMockConnRejectToken(tokens[2], make(chan writtenNotification, 100))
+	apn, results := newResultTestConnection(socket, 10000)
+
+	for _, token := range tokens {
+		select {
+		case apn.SendChannel <- &Payload{AlertText: "Testing", Token: token}:
+		case <-apn.CloseChannel:
+			t.Fatal("Connection closed before all payloads were buffered")
+		}
+	}
+	<-apn.CloseChannel
+
+	//buffered payloads keep consecutive ids around the dropped one
+	expected := map[string]struct {
+		ID     uint32
+		Status PayloadStatus
+	}{
+		tokens[0]: {1, PAYLOAD_ACCEPTED},
+		tokens[1]: {0, PAYLOAD_DROPPED},
+		tokens[2]: {2, PAYLOAD_REJECTED},
+		tokens[3]: {3, PAYLOAD_UNSENT},
+	}
+	for range tokens {
+		result := waitForPayloadResult(t, results)
+		want := expected[result.Payload.Token]
+		if result.ID != want.ID || result.Status != want.Status {
+			t.Errorf("Expected %v with id %v for %v but got %v with id %v",
+				want.Status, want.ID, result.Payload.Token, result.Status, result.ID)
+		}
+	}
+}
+
+func TestConnectionShouldReportAcceptedAfterTimeout(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	apn, results := newResultTestConnection(socket, 20)
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+
+	result := waitForPayloadResult(t, results)
+	if result.ID != 1 || result.Status != PAYLOAD_ACCEPTED {
+		t.Errorf("Expected payload 1 to be accepted but got %v for %v", result.Status, result.ID)
+	}
+
+	apn.Disconnect()
+	socket.Close()
+	<-apn.CloseChannel
+	if len(results) != 0 {
+		t.Errorf("Expected payload to only be reported once but got %v more", len(results))
+	}
+}
+
+func TestConnectionShouldReportDroppedPayload(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	apn, results := newResultTestConnection(socket, 10000)
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: "4ec500"}
+
+	result := waitForPayloadResult(t, results)
+	if result.Status != PAYLOAD_DROPPED || result.Error == nil || result.Payload.Token != "4ec500" {
+		t.Errorf("Expected payload to be dropped with error but got %v %v", result.Status, result.Error)
+	}
+	apn.Disconnect()
+}
+
+func TestConnectionShouldReportAcceptedOnDisconnect(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	apn, results := newResultTestConnection(socket, 1)
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+	//wait for the payload to be written and its timeout to pass before disconnecting
+	<-socket.Notifications
+	time.Sleep(10 * time.Millisecond)
+	apn.Disconnect()
+
+	result := waitForPayloadResult(t, results)
+	if result.Status != PAYLOAD_ACCEPTED || result.Error != nil {
+		t.Errorf("Expected payload to be accepted but got %v %v", result.Status, result.Error)
+	}
+}
+
+func TestConnectionShouldReportUnknownOnDisconnectBeforeTimeout(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	apn, results := newResultTestConnection(socket, 10000)
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+	<-socket.Notifications
+	apn.Disconnect()
+
+	//apple could still reject it, but the connection is gone
+	result := waitForPayloadResult(t, results)
+	appleError, ok := result.Error.(*AppleError)
+	if result.Status != PAYLOAD_UNKNOWN || !ok || appleError.ErrorCode != CONNECTION_CLOSED_DISCONNECT {
+		t.Errorf("Expected payload to be unknown after disconnect but got %v %v", result.Status, result.Error)
+	}
+}
+
+func TestConnectionShouldReportEvictedPayloadsAsUnknown(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	results := make(chan *PayloadResult, 100)
+	config := testAPNSConfig()
+	config.InFlightPayloadBufferSize = 1
+	config.PayloadAcceptedTimeout = 10000
+	config.PayloadResultCallback = func(result *PayloadResult) {
+		results <- result
+	}
+	applyConfigDefaults(config)
+	apn := socketAPNSConnection(socket, config)
+	defer apn.Disconnect()
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(2)}
+
+	result := waitForPayloadResult(t, results)
+	if result.Payload.Token != testToken(1) || result.Status != PAYLOAD_UNKNOWN || !errors.Is(result.Error, ErrPayloadEvicted) {
+		t.Errorf("Expected evicted payload to be unknown but got %v %v for %v", result.Status, result.Error, result.Payload.Token)
+	}
+}
+
+func TestConnectionShouldReportUnknownOnSocketClose(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	apn, results := newResultTestConnection(socket, 10000)
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+	<-socket.Notifications
+	socket.Close()
+
+	result := waitForPayloadResult(t, results)
+	if result.Status != PAYLOAD_UNKNOWN || result.Error == nil {
+		t.Errorf("Expected payload to be unknown with error but got %v %v", result.Status, result.Error)
+	}
+}
+
+func TestConnectionShouldReportInvalidPayloads(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	invalidPayloads := make(chan *InvalidPayloadError, 10)
+	config := testAPNSConfig()
+	config.MaxPayloadSize = 64
+	config.InvalidPayloadCallback = func(err *InvalidPayloadError) {
+		invalidPayloads <- err
+	}
+	apn := socketAPNSConnection(socket, config)
+
+	tests := []struct {
+		Payload  *Payload
+		Expected error
+	}{
+		{&Payload{AlertText: "Testing", Token: "not hex"}, ErrInvalidTokenEncoding},
+		{&Payload{AlertText: "Testing", Token: "4ec500"}, ErrInvalidTokenSize},
+		{&Payload{AlertText: "Testing", Token: testToken(1),
+			CustomFields: map[string]interface{}{"aps": 1}}, ErrApsCustomField},
+		{&Payload{AlertText: "Testing", Token: testToken(1),
+			CustomFields: map[string]interface{}{"big": "more text than will fit in 64 bytes of payload"}}, ErrPayloadTooLarge},
+	}
+
+	for i, test := range tests {
+		test.Payload.ExtraData = i
+		apn.SendChannel <- test.Payload
+
+		var invalidPayload *InvalidPayloadError
+		select {
+		case invalidPayload = <-invalidPayloads:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for invalid payload %v", i)
+		}
+
+		if invalidPayload.Payload != test.Payload || invalidPayload.ExtraData != i {
+			t.Errorf("Expected invalid payload %v with ExtraData %v but got %+v", test.Payload, i, invalidPayload)
+		}
+		if !errors.Is(invalidPayload, test.Expected) {
+			t.Errorf("Expected %v but got %v", test.Expected, invalidPayload.Err)
+		}
+	}
+
+	apn.Disconnect()
+	if len(socket.Notifications) != 0 {
+		t.Errorf("Expected no notifications to be written but got %v", len(socket.Notifications))
+	}
+}
+
+/**
+ * Tests related to context aware dial and send
+ */
+
+//Listen on localhost, accepting connections but never responding
+func newStalledListener(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestConnectionSendShouldHandOffPayload(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	apn := socketAPNSConnection(socket, testAPNSConfig())
+
+	err := apn.Send(context.Background(), &Payload{AlertText: "Testing", Token: testToken(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case notification := <-socket.Notifications:
+		if notification.Token != testToken(1) {
+			t.Errorf("Expected token %v but got %v", testToken(1), notification.Token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for payload to be written")
+	}
+	apn.Disconnect()
+}
+
+func TestConnectionSendShouldFailOnceClosed(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	apn := socketAPNSConnection(socket, testAPNSConfig())
+
+	socket.Close()
+	connectionClose := <-apn.CloseChannel
+	if connectionClose.Error == nil || connectionClose.Error.ErrorCode != CONNECTION_CLOSED_UNKNOWN {
+		t.Errorf("Expected CONNECTION_CLOSED_UNKNOWN but got %v", connectionClose.Error)
+	}
+
+	err := apn.Send(context.Background(), &Payload{AlertText: "Testing", Token: testToken(1)})
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("Expected ErrConnectionClosed but got %v", err)
+	}
+}
+
+func TestConnectionSendShouldRespectDeadline(t *testing.T) {
+	//nothing is reading from SendChannel
+	apn := &APNSConnection{
+		SendChannel:   make(chan *Payload),
+		closedChannel: make(chan bool),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := apn.Send(ctx, &Payload{AlertText: "Testing", Token: testToken(1)})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded but got %v", err)
+	}
+}
+
+func TestNewConnectionContextShouldAbandonHandshake(t *testing.T) {
+	listener := newStalledListener(t)
+	defer listener.Close()
+
+	certificateBytes, keyBytes := generateTestCertificate(t)
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := NewAPNSConnectionContext(ctx, &APNSConfig{
+		CertificateBytes: certificateBytes,
+		KeyBytes:         keyBytes,
+		GatewayHost:      host,
+		GatewayPort:      port,
+		TlsTimeout:       30,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded but got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected handshake to be abandoned at the deadline but took %v", time.Since(start))
+	}
+}
+
+/**
+ * Tests related to the connection shutdown lifecycle
+ */
+func TestConnectionShouldNotBlockSendsAfterClose(t *testing.T) {
+	socket := newMockConnRejectToken(testToken(1), make(chan writtenNotification, 100))
+	apn, results := newResultTestConnection(socket, 10000)
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+	<-apn.CloseChannel
+	waitForPayloadResult(t, results)
+
+	//nothing is selecting on CloseChannel, this must not block
+	late := &Payload{AlertText: "Testing", Token: testToken(2)}
+	select {
+	case apn.SendChannel <- late:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out sending on a closed connection")
+	}
+
+	result := waitForPayloadResult(t, results)
+	if result.Payload != late || result.Status != PAYLOAD_UNSENT || !errors.Is(result.Error, ErrConnectionClosed) {
+		t.Errorf("Expected late payload to be unsent with ErrConnectionClosed but got %v %v", result.Status, result.Error)
+	}
+
+	drained := apn.release()
+	if drained.Len() != 1 || drained.Front().Value.(*Payload) != late {
+		t.Errorf("Expected late payload to be returned by release but got %v payloads", drained.Len())
+	}
+	apn.Disconnect()
+}
+
+func TestConnectionShouldNotBlockSendsAfterDisconnect(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	apn, results := newResultTestConnection(socket, 10000)
+
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	late := &Payload{AlertText: "Testing", Token: testToken(1)}
+	select {
+	case apn.SendChannel <- late:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out sending after Disconnect")
+	}
+
+	result := waitForPayloadResult(t, results)
+	if result.Payload != late || result.Status != PAYLOAD_UNSENT || !errors.Is(result.Error, ErrConnectionClosed) {
+		t.Errorf("Expected late payload to be unsent with ErrConnectionClosed but got %v %v", result.Status, result.Error)
+	}
+	close(apn.SendChannel)
+
+	select {
+	case <-apn.drainDoneChannel:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for closing SendChannel to stop the drain")
+	}
+}
+
+func TestConnectionShouldOnlyKeepBufferSizeDrainedPayloads(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	results := make(chan *PayloadResult, 100)
+	config := testAPNSConfig()
+	config.InFlightPayloadBufferSize = 2
+	config.PayloadAcceptedTimeout = 10000
+	config.PayloadResultCallback = func(result *PayloadResult) {
+		results <- result
+	}
+	apn := socketAPNSConnection(socket, config)
+
+	socket.Close()
+	<-apn.CloseChannel
+
+	for i := 0; i < 5; i++ {
+		apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(i)}
+	}
+	//every discarded payload is still reported
+	for i := 0; i < 5; i++ {
+		result := waitForPayloadResult(t, results)
+		if result.Payload.Token != testToken(i) || result.Status != PAYLOAD_UNSENT {
+			t.Errorf("Expected %v to be unsent but got %v for %v", testToken(i), result.Status, result.Payload.Token)
+		}
+	}
+
+	drained := apn.release()
+	if drained.Len() != 2 || drained.Front().Value.(*Payload).Token != testToken(0) {
+		t.Errorf("Expected the first 2 payloads to be kept but got %v payloads", drained.Len())
+	}
+	apn.Disconnect()
+}
+
+func TestConnectionShouldFlushWhenSendChannelIsClosed(t *testing.T) {
+	for _, batched := range []bool{true, false} {
+		socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+		config := testAPNSConfig()
+		//only the close can flush
+		config.FramingTimeout = 60000
+		apn := socketAPNSConnection(socket, config)
+
+		apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+		if batched {
+			//closed while the second payload's batch is received
+			apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(2)}
+		}
+		close(apn.SendChannel)
+
+		select {
+		case notification := <-socket.Notifications:
+			if notification.Token != testToken(1) {
+				t.Errorf("Expected %v to be written but got %v", testToken(1), notification.Token)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for framed payloads to be written, batched %v", batched)
+		}
+
+		//closing SendChannel disconnects
+		select {
+		case connectionClose := <-apn.CloseChannel:
+			if connectionClose.Error != nil || connectionClose.UnsentPayloads.Len() != 0 {
+				t.Errorf("Expected a clean close but got %v with %v unsent",
+					connectionClose.Error, connectionClose.UnsentPayloads.Len())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for connection close, batched %v", batched)
+		}
+		if _, ok := <-apn.CloseChannel; ok {
+			t.Error("Expected CloseChannel to be closed after the connection close")
+		}
+		apn.Disconnect()
+	}
+}
+
+func TestConnectionShouldCloseWithoutCloseChannelReader(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	apn := socketAPNSConnection(socket, testAPNSConfig())
+
+	socket.Close()
+
+	select {
+	case <-apn.closedChannel:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for connection to close")
+	}
+
+	//the close is waiting in CloseChannel rather than in a blocked go-routine
+	if len(apn.CloseChannel) != 1 {
+		t.Fatalf("Expected buffered connection close but got %v", len(apn.CloseChannel))
+	}
+	<-apn.CloseChannel
+	if _, ok := <-apn.CloseChannel; ok {
+		t.Error("Expected CloseChannel to be closed after the connection close")
+	}
+	apn.Disconnect()
+}
+
+func TestConnectionShouldAllowRepeatedAndConcurrentDisconnect(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	apn := socketAPNSConnection(socket, testAPNSConfig())
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+
+	disconnects := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		disconnects.Add(1)
+		go func() {
+			defer disconnects.Done()
+			apn.Disconnect()
+		}()
+	}
+	disconnects.Wait()
+	apn.Disconnect()
+
+	connectionClose := <-apn.CloseChannel
+	if connectionClose.Error != nil {
+		t.Errorf("Expected clean close but got %v", connectionClose.Error)
+	}
+	if len(socket.Notifications) != 1 {
+		t.Errorf("Expected payload to be flushed on disconnect but %v were written", len(socket.Notifications))
+	}
+
+	err := apn.Send(context.Background(), &Payload{AlertText: "Testing", Token: testToken(2)})
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("Expected ErrConnectionClosed after disconnect but got %v", err)
+	}
+}
+
+func TestConnectionShouldFlushPayloadHandedOffBeforeDisconnect(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+		apn := socketAPNSConnection(socket, testAPNSConfig())
+
+		apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+		apn.Disconnect()
+		<-apn.CloseChannel
+
+		if len(socket.Notifications) != 1 {
+			t.Fatalf("Expected payload to be written before disconnect on attempt %v but %v were written",
+				i, len(socket.Notifications))
+		}
+	}
+}
+
+func TestConnectionShouldDisconnectAfterClose(t *testing.T) {
+	socket := newMockConnRejectToken(testToken(1), make(chan writtenNotification, 100))
+	apn := socketAPNSConnection(socket, testAPNSConfig())
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+	connectionClose := <-apn.CloseChannel
+	if connectionClose.Error == nil || connectionClose.Error.ErrorCode != 8 {
+		t.Errorf("Expected error 8 but got %v", connectionClose.Error)
+	}
+
+	done := make(chan bool)
+	go func() {
+		apn.Disconnect()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out disconnecting a closed connection")
+	}
+
+	select {
+	case <-socket.CloseChannel:
+	default:
+		t.Error("Expected socket to be closed by Disconnect")
+	}
+}
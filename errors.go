@@ -0,0 +1,78 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	//Payload.Token is not hex encoded
+	ErrInvalidTokenEncoding = errors.New("Invalid token, should be hex encoded")
+	//Payload.Token does not decode to APNS_TOKEN_SIZE bytes
+	ErrInvalidTokenSize = errors.New("Invalid token length")
+	//Payload.CustomFields has a field named aps
+	ErrApsCustomField = errors.New("Cannot have a custom field named aps")
+	//Payload.AlertBody has loc-args without the matching loc-key
+	ErrLocArgsWithoutLocKey = errors.New("Loc args need a loc key")
+	//Payload.AlertBody has fields set but no Body, so a simple alert is sent without them
+	ErrAlertBodyWithSimpleAlert = errors.New("AlertBody fields are only sent with AlertBody.Body, not with a simple alert")
+	//Payload could not be truncated to fit in the max payload size
+	ErrPayloadTooLarge = errors.New("Payload was too long")
+	//Critical alert Sound volume is not between 0 and 1
+	ErrInvalidSoundVolume = errors.New("Invalid sound volume, should be between 0 and 1")
+	//Payload.RelevanceScore is not between 0 and 1
+	ErrInvalidRelevanceScore = errors.New("Invalid relevance score, should be between 0 and 1")
+	//Payload.Background is set on a payload with an alert, sound, badge,
+	//live activity or PRIORITY_IMMEDIATE
+	ErrInvalidBackgroundPayload = errors.New("Invalid background payload, can't alert the user or be sent at priority 10")
+	//Payload.LiveActivity.Event is not start, update or end
+	ErrInvalidLiveActivityEvent = errors.New("Invalid live activity event, should be start, update or end")
+	//Payload.LiveActivity has no Timestamp
+	ErrMissingLiveActivityTimestamp = errors.New("Missing live activity timestamp")
+	//Payload.LiveActivity starts or updates an activity without a ContentState
+	ErrMissingContentState = errors.New("Missing live activity content state")
+	//Payload.LiveActivity starts an activity without Attributes and AttributesType,
+	//or has them on an update or end event
+	ErrInvalidLiveActivityAttributes = errors.New("Invalid live activity attributes, start events need attributes and an attributes type, other events can't have them")
+	//Payload.LiveActivity.Timestamp is not after the last timestamp accepted for the activity
+	ErrLiveActivityOutOfOrder = errors.New("Live activity timestamp should be later than the last update's")
+	//Payload.LiveActivity is set on a payload sent on the binary gateway or
+	//with an APNSHTTP2Client using certificate authentication
+	ErrLiveActivityUnsupported = errors.New("Live activities can only be sent to the provider API with token authentication")
+	//Frame has no payload
+	ErrMissingPayload = errors.New("Missing payload")
+	//Frame or Payload priority is not PRIORITY_IMMEDIATE or PRIORITY_CONSERVE_POWER
+	ErrInvalidPriority = errors.New("Invalid priority, should be 5 or 10")
+	//Payload was sent on a connection that has already closed
+	ErrConnectionClosed = errors.New("Connection is closed")
+	//Payload was pushed out of the in flight payload buffer before PayloadAcceptedTimeout passed
+	ErrPayloadEvicted = errors.New("Payload was evicted from the in flight payload buffer before it was accepted")
+)
+
+//Error for a payload that was rejected before being written to the socket
+//Err is one of the Err* values above or the error from encoding/json
+type InvalidPayloadError struct {
+	//The payload object
+	Payload *Payload
+	//The payload's ExtraData
+	ExtraData interface{}
+	//Why the payload was rejected
+	Err error
+}
+
+//Create an InvalidPayloadError for payload
+func newInvalidPayloadError(payload *Payload, err error) *InvalidPayloadError {
+	return &InvalidPayloadError{
+		Payload:   payload,
+		ExtraData: payload.ExtraData,
+		Err:       err,
+	}
+}
+
+func (e *InvalidPayloadError) Error() string {
+	return fmt.Sprintf("Invalid payload for token %v : %v", e.Payload.Token, e.Err)
+}
+
+func (e *InvalidPayloadError) Unwrap() error {
+	return e.Err
+}
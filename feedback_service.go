@@ -4,7 +4,9 @@ package apns
 
 import (
 	"container/list"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -28,6 +30,12 @@ type APNSFeedbackServiceConfig struct {
 	SocketTimeout int
 	//number of seconds to wait for Tls handshake to complete before bailing, defaults to 5 seconds
 	TlsTimeout int
+	//root certificates used to verify the feedback service, defaults to the system roots
+	RootCAs *x509.CertPool
+	//receives feedback service log events, defaults to no logging
+	Logger Logger
+	//minimum level of events sent to Logger, defaults to LOG_INFO
+	LogLevel LogLevel
 }
 
 //Feedback Response
@@ -50,6 +58,15 @@ const (
 //Also if unable to create a connection an error will be returned
 //Will return a list of *FeedbackResponse or error
 func ConnectToFeedbackService(config *APNSFeedbackServiceConfig) (*list.List, error) {
+	return ConnectToFeedbackServiceContext(context.Background(), config)
+}
+
+//Create a new apns feedback service connection with supplied config
+//Connecting, the Tls handshake and reading responses are abandoned if ctx is
+//done first, in which case any responses read so far are returned with ctx.Err()
+//If invalid config an error will be returned
+//Will return a list of *FeedbackResponse or error
+func ConnectToFeedbackServiceContext(ctx context.Context, config *APNSFeedbackServiceConfig) (*list.List, error) {
 	errorStrs := ""
 
 	if config.CertificateBytes == nil || config.KeyBytes == nil {
@@ -73,96 +90,113 @@ func ConnectToFeedbackService(config *APNSFeedbackServiceConfig) (*list.List, er
 		config.TlsTimeout = 5
 	}
 
-	x509Cert, err := tls.X509KeyPair(config.CertificateBytes, config.KeyBytes)
+	logger := newLevelLogger(config.Logger, config.LogLevel)
+
+	tlsConf, err := createTLSConfig(config.CertificateBytes, config.KeyBytes, config.GatewayHost)
 	if err != nil {
 		//failed to validate key pair
+		logger.Log(LOG_ERROR, "Invalid certificate/key", "error", err)
 		return nil, err
 	}
+	tlsConf.RootCAs = config.RootCAs
 
-	tlsConf := &tls.Config{
-		Certificates: []tls.Certificate{x509Cert},
-		ServerName:   config.GatewayHost,
-	}
-
-	tcpSocket, err := net.DialTimeout("tcp",
-		config.GatewayHost+":"+config.GatewayPort,
-		time.Duration(config.SocketTimeout)*time.Second)
+	dialer := &net.Dialer{Timeout: time.Duration(config.SocketTimeout) * time.Second}
+	tcpSocket, err := dialer.DialContext(ctx, "tcp",
+		net.JoinHostPort(config.GatewayHost, config.GatewayPort))
 	if err != nil {
 		//failed to connect to gateway
+		logger.Log(LOG_ERROR, "Failed to connect to feedback service",
+			"host", config.GatewayHost, "port", config.GatewayPort, "error", err)
 		return nil, err
 	}
+	logger.Log(LOG_INFO, "Connected to feedback service",
+		"host", config.GatewayHost, "port", config.GatewayPort)
 
 	tlsSocket := tls.Client(tcpSocket, tlsConf)
 	tlsSocket.SetReadDeadline(time.Now().Add(time.Duration(config.TlsTimeout) * time.Second))
-	err = tlsSocket.Handshake()
+	start := time.Now()
+	err = tlsSocket.HandshakeContext(ctx)
 	if err != nil {
 		//failed to handshake with tls information
+		tcpSocket.Close()
+		logger.Log(LOG_ERROR, "TLS handshake failed", "host", config.GatewayHost, "error", err)
 		return nil, err
 	}
+	logger.Log(LOG_DEBUG, "TLS handshake complete",
+		"host", config.GatewayHost, "duration", time.Since(start))
 
 	//hooray! we're connected
 
 	//let socket close itself when we're finished
 	defer tlsSocket.Close()
 
-	return readFromFeedbackService(tlsSocket)
+	//unblock reads once ctx is done
+	stopWatchingContext := context.AfterFunc(ctx, func() {
+		tlsSocket.SetReadDeadline(time.Now())
+	})
+	defer stopWatchingContext()
+
+	responses, err := readFromFeedbackService(tlsSocket)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		logger.Log(LOG_ERROR, "Error while reading from feedback service",
+			"responses", responses.Len(), "error", err)
+	} else {
+		logger.Log(LOG_INFO, "Read feedback responses", "responses", responses.Len())
+	}
+	logger.Log(LOG_INFO, "Disconnected from feedback service")
+
+	return responses, err
 }
 
 //Read from the socket until there is no more to be read or an error occurs
 //Then close the socket
 //On error some responses may be returned so one should check that the list
 //returned doesn't have anything in it
+//Tuples may be split across reads, a tuple cut off by the end of the
+//socket is an error
 func readFromFeedbackService(socket net.Conn) (*list.List, error) {
 
 	headerBuffer := make([]byte, FEEDBACK_RESPONSE_HEADER_FRAME_SIZE)
 	responses := list.New()
 
 	for {
-		bytesRead, err := socket.Read(headerBuffer)
+		bytesRead, err := io.ReadFull(socket, headerBuffer)
 		if err != nil {
 			if err == io.EOF {
 				//we're good, just reached the end of the socket
 				return responses, nil
+			} else if err == io.ErrUnexpectedEOF {
+				return responses,
+					fmt.Errorf("Should have read %v header bytes but read %v bytes : %w",
+						FEEDBACK_RESPONSE_HEADER_FRAME_SIZE, bytesRead, err)
 			} else {
 				//this is a legit error, return it
 				return responses, err
 			}
 		}
 
-		if bytesRead != FEEDBACK_RESPONSE_HEADER_FRAME_SIZE {
-			//? should always be this size...
-			return responses,
-				errors.New(fmt.Sprintf("Should have read %v header bytes but read %v bytes",
-					FEEDBACK_RESPONSE_HEADER_FRAME_SIZE, bytesRead))
-		}
-
 		tokenSize := int(binary.BigEndian.Uint16(headerBuffer[4:6]))
 
 		tokenBuffer := make([]byte, tokenSize)
 
-		bytesRead, err = socket.Read(tokenBuffer)
+		bytesRead, err = io.ReadFull(socket, tokenBuffer)
 		if err != nil {
-			if err == io.EOF {
-				//we're good, just reached the end of the socket
-				return responses, nil
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return responses,
+					fmt.Errorf("Should have read %v token bytes but read %v bytes : %w",
+						tokenSize, bytesRead, io.ErrUnexpectedEOF)
 			} else {
 				//this is a legit error, return it
 				return responses, err
 			}
 		}
 
-		if bytesRead != tokenSize {
-			//? should always be this size...
-			return responses,
-				errors.New(fmt.Sprintf("Should have read %v token bytes but read %v bytes",
-					tokenSize, bytesRead))
-		}
-
 		response := new(FeedbackResponse)
 		response.Timestamp = binary.BigEndian.Uint32(headerBuffer[0:4])
 		response.Token = hex.EncodeToString(tokenBuffer)
 		responses.PushBack(response)
 	}
-
-	return responses, nil
 }
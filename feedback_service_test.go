@@ -1,6 +1,7 @@
 package apns
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -306,3 +307,54 @@ func TestFeedbackServiceReadShouldReturnTokensAndError(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestFeedbackServiceContextShouldAbandonHandshake(t *testing.T) {
+	listener := newStalledListener(t)
+	defer listener.Close()
+
+	certificateBytes, keyBytes := generateTestCertificate(t)
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	responses, err := ConnectToFeedbackServiceContext(ctx, &APNSFeedbackServiceConfig{
+		CertificateBytes: certificateBytes,
+		KeyBytes:         keyBytes,
+		GatewayHost:      host,
+		GatewayPort:      port,
+		TlsTimeout:       30,
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled but got %v", err)
+	}
+	if responses != nil {
+		t.Errorf("Expected no responses but got %v", responses.Len())
+	}
+}
+
+func TestFeedbackServiceReadShouldRejectTruncatedTuple(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	token := "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f"
+	go func() {
+		tuple := []byte{0, 0, 0, 1, 0, 32}
+		tokenBytes, _ := hex.DecodeString(token)
+		tuple = append(tuple, tokenBytes...)
+		//one whole tuple written a byte at a time, then a cut off tuple
+		for _, b := range tuple {
+			server.Write([]byte{b})
+		}
+		server.Write(append([]byte{0, 0, 0, 2, 0, 32}, tokenBytes[:10]...))
+		server.Close()
+	}()
+
+	responses, err := readFromFeedbackService(client)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected io.ErrUnexpectedEOF but got %v", err)
+	}
+	if responses.Len() != 1 || responses.Front().Value.(*FeedbackResponse).Token != token {
+		t.Errorf("Expected 1 response for %v but got %v", token, responses.Len())
+	}
+}
@@ -0,0 +1,377 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+//Binary interface format notifications are written in
+type WireFormat int
+
+const (
+	//Command 2 frames made of items, the default
+	WIRE_FORMAT_FRAME WireFormat = iota
+	//Command 1 enhanced notifications, with an identifier and expiry but no priority
+	WIRE_FORMAT_ENHANCED
+	//Command 0 simple notifications, with only a token and payload
+	//Apple doesn't send error responses for these, so nothing can be replayed
+	WIRE_FORMAT_SIMPLE
+)
+
+const (
+	//Command byte of a notification frame
+	NOTIFICATION_COMMAND = 2
+	//Command byte of an enhanced notification
+	ENHANCED_NOTIFICATION_COMMAND = 1
+	//Command byte of a simple notification
+	SIMPLE_NOTIFICATION_COMMAND = 0
+	//Number of bytes before each item's data, item id is 1 byte, item length is 2 bytes
+	FRAME_ITEM_HEADER_SIZE = 3
+
+	//Frame item ids
+	FRAME_ITEM_DEVICE_TOKEN    = 1
+	FRAME_ITEM_PAYLOAD         = 2
+	FRAME_ITEM_NOTIFICATION_ID = 3
+	FRAME_ITEM_EXPIRATION_DATE = 4
+	FRAME_ITEM_PRIORITY        = 5
+
+	//Size of the notification id, expiration date and priority items' data
+	NOTIFICATION_ID_SIZE = 4
+	EXPIRATION_DATE_SIZE = 4
+	PRIORITY_SIZE        = 1
+
+	//Send the notification immediately
+	PRIORITY_IMMEDIATE = 10
+	//Send the notification at a time that conserves power on the device
+	PRIORITY_CONSERVE_POWER = 5
+
+	//Error response codes for malformed frames (see APPLE_PUSH_RESPONSES)
+	STATUS_PROCESSING_ERROR      = 1
+	STATUS_MISSING_DEVICE_TOKEN  = 2
+	STATUS_MISSING_PAYLOAD       = 4
+	STATUS_INVALID_TOKEN_SIZE    = 5
+	STATUS_INVALID_FRAME_ITEM_ID = 128
+)
+
+//Notification in the binary interface's command 2 frame format
+//Can also be encoded in the legacy enhanced and simple formats, see WireFormat
+//See https://developer.apple.com/library/archive/documentation/NetworkingInternet/Conceptual/RemoteNotificationsPG/BinaryProviderAPI.html
+type Frame struct {
+	//Device token, APNS_TOKEN_SIZE bytes
+	Token []byte
+	//JSON payload
+	Payload []byte
+	//Identifier Apple returns in an error response for this notification
+	ID uint32
+	//UNIX time in seconds when the notification expires, not sent if 0
+	Expiration uint32
+	//PRIORITY_IMMEDIATE or PRIORITY_CONSERVE_POWER, not sent if 0
+	Priority uint8
+}
+
+//Error decoding a frame
+type FrameError struct {
+	//The error response code Apple would respond with (see APPLE_PUSH_RESPONSES)
+	Status uint8
+	//What was wrong with the frame
+	Reason string
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("%v: %v", APPLE_PUSH_RESPONSES[e.Status], e.Reason)
+}
+
+//Number of bytes the encoded frame takes, including the header
+func (f *Frame) Len() int {
+	return f.LenWireFormat(WIRE_FORMAT_FRAME)
+}
+
+//Number of bytes the frame takes encoded in format
+func (f *Frame) LenWireFormat(format WireFormat) int {
+	switch format {
+	case WIRE_FORMAT_ENHANCED:
+		//command, identifier, expiry, token length, token, payload length, payload
+		return 1 + 4 + 4 + 2 + len(f.Token) + 2 + len(f.Payload)
+	case WIRE_FORMAT_SIMPLE:
+		//command, token length, token, payload length, payload
+		return 1 + 2 + len(f.Token) + 2 + len(f.Payload)
+	}
+
+	n := NOTIFICATION_HEADER_SIZE +
+		FRAME_ITEM_HEADER_SIZE + len(f.Token) +
+		FRAME_ITEM_HEADER_SIZE + len(f.Payload) +
+		FRAME_ITEM_HEADER_SIZE + NOTIFICATION_ID_SIZE
+	if f.Expiration != 0 {
+		n += FRAME_ITEM_HEADER_SIZE + EXPIRATION_DATE_SIZE
+	}
+	if f.Priority != 0 {
+		n += FRAME_ITEM_HEADER_SIZE + PRIORITY_SIZE
+	}
+	return n
+}
+
+//Check the frame's items can be encoded in format
+func (f *Frame) validate(format WireFormat) error {
+	if format < WIRE_FORMAT_FRAME || format > WIRE_FORMAT_SIMPLE {
+		return fmt.Errorf("Unknown wire format %v", format)
+	}
+	if len(f.Token) != APNS_TOKEN_SIZE {
+		return fmt.Errorf("%w. Was %v bytes but should have been %v bytes",
+			ErrInvalidTokenSize, len(f.Token), APNS_TOKEN_SIZE)
+	}
+	if len(f.Payload) == 0 {
+		return ErrMissingPayload
+	}
+	if len(f.Payload) > 0xffff {
+		return ErrPayloadTooLarge
+	}
+	//priority is only sent in frames
+	if format == WIRE_FORMAT_FRAME &&
+		f.Priority != 0 && f.Priority != PRIORITY_IMMEDIATE && f.Priority != PRIORITY_CONSERVE_POWER {
+		return ErrInvalidPriority
+	}
+	return nil
+}
+
+//Append the encoded frame, header and items, to b
+//Returns an error if an item is invalid, b is returned unchanged
+func (f *Frame) AppendBinary(b []byte) ([]byte, error) {
+	return f.AppendWireFormat(b, WIRE_FORMAT_FRAME)
+}
+
+//Append the frame encoded in format to b
+//Returns an error if an item is invalid, b is returned unchanged
+func (f *Frame) AppendWireFormat(b []byte, format WireFormat) ([]byte, error) {
+	if err := f.validate(format); err != nil {
+		return b, err
+	}
+
+	switch format {
+	case WIRE_FORMAT_ENHANCED:
+		b = append(b, ENHANCED_NOTIFICATION_COMMAND)
+		b = binary.BigEndian.AppendUint32(b, f.ID)
+		b = binary.BigEndian.AppendUint32(b, f.Expiration)
+		return f.appendTokenAndPayload(b), nil
+	case WIRE_FORMAT_SIMPLE:
+		b = append(b, SIMPLE_NOTIFICATION_COMMAND)
+		return f.appendTokenAndPayload(b), nil
+	}
+
+	b = append(b, NOTIFICATION_COMMAND)
+	b = binary.BigEndian.AppendUint32(b, uint32(f.Len()-NOTIFICATION_HEADER_SIZE))
+
+	b = appendFrameItem(b, FRAME_ITEM_DEVICE_TOKEN, len(f.Token))
+	b = append(b, f.Token...)
+
+	b = appendFrameItem(b, FRAME_ITEM_PAYLOAD, len(f.Payload))
+	b = append(b, f.Payload...)
+
+	b = appendFrameItem(b, FRAME_ITEM_NOTIFICATION_ID, NOTIFICATION_ID_SIZE)
+	b = binary.BigEndian.AppendUint32(b, f.ID)
+
+	if f.Expiration != 0 {
+		b = appendFrameItem(b, FRAME_ITEM_EXPIRATION_DATE, EXPIRATION_DATE_SIZE)
+		b = binary.BigEndian.AppendUint32(b, f.Expiration)
+	}
+
+	if f.Priority != 0 {
+		b = appendFrameItem(b, FRAME_ITEM_PRIORITY, PRIORITY_SIZE)
+		b = append(b, f.Priority)
+	}
+
+	return b, nil
+}
+
+//Append the length prefixed token and payload of the legacy formats to b
+func (f *Frame) appendTokenAndPayload(b []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(f.Token)))
+	b = append(b, f.Token...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(f.Payload)))
+	return append(b, f.Payload...)
+}
+
+//Encode the frame, header and items
+func (f *Frame) MarshalBinary() ([]byte, error) {
+	return f.AppendBinary(make([]byte, 0, f.Len()))
+}
+
+//Decode a frame, header and items, replacing f's fields
+//Enhanced and simple notifications are decoded too
+//Returns a *FrameError if the frame is malformed, items decoded before
+//the problem was found (like the ID) are still set
+func (f *Frame) UnmarshalBinary(data []byte) error {
+	*f = Frame{}
+
+	r := bytes.NewReader(data)
+	err := f.read(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &FrameError{Status: STATUS_PROCESSING_ERROR, Reason: "Frame is truncated"}
+	}
+	if err == nil && r.Len() > 0 {
+		return &FrameError{Status: STATUS_PROCESSING_ERROR, Reason: fmt.Sprintf("%v bytes follow the frame", r.Len())}
+	}
+	return err
+}
+
+//Decode the items of a frame
+func (f *Frame) unmarshalItems(items []byte) error {
+	//the first problem found with an item, decoding carries on so the ID is found
+	var itemErr *FrameError
+
+	for len(items) > 0 {
+		if len(items) < FRAME_ITEM_HEADER_SIZE {
+			return &FrameError{Status: STATUS_PROCESSING_ERROR, Reason: "Item header overruns the frame"}
+		}
+		itemID := items[0]
+		itemLength := int(binary.BigEndian.Uint16(items[1:FRAME_ITEM_HEADER_SIZE]))
+		if len(items) < FRAME_ITEM_HEADER_SIZE+itemLength {
+			return &FrameError{Status: STATUS_PROCESSING_ERROR, Reason: fmt.Sprintf("Item %v overruns the frame", itemID)}
+		}
+		item := items[FRAME_ITEM_HEADER_SIZE : FRAME_ITEM_HEADER_SIZE+itemLength]
+		items = items[FRAME_ITEM_HEADER_SIZE+itemLength:]
+
+		switch itemID {
+		case FRAME_ITEM_DEVICE_TOKEN:
+			f.Token = append([]byte{}, item...)
+			if itemLength != APNS_TOKEN_SIZE && itemErr == nil {
+				itemErr = &FrameError{Status: STATUS_INVALID_TOKEN_SIZE, Reason: fmt.Sprintf("Token is %v bytes", itemLength)}
+			}
+		case FRAME_ITEM_PAYLOAD:
+			f.Payload = append([]byte{}, item...)
+		case FRAME_ITEM_NOTIFICATION_ID:
+			if itemLength != NOTIFICATION_ID_SIZE {
+				return &FrameError{Status: STATUS_PROCESSING_ERROR, Reason: fmt.Sprintf("Notification id is %v bytes", itemLength)}
+			}
+			f.ID = binary.BigEndian.Uint32(item)
+		case FRAME_ITEM_EXPIRATION_DATE:
+			if itemLength != EXPIRATION_DATE_SIZE {
+				return &FrameError{Status: STATUS_PROCESSING_ERROR, Reason: fmt.Sprintf("Expiration date is %v bytes", itemLength)}
+			}
+			f.Expiration = binary.BigEndian.Uint32(item)
+		case FRAME_ITEM_PRIORITY:
+			if itemLength != PRIORITY_SIZE {
+				return &FrameError{Status: STATUS_PROCESSING_ERROR, Reason: fmt.Sprintf("Priority is %v bytes", itemLength)}
+			}
+			f.Priority = item[0]
+		default:
+			return &FrameError{Status: STATUS_INVALID_FRAME_ITEM_ID, Reason: fmt.Sprintf("Unknown item %v", itemID)}
+		}
+	}
+
+	if itemErr != nil {
+		return itemErr
+	}
+	if f.Token == nil {
+		return &FrameError{Status: STATUS_MISSING_DEVICE_TOKEN, Reason: "No token item"}
+	}
+	if len(f.Payload) == 0 {
+		return &FrameError{Status: STATUS_MISSING_PAYLOAD, Reason: "No payload item"}
+	}
+	return nil
+}
+
+//Read one frame from r
+//Enhanced and simple notifications are read too
+//Returns the error from r if it fails (io.EOF if there are no more frames)
+//or a *FrameError if the frame is malformed, along with what was decoded
+//After a *FrameError for the header r is no longer at a frame boundary
+func ReadFrame(r io.Reader) (*Frame, error) {
+	f := new(Frame)
+	err := f.read(r)
+	if _, ok := err.(*FrameError); err != nil && !ok {
+		return nil, err
+	}
+	return f, err
+}
+
+//Read one frame in any format from r into f
+//Returns io.EOF only if r ended before the frame started
+func (f *Frame) read(r io.Reader) error {
+	command := make([]byte, 1)
+	if _, err := io.ReadFull(r, command); err != nil {
+		return err
+	}
+
+	err := f.readCommand(r, command[0])
+	if err == io.EOF {
+		//part of the frame was read
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+//Read the rest of a frame that started with command from r into f
+func (f *Frame) readCommand(r io.Reader, command byte) error {
+	switch command {
+	case NOTIFICATION_COMMAND:
+		length := make([]byte, NOTIFICATION_HEADER_SIZE-1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return err
+		}
+		frameLength := binary.BigEndian.Uint32(length)
+		if frameLength > TCP_FRAME_MAX {
+			return &FrameError{Status: STATUS_PROCESSING_ERROR, Reason: fmt.Sprintf("Frame length %v is too long", frameLength)}
+		}
+
+		items := make([]byte, frameLength)
+		if _, err := io.ReadFull(r, items); err != nil {
+			return err
+		}
+		return f.unmarshalItems(items)
+	case ENHANCED_NOTIFICATION_COMMAND:
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		f.ID = binary.BigEndian.Uint32(header[0:4])
+		f.Expiration = binary.BigEndian.Uint32(header[4:8])
+		return f.readTokenAndPayload(r)
+	case SIMPLE_NOTIFICATION_COMMAND:
+		return f.readTokenAndPayload(r)
+	}
+
+	return &FrameError{Status: STATUS_PROCESSING_ERROR, Reason: fmt.Sprintf("Unknown command %v", command)}
+}
+
+//Read the length prefixed token and payload of the legacy formats
+func (f *Frame) readTokenAndPayload(r io.Reader) error {
+	var err error
+	if f.Token, err = readLengthPrefixed(r); err != nil {
+		return err
+	}
+	if f.Payload, err = readLengthPrefixed(r); err != nil {
+		return err
+	}
+
+	if len(f.Token) == 0 {
+		return &FrameError{Status: STATUS_MISSING_DEVICE_TOKEN, Reason: "Token is empty"}
+	}
+	if len(f.Token) != APNS_TOKEN_SIZE {
+		return &FrameError{Status: STATUS_INVALID_TOKEN_SIZE, Reason: fmt.Sprintf("Token is %v bytes", len(f.Token))}
+	}
+	if len(f.Payload) == 0 {
+		return &FrameError{Status: STATUS_MISSING_PAYLOAD, Reason: "Payload is empty"}
+	}
+	return nil
+}
+
+//Read 2 byte length then that many bytes
+func readLengthPrefixed(r io.Reader) ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//Append an item's header to b
+func appendFrameItem(b []byte, itemID uint8, length int) []byte {
+	b = append(b, itemID)
+	return binary.BigEndian.AppendUint16(b, uint16(length))
+}
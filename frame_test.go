@@ -0,0 +1,283 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testFrame() *Frame {
+	token, _ := hex.DecodeString("4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f")
+	return &Frame{
+		Token:      token,
+		Payload:    []byte(`{"aps":{"alert":"Testing"}}`),
+		ID:         42,
+		Expiration: 1700000000,
+		Priority:   PRIORITY_IMMEDIATE,
+	}
+}
+
+func TestFrameShouldEncodeItems(t *testing.T) {
+	frame := testFrame()
+	encoded, err := frame.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{NOTIFICATION_COMMAND, 0, 0, 0, 83}
+	expected = append(expected, FRAME_ITEM_DEVICE_TOKEN, 0, 32)
+	expected = append(expected, frame.Token...)
+	expected = append(expected, FRAME_ITEM_PAYLOAD, 0, 27)
+	expected = append(expected, frame.Payload...)
+	expected = append(expected, FRAME_ITEM_NOTIFICATION_ID, 0, 4, 0, 0, 0, 42)
+	expected = append(expected, FRAME_ITEM_EXPIRATION_DATE, 0, 4, 0x65, 0x53, 0xf1, 0x00)
+	//priority is a single byte
+	expected = append(expected, FRAME_ITEM_PRIORITY, 0, 1, 10)
+
+	if !bytes.Equal(encoded, expected) {
+		t.Errorf("Expected frame\n%x\nbut got\n%x", expected, encoded)
+	}
+	if frame.Len() != len(expected) {
+		t.Errorf("Expected Len %v but got %v", len(expected), frame.Len())
+	}
+}
+
+func TestFrameShouldOmitUnsetItems(t *testing.T) {
+	frame := testFrame()
+	frame.Expiration = 0
+	frame.Priority = 0
+
+	encoded, err := frame.AppendBinary([]byte{0xff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded[0] != 0xff || len(encoded) != 1+frame.Len() || frame.Len() != 5+35+30+7 {
+		t.Errorf("Expected frame appended without expiration or priority but got %x", encoded)
+	}
+}
+
+func TestFrameShouldRoundTrip(t *testing.T) {
+	frame := testFrame()
+	encoded, _ := frame.MarshalBinary()
+
+	decoded := new(Frame)
+	if err := decoded.UnmarshalBinary(encoded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Token, frame.Token) || !bytes.Equal(decoded.Payload, frame.Payload) ||
+		decoded.ID != frame.ID || decoded.Expiration != frame.Expiration || decoded.Priority != frame.Priority {
+		t.Errorf("Expected %+v but got %+v", frame, decoded)
+	}
+}
+
+func TestFrameShouldRejectInvalidItems(t *testing.T) {
+	shortToken := testFrame()
+	shortToken.Token = shortToken.Token[:31]
+	noPayload := testFrame()
+	noPayload.Payload = nil
+	badPriority := testFrame()
+	badPriority.Priority = 7
+
+	frames := []struct {
+		Frame    *Frame
+		Expected error
+	}{
+		{shortToken, ErrInvalidTokenSize},
+		{noPayload, ErrMissingPayload},
+		{badPriority, ErrInvalidPriority},
+	}
+
+	for _, test := range frames {
+		encoded, err := test.Frame.AppendBinary([]byte{1, 2})
+		if !errors.Is(err, test.Expected) {
+			t.Errorf("Expected %v but got %v", test.Expected, err)
+		}
+		if len(encoded) != 2 {
+			t.Errorf("Expected buffer to be unchanged but got %x", encoded)
+		}
+	}
+}
+
+func TestFrameShouldReportDecodeErrors(t *testing.T) {
+	token := testFrame().Token
+	tokenItem := append([]byte{FRAME_ITEM_DEVICE_TOKEN, 0, 32}, token...)
+	payloadItem := []byte{FRAME_ITEM_PAYLOAD, 0, 2, '{', '}'}
+	idItem := []byte{FRAME_ITEM_NOTIFICATION_ID, 0, 4, 0, 0, 0, 7}
+
+	frames := []struct {
+		Items    []byte
+		Expected uint8
+		ID       uint32
+	}{
+		{idItem, STATUS_MISSING_DEVICE_TOKEN, 7},
+		{append(append([]byte{}, tokenItem...), idItem...), STATUS_MISSING_PAYLOAD, 7},
+		{append([]byte{FRAME_ITEM_DEVICE_TOKEN, 0, 2, 0xab, 0xcd}, idItem...), STATUS_INVALID_TOKEN_SIZE, 7},
+		{append(append([]byte{}, idItem...), 9, 0, 1, 0), STATUS_INVALID_FRAME_ITEM_ID, 7},
+		//4 byte priority
+		{append(append(append([]byte{}, tokenItem...), payloadItem...), FRAME_ITEM_PRIORITY, 0, 4, 0, 0, 0, 10), STATUS_PROCESSING_ERROR, 0},
+		//item overruns frame
+		{[]byte{FRAME_ITEM_PRIORITY, 0, 4, 10}, STATUS_PROCESSING_ERROR, 0},
+	}
+
+	for i, test := range frames {
+		encoded := append([]byte{NOTIFICATION_COMMAND, 0, 0, 0, byte(len(test.Items))}, test.Items...)
+		decoded := new(Frame)
+		err := decoded.UnmarshalBinary(encoded)
+
+		var frameErr *FrameError
+		if !errors.As(err, &frameErr) || frameErr.Status != test.Expected {
+			t.Errorf("Expected status %v for frame %v but got %v", test.Expected, i, err)
+		}
+		if decoded.ID != test.ID {
+			t.Errorf("Expected id %v for frame %v but got %v", test.ID, i, decoded.ID)
+		}
+	}
+
+	//header length doesn't match the items
+	encoded, _ := testFrame().MarshalBinary()
+	err := new(Frame).UnmarshalBinary(encoded[:len(encoded)-1])
+	var frameErr *FrameError
+	if !errors.As(err, &frameErr) || frameErr.Status != STATUS_PROCESSING_ERROR {
+		t.Errorf("Expected PROCESSING_ERROR for truncated frame but got %v", err)
+	}
+}
+
+func TestReadFrameShouldReadEachFrame(t *testing.T) {
+	first := testFrame()
+	second := testFrame()
+	second.ID = 43
+	second.Priority = PRIORITY_CONSERVE_POWER
+
+	encoded, _ := first.MarshalBinary()
+	encoded, _ = second.AppendBinary(encoded)
+	reader := bytes.NewReader(encoded)
+
+	for _, expected := range []*Frame{first, second} {
+		frame, err := ReadFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.ID != expected.ID || frame.Priority != expected.Priority {
+			t.Errorf("Expected %+v but got %+v", expected, frame)
+		}
+	}
+
+	if _, err := ReadFrame(reader); err != io.EOF {
+		t.Errorf("Expected io.EOF but got %v", err)
+	}
+
+	//frame cut off after the header
+	if _, err := ReadFrame(bytes.NewReader(encoded[:10])); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF but got %v", err)
+	}
+
+	//unknown command
+	_, err := ReadFrame(bytes.NewReader([]byte{7, 0, 0, 0, 0}))
+	var frameErr *FrameError
+	if !errors.As(err, &frameErr) || frameErr.Status != STATUS_PROCESSING_ERROR {
+		t.Errorf("Expected PROCESSING_ERROR for unknown command but got %v", err)
+	}
+}
+
+func TestFrameShouldEncodeEnhancedFormat(t *testing.T) {
+	frame := testFrame()
+	encoded, err := frame.AppendWireFormat(nil, WIRE_FORMAT_ENHANCED)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{ENHANCED_NOTIFICATION_COMMAND, 0, 0, 0, 42, 0x65, 0x53, 0xf1, 0x00, 0, 32}
+	expected = append(expected, frame.Token...)
+	expected = append(expected, 0, 27)
+	expected = append(expected, frame.Payload...)
+
+	//no priority in the enhanced format
+	if !bytes.Equal(encoded, expected) {
+		t.Errorf("Expected enhanced notification\n%x\nbut got\n%x", expected, encoded)
+	}
+	if frame.LenWireFormat(WIRE_FORMAT_ENHANCED) != len(expected) {
+		t.Errorf("Expected Len %v but got %v", len(expected), frame.LenWireFormat(WIRE_FORMAT_ENHANCED))
+	}
+}
+
+func TestFrameShouldEncodeSimpleFormat(t *testing.T) {
+	frame := testFrame()
+	encoded, err := frame.AppendWireFormat(nil, WIRE_FORMAT_SIMPLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{SIMPLE_NOTIFICATION_COMMAND, 0, 32}
+	expected = append(expected, frame.Token...)
+	expected = append(expected, 0, 27)
+	expected = append(expected, frame.Payload...)
+
+	if !bytes.Equal(encoded, expected) {
+		t.Errorf("Expected simple notification\n%x\nbut got\n%x", expected, encoded)
+	}
+	if frame.LenWireFormat(WIRE_FORMAT_SIMPLE) != len(expected) {
+		t.Errorf("Expected Len %v but got %v", len(expected), frame.LenWireFormat(WIRE_FORMAT_SIMPLE))
+	}
+}
+
+func TestFrameShouldValidateLegacyFormats(t *testing.T) {
+	//priority isn't sent so isn't checked
+	frame := testFrame()
+	frame.Priority = 7
+	for _, format := range []WireFormat{WIRE_FORMAT_ENHANCED, WIRE_FORMAT_SIMPLE} {
+		if _, err := frame.AppendWireFormat(nil, format); err != nil {
+			t.Errorf("Expected format %v to ignore priority but got %v", format, err)
+		}
+	}
+
+	frame.Token = frame.Token[:4]
+	for _, format := range []WireFormat{WIRE_FORMAT_ENHANCED, WIRE_FORMAT_SIMPLE} {
+		if _, err := frame.AppendWireFormat(nil, format); !errors.Is(err, ErrInvalidTokenSize) {
+			t.Errorf("Expected ErrInvalidTokenSize for format %v but got %v", format, err)
+		}
+	}
+
+	if _, err := testFrame().AppendWireFormat(nil, WireFormat(5)); err == nil {
+		t.Error("Expected error for unknown wire format")
+	}
+}
+
+func TestReadFrameShouldReadLegacyFormats(t *testing.T) {
+	frame := testFrame()
+	encoded, _ := frame.AppendWireFormat(nil, WIRE_FORMAT_ENHANCED)
+	encoded, _ = frame.AppendWireFormat(encoded, WIRE_FORMAT_SIMPLE)
+	reader := bytes.NewReader(encoded)
+
+	enhanced, err := ReadFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(enhanced.Token, frame.Token) || !bytes.Equal(enhanced.Payload, frame.Payload) ||
+		enhanced.ID != frame.ID || enhanced.Expiration != frame.Expiration || enhanced.Priority != 0 {
+		t.Errorf("Unexpected enhanced notification %+v", enhanced)
+	}
+
+	simple, err := ReadFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(simple.Token, frame.Token) || !bytes.Equal(simple.Payload, frame.Payload) ||
+		simple.ID != 0 || simple.Expiration != 0 {
+		t.Errorf("Unexpected simple notification %+v", simple)
+	}
+
+	//short token
+	decoded := new(Frame)
+	err = decoded.UnmarshalBinary([]byte{SIMPLE_NOTIFICATION_COMMAND, 0, 2, 0xab, 0xcd, 0, 2, '{', '}'})
+	var frameErr *FrameError
+	if !errors.As(err, &frameErr) || frameErr.Status != STATUS_INVALID_TOKEN_SIZE {
+		t.Errorf("Expected INVALID_TOKEN_SIZE but got %v", err)
+	}
+
+	//cut off after the command
+	if _, err := ReadFrame(bytes.NewReader([]byte{ENHANCED_NOTIFICATION_COMMAND})); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF but got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package apns
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+//Extended grapheme cluster segmentation, close enough to UAX #29 that
+//truncated alert text never splits what a user sees as one character:
+//combining marks, emoji with modifiers or variation selectors, emoji ZWJ
+//sequences, flags, tag sequences, Hangul syllables and CR LF
+
+const zeroWidthJoiner = '\u200d'
+
+//Length in bytes of the grapheme cluster s starts with
+//Invalid utf-8 bytes are clusters of their own
+func graphemeLen(s string) int {
+	r, size := utf8.DecodeRuneInString(s)
+	if size <= 1 && r == utf8.RuneError {
+		return size
+	}
+	if r == '\r' && len(s) > 1 && s[1] == '\n' {
+		return 2
+	}
+	if isGraphemeControl(r) {
+		return size
+	}
+
+	prev := r
+	pictographic := isPictographic(r)
+	regionalIndicators := 0
+	if isRegionalIndicator(r) {
+		regionalIndicators = 1
+	}
+
+	i := size
+	for i < len(s) {
+		next, nextSize := utf8.DecodeRuneInString(s[i:])
+		if next == utf8.RuneError && nextSize == 1 {
+			break
+		}
+
+		switch {
+		case joinsHangul(prev, next):
+		case isGraphemeExtend(next) || next == zeroWidthJoiner:
+			//extends the cluster without changing its base
+		case prev == zeroWidthJoiner && pictographic && isPictographic(next):
+		case regionalIndicators == 1 && isRegionalIndicator(next):
+			//a flag is a pair of regional indicators
+			regionalIndicators++
+		default:
+			return i
+		}
+
+		prev = next
+		i += nextSize
+	}
+	return i
+}
+
+//Control characters are clusters of their own
+func isGraphemeControl(r rune) bool {
+	return r == '\u2028' || r == '\u2029' || (unicode.IsControl(r) && r != zeroWidthJoiner)
+}
+
+//Marks, variation selectors, emoji modifiers and tags extend the cluster before them
+func isGraphemeExtend(r rune) bool {
+	switch {
+	case r >= 0x1f3fb && r <= 0x1f3ff:
+		//emoji skin tone modifiers
+		return true
+	case r >= 0xe0020 && r <= 0xe007f:
+		//tags, used by subdivision flags
+		return true
+	case r == '\u200c':
+		//zero width non-joiner
+		return true
+	}
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc)
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+//Approximates Extended_Pictographic, the emoji that can be joined with a ZWJ
+func isPictographic(r rune) bool {
+	switch {
+	case r >= 0x1f000 && r <= 0x1faff:
+		return !isRegionalIndicator(r) && !(r >= 0x1f3fb && r <= 0x1f3ff)
+	case r >= 0x2190 && r <= 0x21ff, r >= 0x2300 && r <= 0x23ff,
+		r >= 0x2600 && r <= 0x27bf, r >= 0x2b00 && r <= 0x2bff:
+		return true
+	}
+	switch r {
+	case 0xa9, 0xae, 0x203c, 0x2049, 0x2122, 0x2139, 0x3030, 0x303d, 0x3297, 0x3299:
+		return true
+	}
+	return false
+}
+
+//Hangul jamo and syllable types
+const (
+	hangulNone = iota
+	hangulL
+	hangulV
+	hangulT
+	hangulLV
+	hangulLVT
+)
+
+func hangulType(r rune) int {
+	switch {
+	case r >= 0x1100 && r <= 0x115f, r >= 0xa960 && r <= 0xa97c:
+		return hangulL
+	case r >= 0x1160 && r <= 0x11a7, r >= 0xd7b0 && r <= 0xd7c6:
+		return hangulV
+	case r >= 0x11a8 && r <= 0x11ff, r >= 0xd7cb && r <= 0xd7fb:
+		return hangulT
+	case r >= 0xac00 && r <= 0xd7a3:
+		if (r-0xac00)%28 == 0 {
+			return hangulLV
+		}
+		return hangulLVT
+	}
+	return hangulNone
+}
+
+//Whether jamo next continues the syllable ending in prev
+func joinsHangul(prev rune, next rune) bool {
+	switch hangulType(prev) {
+	case hangulL:
+		t := hangulType(next)
+		return t == hangulL || t == hangulV || t == hangulLV || t == hangulLVT
+	case hangulLV, hangulV:
+		t := hangulType(next)
+		return t == hangulV || t == hangulT
+	case hangulLVT, hangulT:
+		return hangulType(next) == hangulT
+	}
+	return false
+}
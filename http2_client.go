@@ -0,0 +1,384 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Config for creating an APNS HTTP/2 provider API client
+type APNSHTTP2Config struct {
+	//bytes for cert.pem : required unless using token authentication
+	CertificateBytes []byte
+	//bytes for key.pem : required unless using token authentication
+	KeyBytes []byte
+	//bytes for the .p8 signing key : required for token authentication
+	AuthKeyBytes []byte
+	//Key ID of the signing key : required for token authentication
+	KeyID string
+	//Team ID that owns the signing key : required for token authentication
+	TeamID string
+	//number of minutes to reuse a provider token before signing a new one,
+	//must be between 20 and 60, defaults to 50
+	TokenRefreshInterval int
+	//apple provider api host, defaults to APNS_HTTP2_PRODUCTION_HOST
+	GatewayHost string
+	//apple provider api port, defaults to "443"
+	GatewayPort string
+	//apns-topic (usually the app bundle id) used when a Payload has no Topic,
+	//LIVE_ACTIVITY_TOPIC_SUFFIX is added for Live Activity pushes
+	Topic string
+	//max number of bytes allowed in payload, defaults to 4096
+	MaxPayloadSize int
+	//how payloads over MaxPayloadSize are truncated, defaults to DefaultTruncationPolicy
+	TruncationPolicy *TruncationPolicy
+	//number of seconds to wait for connection before bailing, defaults to no timeout
+	SocketTimeout int
+	//number of seconds to wait for Tls handshake to complete before bailing, defaults to 5 sec
+	TlsTimeout int
+	//number of seconds to wait for apple to respond to a push, defaults to 30 sec
+	RequestTimeout int
+	//root certificates used to verify the provider api, defaults to the system roots
+	RootCAs *x509.CertPool
+}
+
+//Result of sending a single Payload over the provider API
+type HTTP2Response struct {
+	//The payload that was sent
+	Payload *Payload
+	//apns-id of the notification
+	ApnsID string
+	//HTTP status code returned by Apple, 0 if no response was received
+	StatusCode int
+	//Reason Apple rejected the notification (e.g. "BadDeviceToken"), empty on success
+	Reason string
+	//For status 410, milliseconds since epoch when the token stopped being valid
+	Timestamp int64
+	//Set if the request couldn't be completed, an *InvalidPayloadError
+	//if the payload couldn't be sent, otherwise a network or decoding error
+	Error error
+}
+
+//APNS HTTP/2 provider API client
+//Safe for concurrent use, each Push is sent as its own HTTP/2 stream
+type APNSHTTP2Client struct {
+	//config
+	config *APNSHTTP2Config
+	//http client with HTTP/2 transport
+	httpClient *http.Client
+	//transport, kept around to close idle connections
+	transport *http.Transport
+	//scheme://host:port prefix for requests
+	baseURL string
+	//provider token signer, nil when using certificate authentication
+	token *providerToken
+	//timestamp of the last push to each running Live Activity
+	liveActivities *liveActivityTracker
+}
+
+//Body of a rejected provider API response
+type http2ErrorResponse struct {
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+const (
+	//Host of Apple's production provider API
+	APNS_HTTP2_PRODUCTION_HOST = "api.push.apple.com"
+	//Host of Apple's development provider API
+	APNS_HTTP2_DEVELOPMENT_HOST = "api.sandbox.push.apple.com"
+	//Max payload size accepted by the provider API
+	APNS_HTTP2_MAX_PAYLOAD_SIZE = 4096
+)
+
+//Whether Apple accepted the notification (status 200 with no error)
+func (r *HTTP2Response) Accepted() bool {
+	return r.Error == nil && r.StatusCode == http.StatusOK
+}
+
+// Apply config defaults to given HTTP/2 Config
+func applyHTTP2ConfigDefaults(config *APNSHTTP2Config) error {
+	errorStrs := ""
+
+	if config.AuthKeyBytes != nil {
+		if config.KeyID == "" || config.TeamID == "" {
+			errorStrs += "Invalid KeyID/TeamID. Both are required with AuthKeyBytes\n"
+		}
+	} else if config.CertificateBytes == nil || config.KeyBytes == nil {
+		errorStrs += "Invalid Key/Certificate bytes\n"
+	}
+	if config.MaxPayloadSize < 0 {
+		errorStrs += "Invalid MaxPayloadSize. Should be greater than 0.\n"
+	}
+	if config.TokenRefreshInterval != 0 &&
+		(config.TokenRefreshInterval < PROVIDER_TOKEN_MIN_REFRESH_MINUTES ||
+			config.TokenRefreshInterval > PROVIDER_TOKEN_MAX_REFRESH_MINUTES) {
+		errorStrs += "Invalid TokenRefreshInterval. Should be between 20 and 60 minutes\n"
+	}
+
+	if errorStrs != "" {
+		return errors.New(errorStrs)
+	}
+
+	if config.GatewayHost == "" {
+		config.GatewayHost = APNS_HTTP2_PRODUCTION_HOST
+	}
+	if config.GatewayPort == "" {
+		config.GatewayPort = "443"
+	}
+	if config.MaxPayloadSize == 0 {
+		config.MaxPayloadSize = APNS_HTTP2_MAX_PAYLOAD_SIZE
+	}
+	if config.TlsTimeout == 0 {
+		config.TlsTimeout = 5
+	}
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = 30
+	}
+	if config.TokenRefreshInterval == 0 {
+		config.TokenRefreshInterval = 50
+	}
+	return nil
+}
+
+//Create a new HTTP/2 provider API client with supplied config
+//If invalid config an error will be returned
+//Connections to Apple are made lazily on the first Push
+func NewAPNSHTTP2Client(config *APNSHTTP2Config) (*APNSHTTP2Client, error) {
+	err := applyHTTP2ConfigDefaults(config)
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(APNSHTTP2Client)
+	c.config = config
+	c.liveActivities = newLiveActivityTracker()
+
+	tlsConf := &tls.Config{ServerName: config.GatewayHost}
+	if config.CertificateBytes != nil && config.KeyBytes != nil {
+		tlsConf, err = createTLSConfig(config.CertificateBytes, config.KeyBytes, config.GatewayHost)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tlsConf.RootCAs = config.RootCAs
+	tlsConf.NextProtos = []string{"h2"}
+
+	if config.AuthKeyBytes != nil {
+		c.token, err = newProviderToken(config.AuthKeyBytes, config.KeyID, config.TeamID,
+			time.Duration(config.TokenRefreshInterval)*time.Minute)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.baseURL = "https://" + net.JoinHostPort(config.GatewayHost, config.GatewayPort)
+	c.transport = &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: time.Duration(config.SocketTimeout) * time.Second}
+			socket, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				//failed to connect to gateway
+				return nil, err
+			}
+
+			tlsSocket, err := handshakeTLSClient(ctx, socket, tlsConf, config.TlsTimeout)
+			if err != nil {
+				socket.Close()
+				return nil, err
+			}
+
+			if tlsSocket.ConnectionState().NegotiatedProtocol != "h2" {
+				tlsSocket.Close()
+				return nil, errors.New("Provider API did not negotiate HTTP/2")
+			}
+
+			return tlsSocket, nil
+		},
+		ForceAttemptHTTP2: true,
+	}
+	c.httpClient = &http.Client{
+		Transport: c.transport,
+		Timeout:   time.Duration(config.RequestTimeout) * time.Second,
+	}
+
+	return c, nil
+}
+
+//Send a single payload to Apple and wait for the result
+func (c *APNSHTTP2Client) Push(payload *Payload) *HTTP2Response {
+	response := &HTTP2Response{
+		Payload: payload,
+		ApnsID:  payload.ApnsID,
+	}
+
+	if response.ApnsID == "" {
+		apnsID, err := newApnsID()
+		if err != nil {
+			response.Error = err
+			return response
+		}
+		response.ApnsID = apnsID
+	}
+
+	req, err := c.newRequest(payload, response.ApnsID)
+	if err != nil {
+		response.Error = err
+		return response
+	}
+
+	if payload.LiveActivity != nil {
+		previous, err := c.liveActivities.reserve(payload)
+		if err != nil {
+			response.Error = newInvalidPayloadError(payload, err)
+			return response
+		}
+		defer func() {
+			if !response.Accepted() {
+				c.liveActivities.release(payload, previous)
+			} else if payload.LiveActivity.Event == LIVE_ACTIVITY_EVENT_END {
+				c.liveActivities.ended(payload)
+			}
+		}()
+	}
+
+	httpResponse, err := c.httpClient.Do(req)
+	if err != nil {
+		response.Error = err
+		return response
+	}
+	defer httpResponse.Body.Close()
+
+	response.StatusCode = httpResponse.StatusCode
+	if apnsID := httpResponse.Header.Get("apns-id"); apnsID != "" {
+		response.ApnsID = apnsID
+	}
+
+	if httpResponse.StatusCode == http.StatusOK {
+		//drain so the stream can be reused
+		io.Copy(io.Discard, httpResponse.Body)
+		return response
+	}
+
+	errorResponse := http2ErrorResponse{}
+	err = json.NewDecoder(httpResponse.Body).Decode(&errorResponse)
+	if err != nil && err != io.EOF {
+		response.Error = fmt.Errorf("Error decoding provider API response with status %v : %v", httpResponse.StatusCode, err)
+		return response
+	}
+	response.Reason = errorResponse.Reason
+	response.Timestamp = errorResponse.Timestamp
+
+	if c.token != nil && response.Reason == "ExpiredProviderToken" {
+		//apple disagrees with our clock, sign a fresh token once apple allows a refresh
+		c.token.Expire()
+	}
+
+	return response
+}
+
+//Close any idle connections to the provider API
+func (c *APNSHTTP2Client) Close() {
+	c.transport.CloseIdleConnections()
+}
+
+//Build the provider API request for payload
+func (c *APNSHTTP2Client) newRequest(payload *Payload, apnsID string) (*http.Request, error) {
+	if !validHTTP2Token(payload.Token) {
+		return nil, newInvalidPayloadError(payload, ErrInvalidTokenEncoding)
+	}
+	if err := payload.validateBackground(); err != nil {
+		return nil, newInvalidPayloadError(payload, err)
+	}
+	if payload.LiveActivity != nil && c.token == nil {
+		//apple only takes Live Activities with token authentication
+		return nil, newInvalidPayloadError(payload, ErrLiveActivityUnsupported)
+	}
+
+	payloadBytes, _, err := payload.MarshalWithPolicy(c.config.MaxPayloadSize, c.config.TruncationPolicy)
+	if err != nil {
+		return nil, newInvalidPayloadError(payload, err)
+	}
+
+	req, err := http.NewRequest("POST", c.baseURL+"/3/device/"+payload.Token, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	topic := payload.Topic
+	if topic == "" {
+		topic = c.config.Topic
+	}
+	if payload.LiveActivity != nil && topic != "" && !strings.HasSuffix(topic, LIVE_ACTIVITY_TOPIC_SUFFIX) {
+		topic += LIVE_ACTIVITY_TOPIC_SUFFIX
+	}
+
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("apns-id", apnsID)
+	req.Header.Set("apns-push-type", payload.pushType())
+	if topic != "" {
+		req.Header.Set("apns-topic", topic)
+	}
+	if payload.ExpirationTime != 0 {
+		req.Header.Set("apns-expiration", strconv.FormatUint(uint64(payload.ExpirationTime), 10))
+	}
+	if priority := payload.sendPriority(); priority != 0 {
+		req.Header.Set("apns-priority", strconv.Itoa(int(priority)))
+	}
+	if c.token != nil {
+		bearer, err := c.token.Bearer()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("authorization", "bearer "+bearer)
+	}
+
+	return req, nil
+}
+
+//Whether token can be sent to the provider API, which takes hex tokens of any length
+func validHTTP2Token(token string) bool {
+	_, err := hex.DecodeString(token)
+	return err == nil && token != ""
+}
+
+//apns-push-type for the payload, "liveactivity" for Live Activities,
+//"background" for content-available only payloads and "alert" for everything else
+func (p *Payload) pushType() string {
+	if p.LiveActivity != nil {
+		return "liveactivity"
+	}
+	if p.Background {
+		return "background"
+	}
+	if p.ContentAvailable != 0 && p.AlertText == "" && p.AlertBody.Body == "" &&
+		!p.Sound.IsSet() && !p.Badge.IsSet() {
+		return "background"
+	}
+	return "alert"
+}
+
+//Generate a random (version 4) UUID to use as an apns-id
+func newApnsID() (string, error) {
+	uuid := make([]byte, 16)
+	_, err := rand.Read(uuid)
+	if err != nil {
+		return "", err
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
@@ -0,0 +1,268 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//Generate a self signed cert/key pem pair to use as a push certificate
+func generateTestCertificate(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Apple Push Services: com.example.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+//Start a local HTTP/2 provider API and a config pointing at it
+func newTestHTTP2Server(handler http.HandlerFunc) (*APNSHTTP2Config, *httptest.Server) {
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+
+	return &APNSHTTP2Config{
+		GatewayHost: host,
+		GatewayPort: port,
+		Topic:       "com.example.test",
+		RootCAs:     rootCAs,
+	}, server
+}
+
+//Start a local HTTP/2 provider API and a cert authenticated client configured to talk to it
+func newTestHTTP2Client(t *testing.T, handler http.HandlerFunc) (*APNSHTTP2Client, *httptest.Server) {
+	config, server := newTestHTTP2Server(handler)
+	config.CertificateBytes, config.KeyBytes = generateTestCertificate(t)
+
+	client, err := NewAPNSHTTP2Client(config)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	return client, server
+}
+
+//Client using token authentication, needed to send Live Activities
+func newTestTokenHTTP2Client(t *testing.T, handler http.HandlerFunc) (*APNSHTTP2Client, *httptest.Server) {
+	config, server := newTestHTTP2Server(handler)
+	_, config.AuthKeyBytes = generateTestAuthKey(t)
+	config.KeyID = "ABC123DEFG"
+	config.TeamID = "DEF123GHIJ"
+
+	client, err := NewAPNSHTTP2Client(config)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	return client, server
+}
+
+func TestHTTP2ClientShouldRequireCertificate(t *testing.T) {
+	_, err := NewAPNSHTTP2Client(&APNSHTTP2Config{})
+	if err == nil {
+		t.Error("Expected error for missing Key/Certificate bytes")
+	}
+}
+
+func TestHTTP2ClientShouldSendPayload(t *testing.T) {
+	token := "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f"
+	apnsID := "d8fa5b35-2bd4-4c4b-a1ef-0b7a6d1f0a3b"
+
+	var request *http.Request
+	var body []byte
+	client, server := newTestHTTP2Client(t, func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("apns-id", r.Header.Get("apns-id"))
+	})
+	defer server.Close()
+	defer client.Close()
+
+	response := client.Push(&Payload{
+		AlertText:      "Testing",
+		Token:          token,
+		ApnsID:         apnsID,
+		Priority:       10,
+		ExpirationTime: 1500000000,
+	})
+
+	if !response.Accepted() {
+		t.Fatalf("Expected payload to be accepted but received %+v", response)
+	}
+	if request.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2 request but was %v", request.Proto)
+	}
+	if request.Method != "POST" || request.URL.Path != "/3/device/"+token {
+		t.Errorf("Unexpected request %v %v", request.Method, request.URL.Path)
+	}
+
+	expectedHeaders := map[string]string{
+		"apns-topic":      "com.example.test",
+		"apns-priority":   "10",
+		"apns-expiration": "1500000000",
+		"apns-id":         apnsID,
+		"apns-push-type":  "alert",
+	}
+	for header, expected := range expectedHeaders {
+		if request.Header.Get(header) != expected {
+			t.Errorf("Expected header %v to be %v but was %v", header, expected, request.Header.Get(header))
+		}
+	}
+
+	expectedJson := "{\"aps\":{\"alert\":\"Testing\"}}"
+	if string(body) != expectedJson {
+		t.Errorf("Expected %v but got %v", expectedJson, string(body))
+	}
+	if response.ApnsID != apnsID {
+		t.Errorf("Expected apns-id %v but got %v", apnsID, response.ApnsID)
+	}
+}
+
+func TestHTTP2ClientShouldGenerateApnsIDAndOmitUnsetHeaders(t *testing.T) {
+	var request *http.Request
+	client, server := newTestHTTP2Client(t, func(w http.ResponseWriter, r *http.Request) {
+		request = r
+	})
+	defer server.Close()
+	defer client.Close()
+
+	response := client.Push(&Payload{
+		ContentAvailable: 1,
+		Topic:            "com.example.other",
+		Token:            "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+	})
+
+	if !response.Accepted() {
+		t.Fatalf("Expected payload to be accepted but received %+v", response)
+	}
+	if len(response.ApnsID) != 36 || request.Header.Get("apns-id") != response.ApnsID {
+		t.Errorf("Expected generated apns-id but got %v", response.ApnsID)
+	}
+	if request.Header.Get("apns-topic") != "com.example.other" {
+		t.Errorf("Expected payload topic to override config topic but was %v", request.Header.Get("apns-topic"))
+	}
+	if request.Header.Get("apns-push-type") != "background" {
+		t.Errorf("Expected background push type but was %v", request.Header.Get("apns-push-type"))
+	}
+	for _, header := range []string{"apns-priority", "apns-expiration"} {
+		if _, ok := request.Header[http.CanonicalHeaderKey(header)]; ok {
+			t.Errorf("Expected %v header to be omitted", header)
+		}
+	}
+}
+
+func TestHTTP2ClientShouldReturnRejection(t *testing.T) {
+	client, server := newTestHTTP2Client(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprint(w, "{\"reason\":\"Unregistered\",\"timestamp\":1500000000000}")
+	})
+	defer server.Close()
+	defer client.Close()
+
+	response := client.Push(&Payload{
+		AlertText: "Testing",
+		Token:     "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+	})
+
+	if response.Accepted() {
+		t.Fatal("Expected payload to be rejected")
+	}
+	if response.Error != nil {
+		t.Errorf("Expected no request error but got %v", response.Error)
+	}
+	if response.StatusCode != http.StatusGone || response.Reason != "Unregistered" ||
+		response.Timestamp != 1500000000000 {
+		t.Errorf("Unexpected rejection %+v", response)
+	}
+}
+
+func TestHTTP2ClientShouldNotSendInvalidPayload(t *testing.T) {
+	requests := 0
+	client, server := newTestHTTP2Client(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	})
+	defer server.Close()
+	defer client.Close()
+
+	payloads := []*Payload{
+		{AlertText: "Testing", Token: "not hex"},
+		{AlertText: "Testing", Token: "4ec500", CustomFields: map[string]interface{}{"aps": 1}},
+	}
+	for _, payload := range payloads {
+		response := client.Push(payload)
+		if response.Error == nil {
+			t.Errorf("Expected error for payload %+v", payload)
+		}
+	}
+
+	if requests != 0 {
+		t.Errorf("Expected no requests to be sent but %v were", requests)
+	}
+}
+
+func TestHTTP2ClientShouldSendBackgroundPayload(t *testing.T) {
+	var request *http.Request
+	client, server := newTestHTTP2Client(t, func(w http.ResponseWriter, r *http.Request) {
+		request = r
+	})
+	defer server.Close()
+	defer client.Close()
+
+	payload := NewBackgroundPayload("4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f", nil)
+	payload.Priority = 0
+	response := client.Push(payload)
+
+	if !response.Accepted() {
+		t.Fatalf("Expected payload to be accepted but received %+v", response)
+	}
+	if request.Header.Get("apns-push-type") != "background" || request.Header.Get("apns-priority") != "5" {
+		t.Errorf("Expected background push type at priority 5 but got %v at %v",
+			request.Header.Get("apns-push-type"), request.Header.Get("apns-priority"))
+	}
+
+	payload.Sound = NewSound("default")
+	response = client.Push(payload)
+	if !errors.Is(response.Error, ErrInvalidBackgroundPayload) {
+		t.Errorf("Expected ErrInvalidBackgroundPayload but got %v", response.Error)
+	}
+}
@@ -0,0 +1,75 @@
+package apns
+
+//Ring buffer of the most recently buffered payloads, kept for replay
+//Entries are stored by value in a slice allocated up front, so buffering
+//a payload doesn't allocate
+//IDs are consecutive (skipping 0 when the counter wraps), so the entry
+//for an ID is found from its distance to the newest ID
+//NOT THREADSAFE (callers hold inFlightBufferLock)
+type inFlightBuffer struct {
+	entries []idPayload
+	//index in entries of the oldest entry
+	head int
+	//number of entries in use
+	length int
+}
+
+//Create an inFlightBuffer holding up to size payloads
+func newInFlightBuffer(size int) *inFlightBuffer {
+	return &inFlightBuffer{
+		entries: make([]idPayload, size),
+	}
+}
+
+//Number of payloads in the buffer
+func (b *inFlightBuffer) Len() int {
+	return b.length
+}
+
+//Entry i, from 0 (oldest) to Len() - 1 (newest)
+//The pointer is only valid until the next push
+func (b *inFlightBuffer) at(i int) *idPayload {
+	return &b.entries[(b.head+i)%len(b.entries)]
+}
+
+//Add entry as the newest payload
+//If the buffer was full the oldest entry is evicted and returned
+func (b *inFlightBuffer) push(entry idPayload) (evicted idPayload, wasFull bool) {
+	if len(b.entries) == 0 {
+		return entry, true
+	}
+
+	if b.length == len(b.entries) {
+		evicted = b.entries[b.head]
+		b.entries[b.head] = entry
+		b.head = (b.head + 1) % len(b.entries)
+		return evicted, true
+	}
+
+	b.entries[(b.head+b.length)%len(b.entries)] = entry
+	b.length++
+	return idPayload{}, false
+}
+
+//Index (see at) of the entry with id, -1 if it isn't in the buffer
+func (b *inFlightBuffer) indexOf(id uint32) int {
+	if b.length == 0 || id == 0 {
+		return -1
+	}
+
+	newest := b.at(b.length - 1).ID
+	distance := newest - id
+	if id > newest {
+		//the counter wrapped between id and newest, skipping 0
+		distance--
+	}
+	if distance >= uint32(b.length) {
+		return -1
+	}
+
+	i := b.length - 1 - int(distance)
+	if b.at(i).ID != id {
+		return -1
+	}
+	return i
+}
@@ -0,0 +1,138 @@
+package apns
+
+import (
+	"container/list"
+	"testing"
+)
+
+func TestInFlightBufferShouldEvictOldest(t *testing.T) {
+	b := newInFlightBuffer(3)
+	for id := uint32(1); id <= 3; id++ {
+		if _, wasFull := b.push(idPayload{ID: id}); wasFull {
+			t.Fatalf("Expected no eviction for id %v", id)
+		}
+	}
+
+	evicted, wasFull := b.push(idPayload{ID: 4})
+	if !wasFull || evicted.ID != 1 {
+		t.Fatalf("Expected id 1 to be evicted but got %v %v", evicted.ID, wasFull)
+	}
+
+	if b.Len() != 3 {
+		t.Fatalf("Expected 3 entries but got %v", b.Len())
+	}
+	for i := 0; i < b.Len(); i++ {
+		if b.at(i).ID != uint32(i+2) {
+			t.Errorf("Expected id %v at %v but got %v", i+2, i, b.at(i).ID)
+		}
+	}
+}
+
+func TestInFlightBufferShouldFindIDs(t *testing.T) {
+	b := newInFlightBuffer(5)
+	if b.indexOf(1) != -1 {
+		t.Error("Expected empty buffer not to find id 1")
+	}
+
+	for id := uint32(1); id <= 8; id++ {
+		b.push(idPayload{ID: id})
+	}
+
+	expected := map[uint32]int{0: -1, 1: -1, 3: -1, 4: 0, 6: 2, 8: 4, 9: -1, 0xffffffff: -1}
+	for id, index := range expected {
+		if b.indexOf(id) != index {
+			t.Errorf("Expected index %v for id %v but got %v", index, id, b.indexOf(id))
+		}
+	}
+}
+
+func TestInFlightBufferShouldFindIDsAcrossWrap(t *testing.T) {
+	b := newInFlightBuffer(4)
+	//the id counter skips 0 when it wraps
+	for _, id := range []uint32{0xfffffffe, 0xffffffff, 1, 2} {
+		b.push(idPayload{ID: id})
+	}
+
+	expected := map[uint32]int{0xfffffffd: -1, 0xfffffffe: 0, 0xffffffff: 1, 0: -1, 1: 2, 2: 3, 3: -1}
+	for id, index := range expected {
+		if b.indexOf(id) != index {
+			t.Errorf("Expected index %v for id %v but got %v", index, id, b.indexOf(id))
+		}
+	}
+}
+
+//The container/list in flight buffer inFlightBuffer replaced,
+//kept to benchmark against
+type listInFlightBuffer struct {
+	payloads *list.List
+	size     int
+}
+
+func (b *listInFlightBuffer) push(entry *idPayload) {
+	b.payloads.PushFront(entry)
+	if b.payloads.Len() > b.size {
+		b.payloads.Remove(b.payloads.Back())
+	}
+}
+
+//Scan from the newest payload for id
+func (b *listInFlightBuffer) find(id uint32) *idPayload {
+	for e := b.payloads.Front(); e != nil; e = e.Next() {
+		idPayloadObj := e.Value.(*idPayload)
+		if idPayloadObj.ID == id {
+			return idPayloadObj
+		}
+	}
+	return nil
+}
+
+const benchmarkInFlightBufferSize = 10000
+
+func BenchmarkInFlightBufferPush(b *testing.B) {
+	buffer := newInFlightBuffer(benchmarkInFlightBufferSize)
+	payload := &Payload{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer.push(idPayload{Payload: payload, ID: uint32(i + 1)})
+	}
+}
+
+func BenchmarkInFlightListPush(b *testing.B) {
+	buffer := &listInFlightBuffer{payloads: list.New(), size: benchmarkInFlightBufferSize}
+	payload := &Payload{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer.push(&idPayload{Payload: payload, ID: uint32(i + 1)})
+	}
+}
+
+//Apple rejected the oldest payload in a full buffer
+func BenchmarkInFlightBufferFindErrorPayload(b *testing.B) {
+	buffer := newInFlightBuffer(benchmarkInFlightBufferSize)
+	for id := uint32(1); id <= benchmarkInFlightBufferSize; id++ {
+		buffer.push(idPayload{Payload: &Payload{}, ID: id})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if buffer.indexOf(1) < 0 {
+			b.Fatal("Error payload not found")
+		}
+	}
+}
+
+func BenchmarkInFlightListFindErrorPayload(b *testing.B) {
+	buffer := &listInFlightBuffer{payloads: list.New(), size: benchmarkInFlightBufferSize}
+	for id := uint32(1); id <= benchmarkInFlightBufferSize; id++ {
+		buffer.push(&idPayload{Payload: &Payload{}, ID: id})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if buffer.find(1) == nil {
+			b.Fatal("Error payload not found")
+		}
+	}
+}
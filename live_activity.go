@@ -0,0 +1,175 @@
+package apns
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//What a Live Activity push does to the activity (iOS 16.1+)
+type LiveActivityEvent string
+
+const (
+	//Start a new Live Activity (push-to-start, iOS 17.2+)
+	LIVE_ACTIVITY_EVENT_START LiveActivityEvent = "start"
+	//Update the content of a running Live Activity
+	LIVE_ACTIVITY_EVENT_UPDATE LiveActivityEvent = "update"
+	//End a Live Activity
+	LIVE_ACTIVITY_EVENT_END LiveActivityEvent = "end"
+)
+
+//Suffix added to the apns-topic of Live Activity pushes
+const LIVE_ACTIVITY_TOPIC_SUFFIX = ".push-type.liveactivity"
+
+//Hours after its last push that an activity is forgotten by the APNSHTTP2Client
+//Activities end after 8 hours and leave the Lock Screen at most 4 hours later
+const LIVE_ACTIVITY_MAX_AGE_HOURS = 12
+
+//Live Activity fields of a Payload's aps dictionary
+//Live Activities can only be pushed with the APNSHTTP2Client
+type LiveActivity struct {
+	//start, update or end : required
+	Event LiveActivityEvent
+	//UNIX time in seconds of this update : required, must be later than
+	//the timestamp of the last push to the same activity
+	Timestamp int64
+	//The activity's ContentState, marshalled with encoding/json
+	//Required for start and update events
+	ContentState interface{}
+	//UNIX time in seconds when the activity's content is out of date, 0 to leave out
+	StaleDate int64
+	//UNIX time in seconds when an ended activity is removed, 0 to leave out
+	DismissalDate int64
+	//Start events only : name of the ActivityAttributes type to start
+	AttributesType string
+	//Start events only : the activity's attributes, marshalled with encoding/json
+	Attributes interface{}
+}
+
+//Get a new Live Activity payload for the activity's push token
+func NewLiveActivityPayload(token string, event LiveActivityEvent, timestamp int64, contentState interface{}) *Payload {
+	return &Payload{
+		Token: token,
+		LiveActivity: &LiveActivity{
+			Event:        event,
+			Timestamp:    timestamp,
+			ContentState: contentState,
+		},
+	}
+}
+
+//Check the Live Activity has what its event needs before it's marshalled
+func (a *LiveActivity) validate() error {
+	switch a.Event {
+	case LIVE_ACTIVITY_EVENT_START:
+		if a.AttributesType == "" || a.Attributes == nil {
+			return ErrInvalidLiveActivityAttributes
+		}
+	case LIVE_ACTIVITY_EVENT_UPDATE, LIVE_ACTIVITY_EVENT_END:
+		if a.AttributesType != "" || a.Attributes != nil {
+			return ErrInvalidLiveActivityAttributes
+		}
+	default:
+		return ErrInvalidLiveActivityEvent
+	}
+
+	if a.Timestamp <= 0 {
+		return ErrMissingLiveActivityTimestamp
+	}
+	if a.ContentState == nil && a.Event != LIVE_ACTIVITY_EVENT_END {
+		return ErrMissingContentState
+	}
+	return nil
+}
+
+//Last timestamp pushed to each Live Activity, so out of order pushes aren't sent
+type liveActivityTracker struct {
+	//Mutex to sync access to activities
+	lock *sync.Mutex
+	//activities being pushed to, by token
+	activities map[string]*trackedLiveActivity
+	//when activities was last swept for expired activities
+	sweptAt time.Time
+	//clock, replaced in tests
+	now func() time.Time
+}
+
+type trackedLiveActivity struct {
+	//timestamp of the newest push that hasn't failed
+	timestamp int64
+	//when the activity was last pushed to
+	pushedAt time.Time
+}
+
+func newLiveActivityTracker() *liveActivityTracker {
+	return &liveActivityTracker{
+		lock:       new(sync.Mutex),
+		activities: make(map[string]*trackedLiveActivity),
+		now:        time.Now,
+	}
+}
+
+//Check payload is later than the last push to its activity and record its
+//timestamp under the same lock, so concurrent pushes can't both pass the check
+//Returns the timestamp it replaced for release, 0 if the activity wasn't tracked
+func (t *liveActivityTracker) reserve(payload *Payload) (int64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	maxAge := LIVE_ACTIVITY_MAX_AGE_HOURS * time.Hour
+	if now.Sub(t.sweptAt) >= time.Hour {
+		for token, activity := range t.activities {
+			if now.Sub(activity.pushedAt) >= maxAge {
+				delete(t.activities, token)
+			}
+		}
+		t.sweptAt = now
+	}
+
+	activity := t.activities[payload.Token]
+	if activity == nil || now.Sub(activity.pushedAt) >= maxAge {
+		t.activities[payload.Token] = &trackedLiveActivity{
+			timestamp: payload.LiveActivity.Timestamp,
+			pushedAt:  now,
+		}
+		return 0, nil
+	}
+	if payload.LiveActivity.Timestamp <= activity.timestamp {
+		return 0, fmt.Errorf("%w. Was %v, last was %v", ErrLiveActivityOutOfOrder, payload.LiveActivity.Timestamp, activity.timestamp)
+	}
+
+	previous := activity.timestamp
+	activity.timestamp = payload.LiveActivity.Timestamp
+	activity.pushedAt = now
+	return previous, nil
+}
+
+//Give back the timestamp reserved for a push that wasn't accepted,
+//unless a later push has reserved its own since
+func (t *liveActivityTracker) release(payload *Payload, previous int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	activity := t.activities[payload.Token]
+	if activity == nil || activity.timestamp != payload.LiveActivity.Timestamp {
+		return
+	}
+	if previous == 0 {
+		delete(t.activities, payload.Token)
+		return
+	}
+	activity.timestamp = previous
+}
+
+//Forget an activity once its end event is accepted,
+//unless a later push has reserved its own since
+func (t *liveActivityTracker) ended(payload *Payload) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	activity := t.activities[payload.Token]
+	if activity != nil && activity.timestamp == payload.LiveActivity.Timestamp {
+		delete(t.activities, payload.Token)
+	}
+}
@@ -0,0 +1,321 @@
+package apns
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type testScore struct {
+	Home int `json:"home"`
+	Away int `json:"away"`
+}
+
+func TestLiveActivityMarshal(t *testing.T) {
+	p := NewLiveActivityPayload("", LIVE_ACTIVITY_EVENT_UPDATE, 1700000000, testScore{Home: 1})
+	p.LiveActivity.StaleDate = 1700000600
+	p.AlertBody = APSAlertBody{Title: "Goal!", Body: "Home 1 - 0 Away"}
+	p.Sound = NewSound("goal.aiff")
+	p.RelevanceScore = NewRelevanceScore(0.5)
+
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedJson := "{\"aps\":{\"alert\":{\"body\":\"Home 1 - 0 Away\",\"title\":\"Goal!\"}," +
+		"\"content-state\":{\"home\":1,\"away\":0},\"event\":\"update\",\"relevance-score\":0.5," +
+		"\"sound\":\"goal.aiff\",\"stale-date\":1700000600,\"timestamp\":1700000000}}"
+	if string(json) != expectedJson {
+		t.Errorf("Expected %v but got %v", expectedJson, string(json))
+	}
+}
+
+func TestLiveActivityMarshalStartAndEnd(t *testing.T) {
+	p := NewLiveActivityPayload("", LIVE_ACTIVITY_EVENT_START, 1700000000, testScore{})
+	p.LiveActivity.AttributesType = "MatchAttributes"
+	p.LiveActivity.Attributes = map[string]string{"match": "Home v Away"}
+
+	json, err := p.Marshal(256)
+	expectedJson := "{\"aps\":{\"attributes\":{\"match\":\"Home v Away\"},\"attributes-type\":\"MatchAttributes\"," +
+		"\"content-state\":{\"home\":0,\"away\":0},\"event\":\"start\",\"timestamp\":1700000000}}"
+	if err != nil || string(json) != expectedJson {
+		t.Errorf("Expected %v but got %v %v", expectedJson, string(json), err)
+	}
+
+	p = NewLiveActivityPayload("", LIVE_ACTIVITY_EVENT_END, 1700000900, nil)
+	p.LiveActivity.DismissalDate = 1700001000
+
+	json, err = p.Marshal(256)
+	expectedJson = "{\"aps\":{\"dismissal-date\":1700001000,\"event\":\"end\",\"timestamp\":1700000900}}"
+	if err != nil || string(json) != expectedJson {
+		t.Errorf("Expected %v but got %v %v", expectedJson, string(json), err)
+	}
+}
+
+func TestLiveActivityShouldShareSizeBudget(t *testing.T) {
+	p := NewLiveActivityPayload("", LIVE_ACTIVITY_EVENT_UPDATE, 1700000000, testScore{Home: 2, Away: 1})
+	p.AlertText = "Away score, Home 2 - 1 Away"
+
+	expectedJson := "{\"aps\":{\"alert\":\"Away...\",\"content-state\":{\"home\":2,\"away\":1}," +
+		"\"event\":\"update\",\"timestamp\":1700000000}}"
+	json, err := p.Marshal(len(expectedJson))
+	if err != nil || string(json) != expectedJson {
+		t.Errorf("Expected %v but got %v %v", expectedJson, string(json), err)
+	}
+
+	//content state is never truncated
+	_, err = p.Marshal(len(expectedJson) - 10)
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Expected ErrPayloadTooLarge but got %v", err)
+	}
+}
+
+func TestLiveActivityValidation(t *testing.T) {
+	cases := []struct {
+		activity LiveActivity
+		expected error
+	}{
+		{LiveActivity{Event: "pause", Timestamp: 1, ContentState: 1}, ErrInvalidLiveActivityEvent},
+		{LiveActivity{Timestamp: 1, ContentState: 1}, ErrInvalidLiveActivityEvent},
+		{LiveActivity{Event: LIVE_ACTIVITY_EVENT_UPDATE, ContentState: 1}, ErrMissingLiveActivityTimestamp},
+		{LiveActivity{Event: LIVE_ACTIVITY_EVENT_UPDATE, Timestamp: -1, ContentState: 1}, ErrMissingLiveActivityTimestamp},
+		{LiveActivity{Event: LIVE_ACTIVITY_EVENT_UPDATE, Timestamp: 1}, ErrMissingContentState},
+		{LiveActivity{Event: LIVE_ACTIVITY_EVENT_START, Timestamp: 1, AttributesType: "A", Attributes: 1}, ErrMissingContentState},
+		{LiveActivity{Event: LIVE_ACTIVITY_EVENT_START, Timestamp: 1, ContentState: 1}, ErrInvalidLiveActivityAttributes},
+		{LiveActivity{Event: LIVE_ACTIVITY_EVENT_START, Timestamp: 1, ContentState: 1, AttributesType: "A"}, ErrInvalidLiveActivityAttributes},
+		{LiveActivity{Event: LIVE_ACTIVITY_EVENT_UPDATE, Timestamp: 1, ContentState: 1, Attributes: 1}, ErrInvalidLiveActivityAttributes},
+		{LiveActivity{Event: LIVE_ACTIVITY_EVENT_START, Timestamp: 1, ContentState: 1, AttributesType: "A", Attributes: 1}, nil},
+		{LiveActivity{Event: LIVE_ACTIVITY_EVENT_UPDATE, Timestamp: 1, ContentState: 1}, nil},
+		{LiveActivity{Event: LIVE_ACTIVITY_EVENT_END, Timestamp: 1}, nil},
+	}
+
+	for i, c := range cases {
+		p := Payload{LiveActivity: &c.activity}
+		_, err := p.Marshal(256)
+		if !errors.Is(err, c.expected) || (c.expected == nil && err != nil) {
+			t.Errorf("Case %v: expected %v but got %v", i, c.expected, err)
+		}
+	}
+}
+
+func TestLiveActivityShouldNotAllocate(t *testing.T) {
+	if raceEnabled {
+		t.Skip("race detector allocates")
+	}
+
+	p := NewLiveActivityPayload("", LIVE_ACTIVITY_EVENT_END, 1700000000, nil)
+	p.LiveActivity.DismissalDate = 1700000600
+	dst := make([]byte, 0, 256)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		p.appendJSON(dst, 256, nil)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations but got %v", allocs)
+	}
+}
+
+func TestHTTP2ClientShouldSendLiveActivity(t *testing.T) {
+	var request *http.Request
+	var body []byte
+	client, server := newTestTokenHTTP2Client(t, func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = ioutil.ReadAll(r.Body)
+	})
+	defer server.Close()
+	defer client.Close()
+
+	p := NewLiveActivityPayload(testToken(1), LIVE_ACTIVITY_EVENT_UPDATE, 1700000000, testScore{Home: 1})
+	p.Priority = 10
+	response := client.Push(p)
+
+	if !response.Accepted() {
+		t.Fatalf("Expected payload to be accepted but received %+v", response)
+	}
+	if request.Header.Get("apns-push-type") != "liveactivity" {
+		t.Errorf("Expected liveactivity push type but was %v", request.Header.Get("apns-push-type"))
+	}
+	if request.Header.Get("apns-topic") != "com.example.test.push-type.liveactivity" {
+		t.Errorf("Expected live activity topic but was %v", request.Header.Get("apns-topic"))
+	}
+	expectedJson := "{\"aps\":{\"content-state\":{\"home\":1,\"away\":0},\"event\":\"update\",\"timestamp\":1700000000}}"
+	if string(body) != expectedJson {
+		t.Errorf("Expected %v but got %v", expectedJson, string(body))
+	}
+
+	p = NewLiveActivityPayload(testToken(1), LIVE_ACTIVITY_EVENT_UPDATE, 1700000001, testScore{Home: 2})
+	p.Topic = "com.example.other.push-type.liveactivity"
+	client.Push(p)
+	if request.Header.Get("apns-topic") != "com.example.other.push-type.liveactivity" {
+		t.Errorf("Expected topic suffix not to be repeated but was %v", request.Header.Get("apns-topic"))
+	}
+}
+
+func TestHTTP2ClientShouldRejectLiveActivityOutOfOrder(t *testing.T) {
+	requests := 0
+	client, server := newTestTokenHTTP2Client(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	})
+	defer server.Close()
+	defer client.Close()
+
+	push := func(event LiveActivityEvent, timestamp int64) *HTTP2Response {
+		return client.Push(NewLiveActivityPayload(testToken(1), event, timestamp, testScore{}))
+	}
+
+	if response := push(LIVE_ACTIVITY_EVENT_UPDATE, 1700000010); !response.Accepted() {
+		t.Fatalf("Expected payload to be accepted but received %+v", response)
+	}
+	for _, timestamp := range []int64{1700000010, 1700000005} {
+		response := push(LIVE_ACTIVITY_EVENT_UPDATE, timestamp)
+		var invalid *InvalidPayloadError
+		if !errors.As(response.Error, &invalid) || !errors.Is(response.Error, ErrLiveActivityOutOfOrder) {
+			t.Errorf("Expected ErrLiveActivityOutOfOrder for %v but got %v", timestamp, response.Error)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected out of order updates not to be sent but %v requests were made", requests)
+	}
+
+	//other activities are tracked separately
+	otherToken := testToken(2)
+	response := client.Push(NewLiveActivityPayload(otherToken, LIVE_ACTIVITY_EVENT_UPDATE, 1700000001, testScore{}))
+	if !response.Accepted() {
+		t.Errorf("Expected other activity to be accepted but received %+v", response)
+	}
+
+	//ending the activity forgets it
+	if response := push(LIVE_ACTIVITY_EVENT_END, 1700000020); !response.Accepted() {
+		t.Fatalf("Expected end to be accepted but received %+v", response)
+	}
+	if len(client.liveActivities.activities) != 1 {
+		t.Errorf("Expected ended activity to be forgotten but have %v", len(client.liveActivities.activities))
+	}
+}
+
+func TestHTTP2ClientShouldReleaseRejectedLiveActivityTimestamps(t *testing.T) {
+	reject := true
+	client, server := newTestTokenHTTP2Client(t, func(w http.ResponseWriter, r *http.Request) {
+		if reject {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+		}
+	})
+	defer server.Close()
+	defer client.Close()
+
+	p := NewLiveActivityPayload(testToken(1), LIVE_ACTIVITY_EVENT_UPDATE, 1700000010, testScore{})
+	if response := client.Push(p); response.Accepted() {
+		t.Fatalf("Expected payload to be rejected but received %+v", response)
+	}
+
+	//apple never applied the rejected update, so it can be retried
+	reject = false
+	if response := client.Push(p); !response.Accepted() {
+		t.Errorf("Expected retried payload to be accepted but received %+v", response)
+	}
+}
+
+func TestHTTP2ClientShouldCheckConcurrentLiveActivityPushesInOrder(t *testing.T) {
+	received := make(chan bool)
+	respond := make(chan bool)
+	client, server := newTestTokenHTTP2Client(t, func(w http.ResponseWriter, r *http.Request) {
+		received <- true
+		<-respond
+	})
+	defer server.Close()
+	defer client.Close()
+
+	first := make(chan *HTTP2Response)
+	go func() {
+		first <- client.Push(NewLiveActivityPayload(testToken(1), LIVE_ACTIVITY_EVENT_UPDATE, 1700000010, testScore{}))
+	}()
+	<-received
+
+	//the first push hasn't been answered yet but its timestamp is already taken
+	response := client.Push(NewLiveActivityPayload(testToken(1), LIVE_ACTIVITY_EVENT_UPDATE, 1700000010, testScore{}))
+	if !errors.Is(response.Error, ErrLiveActivityOutOfOrder) {
+		t.Errorf("Expected ErrLiveActivityOutOfOrder but got %+v", response)
+	}
+
+	close(respond)
+	if response := <-first; !response.Accepted() {
+		t.Errorf("Expected first push to be accepted but received %+v", response)
+	}
+}
+
+func TestHTTP2ClientShouldForgetOldLiveActivities(t *testing.T) {
+	client, server := newTestTokenHTTP2Client(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+	defer client.Close()
+
+	now := time.Now()
+	client.liveActivities.now = func() time.Time {
+		return now
+	}
+
+	client.Push(NewLiveActivityPayload(testToken(1), LIVE_ACTIVITY_EVENT_UPDATE, 1700000010, testScore{}))
+	now = now.Add(LIVE_ACTIVITY_MAX_AGE_HOURS * time.Hour)
+	client.Push(NewLiveActivityPayload(testToken(2), LIVE_ACTIVITY_EVENT_UPDATE, 1700000010, testScore{}))
+
+	if len(client.liveActivities.activities) != 1 || client.liveActivities.activities[testToken(1)] != nil {
+		t.Errorf("Expected the old activity to be forgotten but have %v activities", len(client.liveActivities.activities))
+	}
+}
+
+func TestHTTP2ClientShouldRejectLiveActivityWithCertificateAuth(t *testing.T) {
+	requests := 0
+	client, server := newTestHTTP2Client(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	})
+	defer server.Close()
+	defer client.Close()
+
+	response := client.Push(NewLiveActivityPayload(testToken(1), LIVE_ACTIVITY_EVENT_UPDATE, 1700000000, testScore{}))
+	var invalid *InvalidPayloadError
+	if !errors.As(response.Error, &invalid) || !errors.Is(response.Error, ErrLiveActivityUnsupported) {
+		t.Errorf("Expected ErrLiveActivityUnsupported but got %+v", response)
+	}
+	if requests != 0 {
+		t.Errorf("Expected live activity not to be sent but %v requests were made", requests)
+	}
+}
+
+func TestConnectionShouldDropLiveActivity(t *testing.T) {
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	config := testAPNSConfig()
+	dropped := make(chan *InvalidPayloadError, 1)
+	config.InvalidPayloadCallback = func(err *InvalidPayloadError) {
+		dropped <- err
+	}
+	apn := socketAPNSConnection(socket, config)
+	defer apn.Disconnect()
+
+	apn.SendChannel <- NewLiveActivityPayload(testToken(1), LIVE_ACTIVITY_EVENT_UPDATE, 1700000000, testScore{})
+	select {
+	case err := <-dropped:
+		if !errors.Is(err, ErrLiveActivityUnsupported) {
+			t.Errorf("Expected ErrLiveActivityUnsupported but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for live activity to be dropped")
+	}
+
+	err := apn.Broadcast(context.Background(), NewLiveActivityPayload("", LIVE_ACTIVITY_EVENT_UPDATE, 1700000000, testScore{}),
+		NewSliceTokenIterator(testTokens(1, 2)))
+	if !errors.Is(err, ErrLiveActivityUnsupported) {
+		t.Errorf("Expected broadcast to fail with ErrLiveActivityUnsupported but got %v", err)
+	}
+
+	tp := newTestPool(t, 1, POOL_ROUND_ROBIN, "")
+	defer tp.Pool.Disconnect()
+	err = tp.Pool.Broadcast(context.Background(), NewLiveActivityPayload("", LIVE_ACTIVITY_EVENT_UPDATE, 1700000000, testScore{}),
+		NewSliceTokenIterator(testTokens(1, 2)))
+	if !errors.Is(err, ErrLiveActivityUnsupported) {
+		t.Errorf("Expected pool broadcast to fail with ErrLiveActivityUnsupported but got %v", err)
+	}
+}
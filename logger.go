@@ -0,0 +1,66 @@
+package apns
+
+import (
+	"context"
+	"log/slog"
+)
+
+//Severity of a log event, values line up with log/slog levels
+type LogLevel int
+
+const (
+	LOG_DEBUG LogLevel = -4
+	LOG_INFO  LogLevel = 0
+	LOG_WARN  LogLevel = 4
+	LOG_ERROR LogLevel = 8
+)
+
+//Receives structured log events from connections and the feedback service
+//keyValues alternates between string keys and their values
+type Logger interface {
+	Log(level LogLevel, msg string, keyValues ...interface{})
+}
+
+//Logger that discards every event
+type nopLogger struct{}
+
+func (l nopLogger) Log(level LogLevel, msg string, keyValues ...interface{}) {}
+
+//Logger that drops events below a minimum level
+type levelLogger struct {
+	logger   Logger
+	minLevel LogLevel
+}
+
+func (l levelLogger) Log(level LogLevel, msg string, keyValues ...interface{}) {
+	if level < l.minLevel {
+		return
+	}
+	l.logger.Log(level, msg, keyValues...)
+}
+
+//Wrap logger so only events at minLevel or above are logged
+//Returns a logger that discards everything if logger is nil
+func newLevelLogger(logger Logger, minLevel LogLevel) Logger {
+	if logger == nil {
+		return nopLogger{}
+	}
+	return levelLogger{
+		logger:   logger,
+		minLevel: minLevel,
+	}
+}
+
+//Logger adapter for log/slog
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+//Create a Logger that writes events to a *slog.Logger
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return slogLogger{logger: logger}
+}
+
+func (l slogLogger) Log(level LogLevel, msg string, keyValues ...interface{}) {
+	l.logger.Log(context.Background(), slog.Level(level), msg, keyValues...)
+}
@@ -0,0 +1,144 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Logger that records every event it receives
+type recordingLogger struct {
+	lock   *sync.Mutex
+	events []loggedEvent
+}
+
+type loggedEvent struct {
+	Level     LogLevel
+	Msg       string
+	KeyValues []interface{}
+}
+
+func newRecordingLogger() *recordingLogger {
+	return &recordingLogger{lock: new(sync.Mutex)}
+}
+
+func (l *recordingLogger) Log(level LogLevel, msg string, keyValues ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events = append(l.events, loggedEvent{level, msg, keyValues})
+}
+
+//Wait for an event with msg to be logged
+func (l *recordingLogger) waitForEvent(t *testing.T, msg string) loggedEvent {
+	timeout := time.Now().Add(5 * time.Second)
+	for {
+		l.lock.Lock()
+		for _, event := range l.events {
+			if event.Msg == msg {
+				l.lock.Unlock()
+				return event
+			}
+		}
+		l.lock.Unlock()
+
+		if time.Now().After(timeout) {
+			t.Fatalf("Timed out waiting for log event %q", msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//Value logged for key, nil if key wasn't logged
+func (e loggedEvent) value(key string) interface{} {
+	for i := 0; i+1 < len(e.KeyValues); i += 2 {
+		if e.KeyValues[i] == key {
+			return e.KeyValues[i+1]
+		}
+	}
+	return nil
+}
+
+func TestLevelLoggerShouldFilterEvents(t *testing.T) {
+	recorder := newRecordingLogger()
+	logger := newLevelLogger(recorder, LOG_WARN)
+
+	logger.Log(LOG_DEBUG, "debug")
+	logger.Log(LOG_INFO, "info")
+	logger.Log(LOG_WARN, "warn")
+	logger.Log(LOG_ERROR, "error")
+
+	if len(recorder.events) != 2 || recorder.events[0].Msg != "warn" || recorder.events[1].Msg != "error" {
+		t.Errorf("Expected only warn and error events but got %v", recorder.events)
+	}
+}
+
+func TestLevelLoggerShouldDiscardWithoutLogger(t *testing.T) {
+	logger := newLevelLogger(nil, LOG_DEBUG)
+	if _, ok := logger.(nopLogger); !ok {
+		t.Errorf("Expected nopLogger but got %T", logger)
+	}
+	logger.Log(LOG_ERROR, "error")
+}
+
+func TestSlogLoggerShouldWriteStructuredEvents(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(buffer, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	logger.Log(LOG_WARN, "Apple error response", "code", 8, "id", uint32(2))
+
+	event := map[string]interface{}{}
+	if err := json.Unmarshal(buffer.Bytes(), &event); err != nil {
+		t.Fatalf("Expected JSON log line but got %q : %v", buffer.String(), err)
+	}
+	if event["level"] != "WARN" || event["msg"] != "Apple error response" ||
+		event["code"] != float64(8) || event["id"] != float64(2) {
+		t.Errorf("Unexpected log event %v", event)
+	}
+}
+
+func TestConnectionShouldLogFlushAndAppleError(t *testing.T) {
+	recorder := newRecordingLogger()
+	socket := newMockConnRejectToken(testToken(2), make(chan writtenNotification, 100))
+	config := testAPNSConfig()
+	config.Logger = recorder
+	config.LogLevel = LOG_DEBUG
+	apn := socketAPNSConnection(socket, config)
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+	<-socket.Notifications
+
+	flush := recorder.waitForEvent(t, "Flushed frame to socket")
+	if flush.Level != LOG_DEBUG || flush.value("count") != 1 || flush.value("bytes") == nil {
+		t.Errorf("Unexpected flush event %v", flush)
+	}
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(2)}
+	<-apn.CloseChannel
+
+	appleError := recorder.waitForEvent(t, "Apple error response")
+	if appleError.Level != LOG_WARN || appleError.value("code") != uint8(8) || appleError.value("id") != uint32(2) {
+		t.Errorf("Unexpected Apple error event %v", appleError)
+	}
+}
+
+func TestConnectionShouldLogWriteError(t *testing.T) {
+	recorder := newRecordingLogger()
+	socket := MockConnErrorOnWrite{
+		WrittenBytes: new(bytes.Buffer),
+		CloseChannel: make(chan bool),
+	}
+	config := testAPNSConfig()
+	config.Logger = recorder
+	apn := socketAPNSConnection(socket, config)
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+	<-apn.CloseChannel
+
+	writeError := recorder.waitForEvent(t, "Error while writing to socket")
+	if writeError.Level != LOG_ERROR || writeError.value("error") == nil {
+		t.Errorf("Unexpected write error event %v", writeError)
+	}
+}
@@ -0,0 +1,227 @@
+package apns
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Receives measurements from an APNSConnection
+//Methods are called from the connection's go-routines so they should not block
+type Metrics interface {
+	//A payload was framed into the outbound TCP frame buffer
+	PayloadBuffered()
+	//A payload was marshalled, truncated is true if it had to be truncated to fit
+	PayloadMarshalled(truncated bool)
+	//A payload was dropped because it couldn't be framed
+	PayloadDropped()
+	//A TCP frame holding payloads was written to the socket in latency
+	FrameFlushed(bytes int, payloads int, latency time.Duration)
+	//Number of payloads held in the in flight payload buffer for replay changed by delta
+	//A connection's changes add up to 0 once it's closed, so the sum over
+	//every connection sharing the Metrics is their total depth
+	InFlightBufferDepthChanged(delta int)
+	//Apple closed the connection with an error response code (see APPLE_PUSH_RESPONSES)
+	AppleErrorResponse(code uint8)
+}
+
+//Metrics that discards every measurement
+type nopMetrics struct{}
+
+func (m nopMetrics) PayloadBuffered()                                            {}
+func (m nopMetrics) PayloadMarshalled(truncated bool)                            {}
+func (m nopMetrics) PayloadDropped()                                             {}
+func (m nopMetrics) FrameFlushed(bytes int, payloads int, latency time.Duration) {}
+func (m nopMetrics) InFlightBufferDepthChanged(delta int)                        {}
+func (m nopMetrics) AppleErrorResponse(code uint8)                               {}
+
+var (
+	//Upper bounds of the frame size histogram buckets in bytes
+	PROMETHEUS_FRAME_BYTES_BUCKETS = []float64{256, 1024, 4096, 16384, 32768, TCP_FRAME_MAX}
+	//Upper bounds of the flush latency histogram buckets in seconds
+	PROMETHEUS_FLUSH_SECONDS_BUCKETS = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+)
+
+//Metrics that collects measurements and serves them in the Prometheus text
+//exposition format as an http.Handler, to be scraped as its own target
+//It isn't a prometheus.Collector, use apnsprometheus.Collector to register
+//the same metrics with client_golang
+//One PrometheusTextMetrics can be shared by many connections
+type PrometheusTextMetrics struct {
+	//prefix for every metric name
+	namespace string
+	//Mutex to sync access to the collected values
+	lock               *sync.Mutex
+	payloadsBuffered   uint64
+	payloadsMarshalled uint64
+	payloadsTruncated  uint64
+	payloadsDropped    uint64
+	payloadsFlushed    uint64
+	frameBytes         *histogram
+	flushSeconds       *histogram
+	inFlightDepth      int
+	appleErrors        map[uint8]uint64
+}
+
+//Cumulative histogram in the shape Prometheus expects
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+//Create a PrometheusTextMetrics with every metric name prefixed by namespace,
+//defaults to "apns"
+func NewPrometheusTextMetrics(namespace string) *PrometheusTextMetrics {
+	if namespace == "" {
+		namespace = "apns"
+	}
+	return &PrometheusTextMetrics{
+		namespace:    namespace,
+		lock:         new(sync.Mutex),
+		frameBytes:   newHistogram(PROMETHEUS_FRAME_BYTES_BUCKETS),
+		flushSeconds: newHistogram(PROMETHEUS_FLUSH_SECONDS_BUCKETS),
+		appleErrors:  make(map[uint8]uint64),
+	}
+}
+
+func (m *PrometheusTextMetrics) PayloadBuffered() {
+	m.lock.Lock()
+	m.payloadsBuffered++
+	m.lock.Unlock()
+}
+
+func (m *PrometheusTextMetrics) PayloadMarshalled(truncated bool) {
+	m.lock.Lock()
+	m.payloadsMarshalled++
+	if truncated {
+		m.payloadsTruncated++
+	}
+	m.lock.Unlock()
+}
+
+func (m *PrometheusTextMetrics) PayloadDropped() {
+	m.lock.Lock()
+	m.payloadsDropped++
+	m.lock.Unlock()
+}
+
+func (m *PrometheusTextMetrics) FrameFlushed(bytes int, payloads int, latency time.Duration) {
+	m.lock.Lock()
+	m.payloadsFlushed += uint64(payloads)
+	m.frameBytes.observe(float64(bytes))
+	m.flushSeconds.observe(latency.Seconds())
+	m.lock.Unlock()
+}
+
+func (m *PrometheusTextMetrics) InFlightBufferDepthChanged(delta int) {
+	m.lock.Lock()
+	m.inFlightDepth += delta
+	m.lock.Unlock()
+}
+
+func (m *PrometheusTextMetrics) AppleErrorResponse(code uint8) {
+	m.lock.Lock()
+	m.appleErrors[code]++
+	m.lock.Unlock()
+}
+
+//Serve the collected metrics in the Prometheus text exposition format
+func (m *PrometheusTextMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+//Write the collected metrics to w in the Prometheus text exposition format
+func (m *PrometheusTextMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e := &expositionWriter{w: w, namespace: m.namespace}
+	e.counter("payloads_buffered_total", "Payloads framed into the outbound TCP frame buffer.", m.payloadsBuffered)
+	e.counter("payloads_marshalled_total", "Payloads marshalled to JSON.", m.payloadsMarshalled)
+	e.counter("payloads_truncated_total", "Payloads that were truncated to fit the max payload size.", m.payloadsTruncated)
+	e.counter("payloads_dropped_total", "Payloads dropped because they couldn't be framed.", m.payloadsDropped)
+	e.counter("payloads_flushed_total", "Payloads written to the socket.", m.payloadsFlushed)
+	e.histogram("frame_bytes", "Size of TCP frames written to the socket in bytes.", m.frameBytes)
+	e.histogram("flush_duration_seconds", "Time taken to write a TCP frame to the socket.", m.flushSeconds)
+	e.gauge("in_flight_buffer_depth", "Payloads held in the in flight payload buffers of every connection for replay.", m.inFlightDepth)
+
+	codes := make([]int, 0, len(m.appleErrors))
+	for code := range m.appleErrors {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	e.header("apple_error_responses_total", "Error responses received from Apple by code.", "counter")
+	for _, code := range codes {
+		e.printf("%v_apple_error_responses_total{code=\"%v\",reason=\"%v\"} %v\n",
+			m.namespace, code, APPLE_PUSH_RESPONSES[uint8(code)], m.appleErrors[uint8(code)])
+	}
+
+	return e.written, e.err
+}
+
+//Helper for writing metrics, remembers the first write error
+type expositionWriter struct {
+	w         io.Writer
+	namespace string
+	written   int64
+	err       error
+}
+
+func (e *expositionWriter) printf(format string, args ...interface{}) {
+	if e.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(e.w, format, args...)
+	e.written += int64(n)
+	e.err = err
+}
+
+func (e *expositionWriter) header(name, help, metricType string) {
+	e.printf("# HELP %v_%v %v\n", e.namespace, name, help)
+	e.printf("# TYPE %v_%v %v\n", e.namespace, name, metricType)
+}
+
+func (e *expositionWriter) counter(name, help string, value uint64) {
+	e.header(name, help, "counter")
+	e.printf("%v_%v %v\n", e.namespace, name, value)
+}
+
+func (e *expositionWriter) gauge(name, help string, value int) {
+	e.header(name, help, "gauge")
+	e.printf("%v_%v %v\n", e.namespace, name, value)
+}
+
+func (e *expositionWriter) histogram(name, help string, h *histogram) {
+	e.header(name, help, "histogram")
+	for i, bucket := range h.buckets {
+		e.printf("%v_%v_bucket{le=\"%v\"} %v\n", e.namespace, name,
+			strconv.FormatFloat(bucket, 'g', -1, 64), h.counts[i])
+	}
+	e.printf("%v_%v_bucket{le=\"+Inf\"} %v\n", e.namespace, name, h.count)
+	e.printf("%v_%v_sum %v\n", e.namespace, name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	e.printf("%v_%v_count %v\n", e.namespace, name, h.count)
+}
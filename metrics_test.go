@@ -0,0 +1,151 @@
+package apns
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionShouldRecordMetrics(t *testing.T) {
+	metrics := NewPrometheusTextMetrics("")
+	socket := newMockConnRejectToken(testToken(3), make(chan writtenNotification, 100))
+	config := testAPNSConfig()
+	config.MaxPayloadSize = 128
+	config.Metrics = metrics
+	apn := socketAPNSConnection(socket, config)
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+	apn.SendChannel <- &Payload{AlertText: strings.Repeat("Testing ", 20), Token: testToken(2)}
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: "4ec500"}
+	<-socket.Notifications
+	<-socket.Notifications
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(3)}
+	<-apn.CloseChannel
+
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+
+	if metrics.payloadsMarshalled != 3 || metrics.payloadsTruncated != 1 {
+		t.Errorf("Expected 3 marshalled and 1 truncated but got %v and %v",
+			metrics.payloadsMarshalled, metrics.payloadsTruncated)
+	}
+	if metrics.payloadsBuffered != 3 || metrics.payloadsDropped != 1 {
+		t.Errorf("Expected 3 buffered and 1 dropped but got %v and %v",
+			metrics.payloadsBuffered, metrics.payloadsDropped)
+	}
+	if metrics.payloadsFlushed != 3 || metrics.frameBytes.count == 0 || metrics.frameBytes.count != metrics.flushSeconds.count {
+		t.Errorf("Expected 3 payloads flushed across frames but got %v in %v frames",
+			metrics.payloadsFlushed, metrics.frameBytes.count)
+	}
+	if len(metrics.appleErrors) != 1 || metrics.appleErrors[8] != 1 {
+		t.Errorf("Expected one error 8 response but got %v", metrics.appleErrors)
+	}
+}
+
+func TestConnectionsShouldAddUpInFlightBufferDepth(t *testing.T) {
+	metrics := NewPrometheusTextMetrics("")
+	depth := func() int {
+		metrics.lock.Lock()
+		defer metrics.lock.Unlock()
+		return metrics.inFlightDepth
+	}
+	waitForDepth := func(expected int) {
+		timeout := time.Now().Add(5 * time.Second)
+		for depth() != expected {
+			if time.Now().After(timeout) {
+				t.Fatalf("Expected in flight depth of %v but got %v", expected, depth())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	conns := []*APNSConnection{}
+	for _, bufferSize := range []int{1, 10} {
+		socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+		config := testAPNSConfig()
+		config.InFlightPayloadBufferSize = bufferSize
+		config.Metrics = metrics
+		apn := socketAPNSConnection(socket, config)
+		conns = append(conns, apn)
+
+		for i := 0; i < 2; i++ {
+			apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(i)}
+			<-socket.Notifications
+		}
+	}
+
+	//the first connection's buffer only holds 1 payload
+	waitForDepth(3)
+	conns[1].Disconnect()
+	waitForDepth(1)
+	conns[0].Disconnect()
+	waitForDepth(0)
+}
+
+func TestConnectionShouldNotCountDisconnectAsAppleError(t *testing.T) {
+	metrics := NewPrometheusTextMetrics("")
+	socket := newMockConnRejectToken("", make(chan writtenNotification, 100))
+	config := testAPNSConfig()
+	config.Metrics = metrics
+	apn := socketAPNSConnection(socket, config)
+
+	apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(1)}
+	<-socket.Notifications
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	if len(metrics.appleErrors) != 0 {
+		t.Errorf("Expected no Apple error responses but got %v", metrics.appleErrors)
+	}
+}
+
+func TestPrometheusTextMetricsShouldServeExpositionFormat(t *testing.T) {
+	metrics := NewPrometheusTextMetrics("push")
+	metrics.PayloadMarshalled(true)
+	metrics.PayloadBuffered()
+	metrics.FrameFlushed(2000, 3, 2*time.Millisecond)
+	metrics.InFlightBufferDepthChanged(40)
+	metrics.InFlightBufferDepthChanged(3)
+	metrics.InFlightBufferDepthChanged(-1)
+	metrics.AppleErrorResponse(8)
+	metrics.AppleErrorResponse(8)
+	metrics.AppleErrorResponse(1)
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	expected := []string{
+		"# TYPE push_payloads_buffered_total counter\npush_payloads_buffered_total 1\n",
+		"push_payloads_truncated_total 1\n",
+		"push_payloads_flushed_total 3\n",
+		"# TYPE push_frame_bytes histogram\n",
+		"push_frame_bytes_bucket{le=\"1024\"} 0\n",
+		"push_frame_bytes_bucket{le=\"4096\"} 1\n",
+		"push_frame_bytes_bucket{le=\"+Inf\"} 1\n",
+		"push_frame_bytes_sum 2000\n",
+		"push_flush_duration_seconds_bucket{le=\"0.005\"} 1\n",
+		"push_flush_duration_seconds_count 1\n",
+		"# TYPE push_in_flight_buffer_depth gauge\npush_in_flight_buffer_depth 42\n",
+		"push_apple_error_responses_total{code=\"1\",reason=\"PROCESSING_ERROR\"} 1\n" +
+			"push_apple_error_responses_total{code=\"8\",reason=\"INVALID_TOKEN\"} 2\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %q but got\n%v", line, body)
+		}
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %v", recorder.Header().Get("Content-Type"))
+	}
+
+	buffer := new(bytes.Buffer)
+	written, err := metrics.WriteTo(buffer)
+	if err != nil || written != int64(buffer.Len()) || buffer.String() != body {
+		t.Errorf("Expected WriteTo to match ServeHTTP but wrote %v bytes with %v", written, err)
+	}
+}
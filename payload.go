@@ -1,9 +1,23 @@
 package apns
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
+	"strconv"
+)
+
+//How urgently a notification is delivered and whether it breaks through Focus (iOS 15+)
+type InterruptionLevel string
+
+const (
+	//Added to the notification list without lighting the screen or playing a sound
+	INTERRUPTION_LEVEL_PASSIVE InterruptionLevel = "passive"
+	//Presented immediately, the default
+	INTERRUPTION_LEVEL_ACTIVE InterruptionLevel = "active"
+	//Presented immediately, can break through Focus
+	INTERRUPTION_LEVEL_TIME_SENSITIVE InterruptionLevel = "time-sensitive"
+	//Presented immediately, ignoring the mute switch and Focus
+	//Requires Apple's critical alerts entitlement
+	INTERRUPTION_LEVEL_CRITICAL InterruptionLevel = "critical"
 )
 
 //Object describing a push notification payload
@@ -11,10 +25,34 @@ type Payload struct {
 	// Basic alert structure
 	AlertText        string
 	Badge            BadgeNumber
-	Sound            string
+	Sound            Sound
 	ContentAvailable int
 	Category         string
 
+	// Set to 1 to let a notification service extension change the
+	// notification before it's shown (iOS 10+)
+	MutableContent int
+	// Groups notifications into threads (iOS 12+)
+	ThreadID string
+	// Window or content brought forward when the notification is opened (iOS 13+)
+	TargetContentID string
+	// Leave empty to use INTERRUPTION_LEVEL_ACTIVE (iOS 15+)
+	InterruptionLevel InterruptionLevel
+	// Between 0 and 1, picks the featured notification in a summary (iOS 15+)
+	RelevanceScore RelevanceScore
+	// Focus filter the notification belongs to (iOS 16+)
+	FilterCriteria string
+
+	// Set to send a silent background notification, see NewBackgroundPayload
+	// content-available is always sent and the priority is forced to 5
+	// The payload is refused if it has an alert, sound, badge or live activity
+	// or a priority of 10
+	Background bool
+
+	// Set to push a Live Activity instead of a regular notification,
+	// see NewLiveActivityPayload
+	LiveActivity *LiveActivity
+
 	// If this is an enhanced message, use
 	// an APSAlertBody instead of .Alert
 	AlertBody APSAlertBody
@@ -26,8 +64,13 @@ type Payload struct {
 	// Payload server fields
 	// UNIX time in seconds when the payload is invalid
 	ExpirationTime uint32
-	// Must be either 5 or 10, if not one of these two values will default to 5
+	// Must be either 5 or 10 (PRIORITY_CONSERVE_POWER or PRIORITY_IMMEDIATE),
+	// other values aren't sent and Apple treats the payload as 10
 	Priority uint8
+	// HTTP/2 only: apns-topic for this payload, defaults to APNSHTTP2Config.Topic
+	Topic string
+	// HTTP/2 only: apns-id (a UUID) for this payload, generated if empty
+	ApnsID string
 
 	// Device push token, should contain no spaces
 	Token string
@@ -51,185 +94,305 @@ type APSAlertBody struct {
 	Title        string   `json:"title,omitempty"`
 	TitleLocKey  string   `json:"title-loc-key,omitempty"`
 	TitleLocArgs []string `json:"title-loc-args,omitempty"`
+
+	// Subtitle fields and localizations. >= iOS 10
+	Subtitle        string   `json:"subtitle,omitempty"`
+	SubtitleLocKey  string   `json:"subtitle-loc-key,omitempty"`
+	SubtitleLocArgs []string `json:"subtitle-loc-args,omitempty"`
+
+	// Summary of grouped notifications. >= iOS 12
+	// "from <SummaryArg>" and the number of items it counts for, defaults to 1
+	SummaryArg      string `json:"summary-arg,omitempty"`
+	SummaryArgCount int    `json:"summary-arg-count,omitempty"`
 }
 
-type alertBodyAps struct {
-	Alert            APSAlertBody
-	Badge            BadgeNumber
-	Sound            string
-	Category         string
-	ContentAvailable int
+// Get a new silent background notification payload for token
+// The custom fields are delivered to the app without alerting the user
+func NewBackgroundPayload(token string, customFields map[string]interface{}) *Payload {
+	return &Payload{
+		Token:            token,
+		ContentAvailable: 1,
+		CustomFields:     customFields,
+		Priority:         PRIORITY_CONSERVE_POWER,
+		Background:       true,
+	}
 }
 
-type simpleAps struct {
-	Alert            string
-	Badge            BadgeNumber
-	Sound            string
-	Category         string
-	ContentAvailable int
+// Turn the payload into a silent background notification,
+// removing its alert, sound and badge and lowering its priority to 5
+func (p *Payload) SetBackground() {
+	p.AlertText = ""
+	p.AlertBody = APSAlertBody{}
+	p.Sound.UnSet()
+	p.Badge.UnSet()
+	p.ContentAvailable = 1
+	p.Priority = PRIORITY_CONSERVE_POWER
+	p.Background = true
 }
 
-// Convert a Payload into a json object and then converted to a byte array
-// If the number of converted bytes is greater than the maxPayloadSize
-// an attempt will be made to truncate the AlertText
-// If this cannot be done, then an error will be returned
-func (p *Payload) Marshal(maxPayloadSize int) ([]byte, error) {
-	if p.isSimple() {
-		return p.marshalSimplePayload(maxPayloadSize)
-	} else {
-		return p.marshalAlertBodyPayload(maxPayloadSize)
+//Check a background payload won't alert the user or be sent at high priority
+func (p *Payload) validateBackground() error {
+	if !p.Background {
+		return nil
+	}
+
+	var field string
+	switch {
+	case p.AlertText != "" || p.AlertBody.Body != "":
+		field = "an alert"
+	case p.Sound.IsSet():
+		field = "a sound"
+	case p.Badge.IsSet():
+		field = "a badge"
+	case p.LiveActivity != nil:
+		field = "a live activity"
+	case p.Priority == PRIORITY_IMMEDIATE:
+		field = "priority 10"
+	default:
+		return nil
 	}
+	return fmt.Errorf("%w. Has %v", ErrInvalidBackgroundPayload, field)
 }
 
-//Whether or not to use simple aps format or not
-func (p *Payload) isSimple() bool {
-	return p.AlertBody.Body == ""
+//Check the payload can be sent on the binary gateway, which doesn't support
+//Live Activities, and that a background payload won't alert the user
+func (p *Payload) validateBinary() error {
+	if p.LiveActivity != nil {
+		return ErrLiveActivityUnsupported
+	}
+	return p.validateBackground()
 }
 
-//Helper method to generate a json compatible map with aps key + custom fields
-//will return error if custom field named aps supplied
-func constructFullPayload(aps interface{}, customFields map[string]interface{}) (map[string]interface{}, error) {
-	var fullPayload = make(map[string]interface{})
-	fullPayload["aps"] = aps
-	for key, value := range customFields {
-		if key == "aps" {
-			return nil, errors.New("Cannot have a custom field named aps")
-		}
-		fullPayload[key] = value
+//Priority to send the payload with, 0 if it shouldn't be sent
+//Background payloads are always sent at PRIORITY_CONSERVE_POWER
+func (p *Payload) sendPriority() uint8 {
+	if p.Background {
+		return PRIORITY_CONSERVE_POWER
 	}
-	return fullPayload, nil
+	//only send priority if set correctly
+	if p.Priority == PRIORITY_IMMEDIATE || p.Priority == PRIORITY_CONSERVE_POWER {
+		return p.Priority
+	}
+	return 0
+}
+
+// Convert a Payload into a json object and then converted to a byte array
+// If the number of converted bytes is greater than the maxPayloadSize
+// an attempt will be made to truncate the AlertText
+// If this cannot be done, then an error will be returned
+func (p *Payload) Marshal(maxPayloadSize int) ([]byte, error) {
+	jsonStr, _, err := p.MarshalWithPolicy(maxPayloadSize, nil)
+	return jsonStr, err
 }
 
-//Handle simple payload case with just text alert
-//Handle truncating of alert text if too long for maxPayloadSize
-func (p *Payload) marshalSimplePayload(maxPayloadSize int) ([]byte, error) {
-	var jsonStr []byte
+// Marshal the payload, truncating it to maxPayloadSize according to policy
+// A nil policy uses DefaultTruncationPolicy
+// The TruncationResult says what was changed, nil if the payload fit as it is
+func (p *Payload) MarshalWithPolicy(maxPayloadSize int, policy *TruncationPolicy) ([]byte, *TruncationResult, error) {
+	return p.appendJSON(nil, maxPayloadSize, policy)
+}
 
-	//use simple payload
-	aps := simpleAps{
-		Alert:            p.AlertText,
-		Badge:            p.Badge,
-		Sound:            p.Sound,
-		Category:         p.Category,
-		ContentAvailable: p.ContentAvailable,
-	}
+//Marshal the payload appended to dst, also returning what had to be truncated (nil if nothing)
+//dst is returned unchanged on error
+//Doesn't allocate unless dst has to grow, there are custom fields or live activity content or it's truncated
+func (p *Payload) appendJSON(dst []byte, maxPayloadSize int, policy *TruncationPolicy) ([]byte, *TruncationResult, error) {
+	e := payloadEncoderPool.Get().(*payloadEncoder)
+	defer payloadEncoderPool.Put(e)
 
-	fullPayload, err := constructFullPayload(aps, p.CustomFields)
+	err := p.Sound.validate()
 	if err != nil {
-		return nil, err
+		return dst, nil, err
 	}
-
-	jsonStr, err = json.Marshal(fullPayload)
+	err = p.RelevanceScore.validate()
 	if err != nil {
-		return nil, err
+		return dst, nil, err
 	}
-
-	payloadLen := len(jsonStr)
-
-	if payloadLen > maxPayloadSize {
-		clipSize := payloadLen - (maxPayloadSize) + 3 //need extra characters for ellipse
-		if clipSize > len(p.AlertText) {
-			return nil, errors.New(fmt.Sprintf("Payload was too long to successfully marshall to less than %v", maxPayloadSize))
-		}
-		aps.Alert = aps.Alert[:len(aps.Alert)-clipSize] + "..."
-		fullPayload["aps"] = aps
+	if p.LiveActivity != nil {
+		err = p.LiveActivity.validate()
 		if err != nil {
-			return nil, err
+			return dst, nil, err
 		}
+	}
+	err = e.sortKeys(p)
+	if err != nil {
+		return dst, nil, err
+	}
 
-		jsonStr, err = json.Marshal(fullPayload)
-		if err != nil {
-			return nil, err
-		}
+	jsonStr, err := e.appendPayload(dst, p)
+	if err != nil {
+		return dst, nil, err
 	}
 
-	return jsonStr, nil
+	if len(jsonStr)-len(dst) > maxPayloadSize {
+		return e.appendTruncated(dst, jsonStr, p, maxPayloadSize, policy)
+	}
+
+	return jsonStr, nil, nil
 }
 
-//Handle complet payload case with alert object
-//Handle truncating of alert text if too long for maxPayloadSize
-func (p *Payload) marshalAlertBodyPayload(maxPayloadSize int) ([]byte, error) {
-	var jsonStr []byte
+//Whether or not to use simple aps format or not
+func (p *Payload) isSimple() bool {
+	return p.AlertBody.Body == ""
+}
 
-	// Use APSAlertBody payload
-	aps := alertBodyAps{
-		Alert:            p.AlertBody,
-		Badge:            p.Badge,
-		Sound:            p.Sound,
-		Category:         p.Category,
-		ContentAvailable: p.ContentAvailable,
-	}
+//Marshalled in place of a nil Payload.LiveActivity, has none of its keys set
+var noLiveActivity LiveActivity
 
-	fullPayload, err := constructFullPayload(aps, p.CustomFields)
-	if err != nil {
-		return nil, err
-	}
+//Append the aps dictionary, keys in sorted order
+//Live Activity content is encoded with e
+func (p *Payload) appendAps(dst []byte, e *payloadEncoder) ([]byte, error) {
+	var err error
+	dst = append(dst, '{')
 
-	jsonStr, err = json.Marshal(fullPayload)
-	if err != nil {
-		return nil, err
+	activity := p.LiveActivity
+	if activity == nil {
+		activity = &noLiveActivity
 	}
 
-	payloadLen := len(jsonStr)
-
-	if payloadLen > maxPayloadSize {
-		clipSize := payloadLen - (maxPayloadSize) + 3 //need extra characters for ellipse
-		if clipSize > len(p.AlertBody.Body) {
-			return nil, errors.New(fmt.Sprintf("Payload was too long to successfully marshall %v or less bytes", maxPayloadSize))
-		}
-		aps.Alert.Body = aps.Alert.Body[:len(aps.Alert.Body)-clipSize] + "..."
-		fullPayload["aps"] = aps
+	if !p.isSimple() {
+		dst = appendJSONKey(dst, "alert")
+		dst = p.AlertBody.appendJSON(dst)
+	} else if p.AlertText != "" {
+		dst = appendJSONKey(dst, "alert")
+		dst = appendJSONString(dst, p.AlertText)
+	}
+	if activity.Attributes != nil {
+		dst = appendJSONKey(dst, "attributes")
+		dst, err = e.appendValue(dst, activity.Attributes)
 		if err != nil {
-			return nil, err
+			return dst, err
 		}
-
-		jsonStr, err = json.Marshal(fullPayload)
+	}
+	if activity.AttributesType != "" {
+		dst = appendJSONKey(dst, "attributes-type")
+		dst = appendJSONString(dst, activity.AttributesType)
+	}
+	if p.Badge.IsSet() {
+		dst = appendJSONKey(dst, "badge")
+		dst = strconv.AppendInt(dst, int64(p.Badge.Number()), 10)
+	}
+	if p.Category != "" {
+		dst = appendJSONKey(dst, "category")
+		dst = appendJSONString(dst, p.Category)
+	}
+	if p.Background {
+		dst = appendJSONKey(dst, "content-available")
+		dst = append(dst, '1')
+	} else if p.ContentAvailable != 0 {
+		dst = appendJSONKey(dst, "content-available")
+		dst = strconv.AppendInt(dst, int64(p.ContentAvailable), 10)
+	}
+	if activity.ContentState != nil {
+		dst = appendJSONKey(dst, "content-state")
+		dst, err = e.appendValue(dst, activity.ContentState)
 		if err != nil {
-			return nil, err
+			return dst, err
 		}
 	}
-
-	return jsonStr, nil
-}
-
-func (s simpleAps) MarshalJSON() ([]byte, error) {
-	toMarshal := make(map[string]interface{})
-
-	if s.Alert != "" {
-		toMarshal["alert"] = s.Alert
+	if activity.DismissalDate != 0 {
+		dst = appendJSONKey(dst, "dismissal-date")
+		dst = strconv.AppendInt(dst, activity.DismissalDate, 10)
+	}
+	if activity.Event != "" {
+		dst = appendJSONKey(dst, "event")
+		dst = appendJSONString(dst, string(activity.Event))
+	}
+	if p.FilterCriteria != "" {
+		dst = appendJSONKey(dst, "filter-criteria")
+		dst = appendJSONString(dst, p.FilterCriteria)
+	}
+	if p.InterruptionLevel != "" {
+		dst = appendJSONKey(dst, "interruption-level")
+		dst = appendJSONString(dst, string(p.InterruptionLevel))
+	}
+	if p.MutableContent != 0 {
+		dst = appendJSONKey(dst, "mutable-content")
+		dst = strconv.AppendInt(dst, int64(p.MutableContent), 10)
+	}
+	if p.RelevanceScore.IsSet() {
+		dst = appendJSONKey(dst, "relevance-score")
+		dst = appendJSONFloat(dst, p.RelevanceScore.Score())
 	}
-	if s.Badge.IsSet() {
-		toMarshal["badge"] = s.Badge
+	if p.Sound.IsSet() {
+		dst = appendJSONKey(dst, "sound")
+		dst = p.Sound.appendJSON(dst)
 	}
-	if s.Sound != "" {
-		toMarshal["sound"] = s.Sound
+	if activity.StaleDate != 0 {
+		dst = appendJSONKey(dst, "stale-date")
+		dst = strconv.AppendInt(dst, activity.StaleDate, 10)
 	}
-	if s.Category != "" {
-		toMarshal["category"] = s.Category
+	if p.TargetContentID != "" {
+		dst = appendJSONKey(dst, "target-content-id")
+		dst = appendJSONString(dst, p.TargetContentID)
 	}
-	if s.ContentAvailable != 0 {
-		toMarshal["content-available"] = s.ContentAvailable
+	if p.ThreadID != "" {
+		dst = appendJSONKey(dst, "thread-id")
+		dst = appendJSONString(dst, p.ThreadID)
+	}
+	if activity.Timestamp != 0 {
+		dst = appendJSONKey(dst, "timestamp")
+		dst = strconv.AppendInt(dst, activity.Timestamp, 10)
 	}
 
-	return json.Marshal(toMarshal)
+	return append(dst, '}'), nil
 }
 
-func (a alertBodyAps) MarshalJSON() ([]byte, error) {
-	toMarshal := make(map[string]interface{})
-	toMarshal["alert"] = a.Alert
+//Append the alert dictionary in field order, leaving out empty fields
+func (a *APSAlertBody) appendJSON(dst []byte) []byte {
+	dst = append(dst, '{')
 
-	if a.Badge.IsSet() {
-		toMarshal["badge"] = a.Badge
+	if a.Body != "" {
+		dst = appendJSONKey(dst, "body")
+		dst = appendJSONString(dst, a.Body)
+	}
+	if a.ActionLocKey != "" {
+		dst = appendJSONKey(dst, "action-loc-key")
+		dst = appendJSONString(dst, a.ActionLocKey)
+	}
+	if a.LocKey != "" {
+		dst = appendJSONKey(dst, "loc-key")
+		dst = appendJSONString(dst, a.LocKey)
+	}
+	if len(a.LocArgs) > 0 {
+		dst = appendJSONKey(dst, "loc-args")
+		dst = appendJSONStrings(dst, a.LocArgs)
+	}
+	if a.LaunchImage != "" {
+		dst = appendJSONKey(dst, "launch-image")
+		dst = appendJSONString(dst, a.LaunchImage)
+	}
+	if a.Title != "" {
+		dst = appendJSONKey(dst, "title")
+		dst = appendJSONString(dst, a.Title)
+	}
+	if a.TitleLocKey != "" {
+		dst = appendJSONKey(dst, "title-loc-key")
+		dst = appendJSONString(dst, a.TitleLocKey)
+	}
+	if len(a.TitleLocArgs) > 0 {
+		dst = appendJSONKey(dst, "title-loc-args")
+		dst = appendJSONStrings(dst, a.TitleLocArgs)
+	}
+	if a.Subtitle != "" {
+		dst = appendJSONKey(dst, "subtitle")
+		dst = appendJSONString(dst, a.Subtitle)
+	}
+	if a.SubtitleLocKey != "" {
+		dst = appendJSONKey(dst, "subtitle-loc-key")
+		dst = appendJSONString(dst, a.SubtitleLocKey)
 	}
-	if a.Sound != "" {
-		toMarshal["sound"] = a.Sound
+	if len(a.SubtitleLocArgs) > 0 {
+		dst = appendJSONKey(dst, "subtitle-loc-args")
+		dst = appendJSONStrings(dst, a.SubtitleLocArgs)
 	}
-	if a.Category != "" {
-		toMarshal["category"] = a.Category
+	if a.SummaryArg != "" {
+		dst = appendJSONKey(dst, "summary-arg")
+		dst = appendJSONString(dst, a.SummaryArg)
 	}
-	if a.ContentAvailable != 0 {
-		toMarshal["content-available"] = a.ContentAvailable
+	if a.SummaryArgCount != 0 {
+		dst = appendJSONKey(dst, "summary-arg-count")
+		dst = strconv.AppendInt(dst, int64(a.SummaryArgCount), 10)
 	}
 
-	return json.Marshal(toMarshal)
+	return append(dst, '}')
 }
@@ -0,0 +1,203 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+//Reusable state for marshalling payloads, see payloadEncoderPool
+//Output matches encoding/json: map keys are sorted and strings are
+//escaped the same way, including HTML characters
+type payloadEncoder struct {
+	//top level keys (custom fields plus "aps"), sorted
+	keys []string
+	//custom field and live activity values are encoded here
+	values *bytes.Buffer
+	//encodes custom field and live activity values into values
+	json *json.Encoder
+}
+
+//Encoders shared by every connection so marshalling doesn't allocate
+var payloadEncoderPool = sync.Pool{
+	New: func() interface{} {
+		e := &payloadEncoder{values: new(bytes.Buffer)}
+		e.json = json.NewEncoder(e.values)
+		return e
+	},
+}
+
+//Append the payload's json to dst
+func (e *payloadEncoder) appendPayload(dst []byte, p *Payload) ([]byte, error) {
+	dst = append(dst, '{')
+	for _, key := range e.keys {
+		dst = appendJSONKey(dst, key)
+		var err error
+		if key == "aps" {
+			dst, err = p.appendAps(dst, e)
+		} else {
+			dst, err = e.appendValue(dst, p.CustomFields[key])
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+//Append v encoded by encoding/json
+func (e *payloadEncoder) appendValue(dst []byte, v interface{}) ([]byte, error) {
+	e.values.Reset()
+	err := e.json.Encode(v)
+	if err != nil {
+		return dst, err
+	}
+	//Encode ends each value with a newline
+	return append(dst, e.values.Bytes()[:e.values.Len()-1]...), nil
+}
+
+//Sort the top level keys of p into keys
+//will return error if custom field named aps supplied
+func (e *payloadEncoder) sortKeys(p *Payload) error {
+	e.keys = append(e.keys[:0], "aps")
+	for key := range p.CustomFields {
+		if key == "aps" {
+			return ErrApsCustomField
+		}
+		e.keys = append(e.keys, key)
+	}
+	slices.Sort(e.keys)
+	return nil
+}
+
+//Append key as an object key, preceded by a comma unless it's the first key
+func appendJSONKey(dst []byte, key string) []byte {
+	if dst[len(dst)-1] != '{' {
+		dst = append(dst, ',')
+	}
+	dst = appendJSONString(dst, key)
+	return append(dst, ':')
+}
+
+//Append s as a json string array
+func appendJSONStrings(dst []byte, s []string) []byte {
+	dst = append(dst, '[')
+	for i, value := range s {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJSONString(dst, value)
+	}
+	return append(dst, ']')
+}
+
+//Append f as a json number, formatted the same way encoding/json formats it
+func appendJSONFloat(dst []byte, f float64) []byte {
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, 64)
+	if format == 'e' {
+		//clean up e-09 to e-9
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst
+}
+
+const hexDigits = "0123456789abcdef"
+
+//Append s as a json string, escaped the same way encoding/json escapes it
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= ' ' && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				dst = append(dst, '\\', b)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				//other control characters and <, > and &
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			//invalid utf-8 is replaced
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if c == '\u2028' || c == '\u2029' {
+			//line and paragraph separators break javascript
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[c&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
+
+//Number of bytes appendJSONString writes for s, not counting the quotes
+func jsonStringLen(s string) int {
+	n := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			switch {
+			case b >= ' ' && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&':
+				n++
+			case b == '"', b == '\\', b == '\b', b == '\f', b == '\n', b == '\r', b == '\t':
+				n += 2
+			default:
+				n += 6
+			}
+			i++
+			continue
+		}
+
+		c, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case c == utf8.RuneError && size == 1:
+			n += len("\ufffd")
+		case c == '\u2028' || c == '\u2029':
+			n += 6
+		default:
+			n += size
+		}
+		i += size
+	}
+	return n
+}
@@ -0,0 +1,117 @@
+package apns
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAppendJSONStringShouldMatchEncodingJSON(t *testing.T) {
+	strings := []string{
+		"",
+		"plain text",
+		`quotes " and \ backslashes`,
+		"control \b\f\n\r\t\x00\x1f\x7f characters",
+		"html <b>&amp;</b>",
+		"unicode ☃ 日本語 😀",
+		"separators \u2028 \u2029",
+		"invalid \xff utf-8 \xe2\x82",
+	}
+
+	for _, s := range strings {
+		expected, _ := json.Marshal(s)
+		if encoded := appendJSONString(nil, s); string(encoded) != string(expected) {
+			t.Errorf("Expected %s but got %s", expected, encoded)
+		}
+	}
+}
+
+func TestMarshalShouldSortApsAmongCustomFields(t *testing.T) {
+	p := Payload{
+		AlertText: "Testing <this>",
+		CustomFields: map[string]interface{}{
+			"zzz":    true,
+			"a":      "first",
+			"b<key>": 1.5,
+		},
+	}
+
+	encoded, err := p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fullPayload := map[string]interface{}{
+		"aps":    map[string]string{"alert": p.AlertText},
+		"zzz":    true,
+		"a":      "first",
+		"b<key>": 1.5,
+	}
+	expected, _ := json.Marshal(fullPayload)
+	if string(encoded) != string(expected) {
+		t.Errorf("Expected %s but got %s", expected, encoded)
+	}
+}
+
+func TestAppendJSONShouldAppendToBuffer(t *testing.T) {
+	p := Payload{AlertText: "Testing", Badge: NewBadgeNumber(0)}
+
+	encoded, truncated, err := p.appendJSON([]byte("prefix"), 256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `prefix{"aps":{"alert":"Testing","badge":0}}`
+	if string(encoded) != expected || truncated != nil {
+		t.Errorf("Expected %v but got %s (truncated %v)", expected, encoded, truncated)
+	}
+
+	//too large, and can't be truncated
+	p.AlertText = ""
+	encoded, _, err = p.appendJSON([]byte("prefix"), 5, nil)
+	if err == nil || string(encoded) != "prefix" {
+		t.Errorf("Expected error and unchanged buffer but got %v %s", err, encoded)
+	}
+}
+
+func TestAppendJSONShouldNotAllocate(t *testing.T) {
+	if raceEnabled {
+		t.Skip("Allocations are counted without the race detector")
+	}
+	p := Payload{
+		AlertBody: APSAlertBody{
+			Body:    "Testing this payload",
+			LocKey:  "loc-key",
+			LocArgs: []string{"arg1", "arg2"},
+			Title:   "Title",
+		},
+		Badge:    NewBadgeNumber(2),
+		Sound:    NewSound("test.aiff"),
+		Category: "TEST_CATEGORY",
+	}
+	buffer := make([]byte, 0, 512)
+
+	//warm up the encoder pool
+	p.appendJSON(buffer, 256, nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		p.appendJSON(buffer, 256, nil)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations but got %v", allocs)
+	}
+}
+
+func BenchmarkAppendJSON(b *testing.B) {
+	p := Payload{
+		AlertText:        "Testing this payload",
+		Badge:            NewBadgeNumber(2),
+		ContentAvailable: 1,
+		Sound:            NewSound("test.aiff"),
+		Category:         "TEST_CATEGORY",
+	}
+	buffer := make([]byte, 0, 512)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer, _, _ = p.appendJSON(buffer[:0], 256, nil)
+	}
+}
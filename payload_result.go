@@ -0,0 +1,49 @@
+package apns
+
+//Outcome of a payload sent through an APNSConnection
+type PayloadStatus int
+
+const (
+	//No error response covered the payload within PayloadAcceptedTimeout of
+	//it being flushed, or Apple rejected a later payload
+	PAYLOAD_ACCEPTED PayloadStatus = iota
+	//Apple rejected the payload, Error is the *AppleError
+	PAYLOAD_REJECTED
+	//The payload followed a rejected payload and was not processed by Apple,
+	//it is included in ConnectionClose.UnsentPayloads
+	//Also used with ErrConnectionClosed for payloads sent after the connection closed
+	PAYLOAD_UNSENT
+	//The payload was never written to the socket because it was invalid
+	PAYLOAD_DROPPED
+	//The connection closed without an error response before the payload
+	//was accepted, Apple may or may not have received it
+	PAYLOAD_UNKNOWN
+)
+
+//Result of a single payload sent through an APNSConnection
+type PayloadResult struct {
+	//Internal ID the payload was sent with (see AppleError.MessageID),
+	//0 for dropped payloads as they were never sent
+	ID uint32
+	//The payload object
+	Payload *Payload
+	//What happened to the payload
+	Status PayloadStatus
+	//Why the payload was rejected, dropped or unknown, nil otherwise
+	Error error
+}
+
+var payloadStatusNames = map[PayloadStatus]string{
+	PAYLOAD_ACCEPTED: "ACCEPTED",
+	PAYLOAD_REJECTED: "REJECTED",
+	PAYLOAD_UNSENT:   "UNSENT",
+	PAYLOAD_DROPPED:  "DROPPED",
+	PAYLOAD_UNKNOWN:  "UNKNOWN",
+}
+
+func (s PayloadStatus) String() string {
+	if name, ok := payloadStatusNames[s]; ok {
+		return name
+	}
+	return "INVALID"
+}
@@ -0,0 +1,20 @@
+package apns
+
+import "testing"
+
+func TestPayloadStatusString(t *testing.T) {
+	expected := map[PayloadStatus]string{
+		PAYLOAD_ACCEPTED:  "ACCEPTED",
+		PAYLOAD_REJECTED:  "REJECTED",
+		PAYLOAD_UNSENT:    "UNSENT",
+		PAYLOAD_DROPPED:   "DROPPED",
+		PAYLOAD_UNKNOWN:   "UNKNOWN",
+		PayloadStatus(42): "INVALID",
+	}
+
+	for status, name := range expected {
+		if status.String() != name {
+			t.Errorf("Expected %v but got %v", name, status.String())
+		}
+	}
+}
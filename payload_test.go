@@ -1,6 +1,7 @@
 package apns
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -10,7 +11,7 @@ func TestSimpleMarshal(t *testing.T) {
 		AlertText:        "Testing this payload",
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		Category:         "TEST_CATEGORY",
 	}
 
@@ -35,7 +36,7 @@ func TestBadge0ShouldOmitBadge(t *testing.T) {
 	p := Payload{
 		AlertText:        "Testing this payload",
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		Category:         "TEST_CATEGORY",
 	}
 
@@ -71,7 +72,7 @@ func TestSimpleMarshalWithCustomFields(t *testing.T) {
 		AlertText:        "Testing this payload",
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		CustomFields:     customFields,
 	}
 
@@ -99,7 +100,7 @@ func TestSimpleMarshalTruncate(t *testing.T) {
 			"and some more text to really make this much bigger and stuff",
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 	}
 
 	payloadSize := 256
@@ -136,7 +137,7 @@ func TestSimpleMarshalTruncateWithCustomFields(t *testing.T) {
 			"plus some more text",
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		CustomFields:     customFields,
 	}
 
@@ -191,15 +192,15 @@ func TestSimpleMarshalThrowErrorIfPayloadTooBigWithCustomFields(t *testing.T) {
 		AlertText:        "Testing this payload",
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		CustomFields:     customFields,
 	}
 
 	payloadSize := 256
 
 	_, err := p.Marshal(payloadSize)
-	if err == nil {
-		t.Error("Should have thrown marshaling error")
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Should have thrown ErrPayloadTooLarge but got %v", err)
 	}
 }
 
@@ -208,7 +209,7 @@ func TestAlertBodyMarshal(t *testing.T) {
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
 		Category:         "TEST_CATEGORY",
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		AlertBody: APSAlertBody{
 			Body:         "Testing this payload",
 			ActionLocKey: "act-loc-key",
@@ -249,7 +250,7 @@ func TestAlertBodyMarshalWithCustomFields(t *testing.T) {
 	p := Payload{
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		CustomFields:     customFields,
 		AlertBody: APSAlertBody{
 			Body:         "Testing this payload",
@@ -284,7 +285,7 @@ func TestAlertBodyMarshalTruncate(t *testing.T) {
 	p := Payload{
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		AlertBody: APSAlertBody{
 			Body: "Testing this payload with a really long message that should " +
 				"cause the payload to be truncated yay and stuff blah blah blah blah blah blah " +
@@ -321,7 +322,7 @@ func TestAlertBodyMarshalTruncateWithCustomFields(t *testing.T) {
 	p := Payload{
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		CustomFields:     customFields,
 		AlertBody: APSAlertBody{
 			Body: "Testing this payload with a bunch of text that should get truncated " +
@@ -384,7 +385,7 @@ func TestAlertBodyMarshalThrowErrorIfPayloadTooBigWithCustomFields(t *testing.T)
 	p := Payload{
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		CustomFields:     customFields,
 		AlertBody: APSAlertBody{
 			Body:        "Testing this payload",
@@ -395,8 +396,8 @@ func TestAlertBodyMarshalThrowErrorIfPayloadTooBigWithCustomFields(t *testing.T)
 	payloadSize := 256
 
 	_, err := p.Marshal(payloadSize)
-	if err == nil {
-		t.Error("Should have thrown marshaling error")
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Should have thrown ErrPayloadTooLarge but got %v", err)
 	}
 }
 
@@ -435,7 +436,7 @@ func BenchmarkSimpleMarshalTruncate256WithCustomFields(b *testing.B) {
 			"plus some more text",
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		CustomFields:     customFields,
 	}
 
@@ -462,7 +463,7 @@ func BenchmarkSimpleMarshalTruncate1024WithCustomFields(b *testing.B) {
 			"plus some more text",
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		CustomFields:     customFields,
 	}
 
@@ -486,7 +487,7 @@ func BenchmarkAlertBodyMarshalTruncate256WithCustomFields(b *testing.B) {
 	p := Payload{
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		CustomFields:     customFields,
 		AlertBody: APSAlertBody{
 			Body: "Testing this payload with a bunch of text that should get truncated " +
@@ -516,7 +517,7 @@ func BenchmarkAlertBodyMarshalTruncate1024WithCustomFields(b *testing.B) {
 	p := Payload{
 		Badge:            NewBadgeNumber(2),
 		ContentAvailable: 1,
-		Sound:            "test.aiff",
+		Sound:            NewSound("test.aiff"),
 		CustomFields:     customFields,
 		AlertBody: APSAlertBody{
 			Body: "Testing this payload with a bunch of text that should get truncated " +
@@ -534,3 +535,174 @@ func BenchmarkAlertBodyMarshalTruncate1024WithCustomFields(b *testing.B) {
 		p.Marshal(1024)
 	}
 }
+
+func TestMarshalShouldRejectApsCustomField(t *testing.T) {
+	p := Payload{
+		AlertText:    "Testing this payload",
+		CustomFields: map[string]interface{}{"aps": "not allowed"},
+	}
+
+	_, err := p.Marshal(256)
+	if !errors.Is(err, ErrApsCustomField) {
+		t.Errorf("Should have thrown ErrApsCustomField but got %v", err)
+	}
+}
+
+func TestModernApsFieldsMarshal(t *testing.T) {
+	p := Payload{
+		AlertBody: APSAlertBody{
+			Body:            "Goal!",
+			Title:           "Home 1 - 0 Away",
+			Subtitle:        "Premier League",
+			SubtitleLocKey:  "LEAGUE",
+			SubtitleLocArgs: []string{"Premier"},
+			SummaryArg:      "Home",
+			SummaryArgCount: 2,
+		},
+		Sound:             NewSound("goal.aiff"),
+		MutableContent:    1,
+		ThreadID:          "match-1234",
+		TargetContentID:   "match-window",
+		InterruptionLevel: INTERRUPTION_LEVEL_TIME_SENSITIVE,
+		RelevanceScore:    NewRelevanceScore(0.75),
+		FilterCriteria:    "sports",
+	}
+
+	json, err := p.Marshal(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedJson := "{\"aps\":{\"alert\":{\"body\":\"Goal!\",\"title\":\"Home 1 - 0 Away\"," +
+		"\"subtitle\":\"Premier League\",\"subtitle-loc-key\":\"LEAGUE\",\"subtitle-loc-args\":[\"Premier\"]," +
+		"\"summary-arg\":\"Home\",\"summary-arg-count\":2}," +
+		"\"filter-criteria\":\"sports\",\"interruption-level\":\"time-sensitive\",\"mutable-content\":1," +
+		"\"relevance-score\":0.75,\"sound\":\"goal.aiff\",\"target-content-id\":\"match-window\"," +
+		"\"thread-id\":\"match-1234\"}}"
+	if string(json) != expectedJson {
+		t.Errorf("Expected %v but got %v", expectedJson, string(json))
+	}
+}
+
+func TestModernApsFieldsShouldBeOmittedWhenEmpty(t *testing.T) {
+	p := Payload{AlertText: "Testing", RelevanceScore: NewRelevanceScore(0)}
+
+	json, err := p.Marshal(256)
+	expectedJson := "{\"aps\":{\"alert\":\"Testing\",\"relevance-score\":0}}"
+	if err != nil || string(json) != expectedJson {
+		t.Errorf("Expected %v but got %v %v", expectedJson, string(json), err)
+	}
+
+	p.RelevanceScore.UnSet()
+	json, err = p.Marshal(256)
+	expectedJson = "{\"aps\":{\"alert\":\"Testing\"}}"
+	if err != nil || string(json) != expectedJson {
+		t.Errorf("Expected %v but got %v %v", expectedJson, string(json), err)
+	}
+}
+
+func TestModernApsFieldsShouldBeTruncated(t *testing.T) {
+	p := Payload{
+		AlertBody: APSAlertBody{
+			Body:            "Goal!",
+			Subtitle:        "Premier League matchday thirty four",
+			SubtitleLocKey:  "LEAGUE",
+			SubtitleLocArgs: []string{"Premier", "thirty four"},
+			SummaryArg:      "Home team",
+		},
+		ThreadID: "match-1234",
+	}
+	policy := &TruncationPolicy{
+		Ellipsis: "...",
+		Steps: []TruncationStep{
+			{Field: TRUNCATE_SUMMARY_ARG, MinLength: 4},
+			{Field: TRUNCATE_SUBTITLE_LOC_ARGS, MinLength: 5},
+			{Field: TRUNCATE_SUBTITLE, MinLength: 7},
+		},
+	}
+
+	expectedJson := "{\"aps\":{\"alert\":{\"body\":\"Goal!\",\"subtitle\":\"Premier...\"," +
+		"\"subtitle-loc-key\":\"LEAGUE\",\"subtitle-loc-args\":[\"Premier\",\"thirt...\"]," +
+		"\"summary-arg\":\"Home...\"},\"thread-id\":\"match-1234\"}}"
+	json, result, err := p.MarshalWithPolicy(len(expectedJson), policy)
+	if err != nil || string(json) != expectedJson {
+		t.Errorf("Expected %v but got %v %v", expectedJson, string(json), err)
+	}
+	if fmt.Sprint(result.Shortened) != "[summary-arg subtitle-loc-args subtitle]" {
+		t.Errorf("Expected summary-arg, subtitle-loc-args and subtitle to be shortened but got %v", result.Shortened)
+	}
+}
+
+func TestBackgroundPayloadMarshal(t *testing.T) {
+	p := NewBackgroundPayload(testToken(1), map[string]interface{}{"sync": "inbox"})
+
+	json, err := p.Marshal(256)
+	expectedJson := "{\"aps\":{\"content-available\":1},\"sync\":\"inbox\"}"
+	if err != nil || string(json) != expectedJson {
+		t.Errorf("Expected %v but got %v %v", expectedJson, string(json), err)
+	}
+	if p.Priority != PRIORITY_CONSERVE_POWER || p.sendPriority() != PRIORITY_CONSERVE_POWER {
+		t.Errorf("Expected priority 5 but was %v", p.Priority)
+	}
+
+	//content-available is sent even if it was cleared
+	p.ContentAvailable = 0
+	p.Priority = 0
+	json, err = p.Marshal(256)
+	if err != nil || string(json) != expectedJson {
+		t.Errorf("Expected %v but got %v %v", expectedJson, string(json), err)
+	}
+	if p.sendPriority() != PRIORITY_CONSERVE_POWER {
+		t.Errorf("Expected background payload to be sent at priority 5 but was %v", p.sendPriority())
+	}
+}
+
+func TestSetBackgroundShouldStripAlertFields(t *testing.T) {
+	p := Payload{
+		AlertText: "Testing",
+		AlertBody: APSAlertBody{Body: "Testing", Title: "Title"},
+		Badge:     NewBadgeNumber(2),
+		Sound:     NewSound("test.aiff"),
+		Category:  "TEST_CATEGORY",
+		Priority:  PRIORITY_IMMEDIATE,
+	}
+	p.SetBackground()
+
+	if err := p.validateBackground(); err != nil {
+		t.Fatal(err)
+	}
+	json, err := p.Marshal(256)
+	expectedJson := "{\"aps\":{\"category\":\"TEST_CATEGORY\",\"content-available\":1}}"
+	if err != nil || string(json) != expectedJson {
+		t.Errorf("Expected %v but got %v %v", expectedJson, string(json), err)
+	}
+	if p.Priority != PRIORITY_CONSERVE_POWER {
+		t.Errorf("Expected priority 5 but was %v", p.Priority)
+	}
+}
+
+func TestBackgroundPayloadValidation(t *testing.T) {
+	cases := []struct {
+		change   func(p *Payload)
+		expected error
+	}{
+		{func(p *Payload) {}, nil},
+		{func(p *Payload) { p.Priority = 0 }, nil},
+		{func(p *Payload) { p.AlertText = "Testing" }, ErrInvalidBackgroundPayload},
+		{func(p *Payload) { p.AlertBody.Body = "Testing" }, ErrInvalidBackgroundPayload},
+		{func(p *Payload) { p.Sound = NewSound("default") }, ErrInvalidBackgroundPayload},
+		{func(p *Payload) { p.Badge = NewBadgeNumber(0) }, ErrInvalidBackgroundPayload},
+		{func(p *Payload) { p.LiveActivity = &LiveActivity{} }, ErrInvalidBackgroundPayload},
+		{func(p *Payload) { p.Priority = PRIORITY_IMMEDIATE }, ErrInvalidBackgroundPayload},
+		{func(p *Payload) { p.Background = false; p.AlertText = "Testing" }, nil},
+	}
+
+	for i, c := range cases {
+		p := NewBackgroundPayload(testToken(1), nil)
+		c.change(p)
+		err := p.validateBackground()
+		if !errors.Is(err, c.expected) || (c.expected == nil && err != nil) {
+			t.Errorf("Case %v: expected %v but got %v", i, c.expected, err)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package apns
+
+//sync.Pool drops items at random under the race detector,
+//so allocation counts are only checked without it
+const raceEnabled = true
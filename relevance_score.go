@@ -0,0 +1,87 @@
+package apns
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Struct representing the relevance score iOS uses
+// to pick the featured notification in a summary
+type RelevanceScore struct {
+	score float64
+	set   bool
+}
+
+// Returns the set relevance score
+func (r *RelevanceScore) Score() float64 {
+	return r.score
+}
+
+// Returns whether or not this RelevanceScore
+// is set and should be sent in the APNS payload
+func (r *RelevanceScore) IsSet() bool {
+	return r.set
+}
+
+// Resets the RelevanceScore to 0 and
+// removes it from the APNS payload
+func (r *RelevanceScore) UnSet() {
+	r.score = 0
+	r.set = false
+}
+
+// Sets the relevance score and includes it in the
+// payload to APNS. Must be between 0 and 1
+func (r *RelevanceScore) Set(score float64) error {
+	if !validRelevanceScore(score) {
+		return ErrInvalidRelevanceScore
+	}
+
+	r.score = score
+	r.set = true
+	return nil
+}
+
+// NaN and infinite scores fail this too
+func validRelevanceScore(score float64) bool {
+	return score >= 0 && score <= 1
+}
+
+// Check a set score can be sent before it's marshalled
+func (r *RelevanceScore) validate() error {
+	if r.set && !validRelevanceScore(r.score) {
+		return ErrInvalidRelevanceScore
+	}
+	return nil
+}
+
+func (r RelevanceScore) MarshalJSON() ([]byte, error) {
+	err := r.validate()
+	if err != nil {
+		return nil, err
+	}
+	return appendJSONFloat(nil, r.score), nil
+}
+
+func (r *RelevanceScore) UnmarshalJSON(data []byte) error {
+	val, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return errors.New("Error unmarshalling RelevanceScore, cannot convert []byte to float64")
+	}
+
+	*r = RelevanceScore{
+		score: val,
+		set:   true,
+	}
+	return nil
+}
+
+// Get a new relevance score, set to the initial
+// score, and included in the payload
+// Scores that aren't between 0 and 1 fail to marshal with ErrInvalidRelevanceScore
+func NewRelevanceScore(score float64) RelevanceScore {
+	return RelevanceScore{
+		score: score,
+		set:   true,
+	}
+}
@@ -0,0 +1,87 @@
+package apns
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestRelevanceScoreDefaults(t *testing.T) {
+	r := RelevanceScore{}
+
+	if r.IsSet() {
+		t.Error("RelevanceScore should not be set by default")
+	}
+	if r.Score() != 0 {
+		t.Error("Relevance score should be 0 by default")
+	}
+}
+
+func TestRelevanceScoreSet(t *testing.T) {
+	r := RelevanceScore{}
+
+	err := r.Set(0)
+	if err != nil || !r.IsSet() || r.Score() != 0 {
+		t.Errorf("Expected score of 0 to be set but got %v %v", r.Score(), err)
+	}
+
+	for _, score := range []float64{-0.1, 1.5, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if err := r.Set(score); !errors.Is(err, ErrInvalidRelevanceScore) {
+			t.Errorf("Expected ErrInvalidRelevanceScore setting score %v but got %v", score, err)
+		}
+	}
+	if r.Score() != 0 {
+		t.Errorf("Expected invalid scores to be ignored but got %v", r.Score())
+	}
+
+	r.UnSet()
+	if r.IsSet() {
+		t.Error("UnSet should unset RelevanceScore")
+	}
+}
+
+func TestRelevanceScoreMarshalJSON(t *testing.T) {
+	for _, score := range []float64{0, 0.25, 1, 0.0000001} {
+		jsonData, err := json.Marshal(map[string]RelevanceScore{"score": NewRelevanceScore(score)})
+		expected, _ := json.Marshal(map[string]float64{"score": score})
+		if err != nil || string(jsonData) != string(expected) {
+			t.Errorf("Expected %s but got %s %v", expected, jsonData, err)
+		}
+	}
+}
+
+func TestRelevanceScoreShouldNotMarshalInvalidScores(t *testing.T) {
+	for _, score := range []float64{5, -1, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		_, err := json.Marshal(NewRelevanceScore(score))
+		if !errors.Is(err, ErrInvalidRelevanceScore) {
+			t.Errorf("Expected ErrInvalidRelevanceScore marshalling %v but got %v", score, err)
+		}
+
+		p := Payload{AlertText: "Testing", RelevanceScore: NewRelevanceScore(score)}
+		_, err = p.Marshal(256)
+		if !errors.Is(err, ErrInvalidRelevanceScore) {
+			t.Errorf("Expected ErrInvalidRelevanceScore marshalling payload with %v but got %v", score, err)
+		}
+		errs := p.Validate(256)
+		if len(errs) != 2 || errs[0].Field != "Token" || errs[1].Field != "RelevanceScore" ||
+			!errors.Is(errs[1], ErrInvalidRelevanceScore) {
+			t.Errorf("Expected Validate to report the score %v but got %v", score, errs)
+		}
+	}
+}
+
+func TestRelevanceScoreUnmarshalJSON(t *testing.T) {
+	type TestStruct struct {
+		Score RelevanceScore
+	}
+
+	var ts TestStruct
+	err := json.Unmarshal([]byte("{\"score\":0}"), &ts)
+	if err != nil {
+		t.Errorf("Error unmarshalling to RelevanceScore: %s", err.Error())
+	}
+	if !ts.Score.IsSet() || ts.Score.Score() != 0 {
+		t.Errorf("Expected score of 0 to be set but got %v", ts.Score.Score())
+	}
+}
@@ -0,0 +1,308 @@
+package apns
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+//Payloads move through an APNSConnection in three stages:
+//  - marshal: sendListener takes a batch of the payloads waiting on SendChannel
+//    and marshals them in parallel with marshalListeners, keeping send order
+//  - frame: sendListener assigns IDs and frames the payloads into a chunk,
+//    handing full chunks (or chunks older than FramingTimeout) to writeListener
+//  - write: writeListener writes every chunk queued with one vectored write
+//Buffers for each stage come from sync.Pools so steady state sending doesn't allocate
+
+const (
+	//Max number of payloads taken from SendChannel to marshal at once
+	MAX_MARSHAL_BATCH_SIZE = 128
+	//Min number of payloads worth handing to a marshalListener
+	MIN_MARSHAL_JOB_SIZE = 8
+	//Number of chunks that can wait for writeListener before framing blocks
+	WRITE_QUEUE_SIZE = 4
+)
+
+var (
+	//Buffers payloads are marshalled into, returned once the payload is framed
+	payloadBufferPool = sync.Pool{
+		New: func() interface{} {
+			buffer := make([]byte, 0, 512)
+			return &buffer
+		},
+	}
+	//Chunks of frames waiting to be written, returned once the chunk is written
+	frameChunkPool = sync.Pool{
+		New: func() interface{} {
+			chunk := make([]byte, 0, TCP_FRAME_MAX)
+			return &chunk
+		},
+	}
+)
+
+//A payload marshalled ahead of being framed
+type marshalledPayload struct {
+	//The Payload object, the template for broadcasts
+	Payload *Payload
+	//Device token the template is broadcast to, empty if not a broadcast
+	BroadcastToken string
+	//Decoded device token
+	Token [APNS_TOKEN_SIZE]byte
+	//Marshalled json, from payloadBufferPool (shared by the batch for broadcasts)
+	JSON *[]byte
+	//What had to be truncated to fit, nil if nothing
+	Truncation *TruncationResult
+	//Why the payload can't be framed, nil if it can
+	Err *InvalidPayloadError
+}
+
+//Part of a batch for a marshalListener to marshal
+type marshalJob struct {
+	//payloads to marshal in place
+	payloads []marshalledPayload
+	//Done is called once every payload is marshalled
+	done *sync.WaitGroup
+}
+
+//A chunk of frames for writeListener
+type pendingWrite struct {
+	//framed payloads, from frameChunkPool
+	frames *[]byte
+	//number of payloads framed in frames
+	count int
+	//ID of the last payload framed in frames
+	lastID uint32
+}
+
+//Decode the token and marshal the payload into a pooled buffer
+func (m *marshalledPayload) marshal(maxPayloadSize int, policy *TruncationPolicy) {
+	m.Err = nil
+	err := decodeToken(&m.Token, m.Payload.Token)
+	if err != nil {
+		m.Err = newInvalidPayloadError(m.Payload, err)
+		return
+	}
+	err = m.Payload.validateBinary()
+	if err != nil {
+		m.Err = newInvalidPayloadError(m.Payload, err)
+		return
+	}
+
+	m.JSON = payloadBufferPool.Get().(*[]byte)
+	jsonStr, truncation, err := m.Payload.appendJSON((*m.JSON)[:0], maxPayloadSize, policy)
+	if err != nil {
+		payloadBufferPool.Put(m.JSON)
+		m.JSON = nil
+		m.Err = newInvalidPayloadError(m.Payload, err)
+		return
+	}
+	*m.JSON = jsonStr
+	m.Truncation = truncation
+}
+
+//Return the marshalled json to payloadBufferPool once the payload is framed
+//and let go of the payload
+func (m *marshalledPayload) release() {
+	if m.JSON != nil {
+		payloadBufferPool.Put(m.JSON)
+		m.JSON = nil
+	}
+	m.Payload = nil
+}
+
+//Decode a hex device token without allocating
+func decodeToken(token *[APNS_TOKEN_SIZE]byte, hexToken string) error {
+	if len(hexToken)%2 != 0 {
+		return ErrInvalidTokenEncoding
+	}
+	for i := 0; i < len(hexToken); i++ {
+		if _, ok := fromHexChar(hexToken[i]); !ok {
+			return ErrInvalidTokenEncoding
+		}
+	}
+	if len(hexToken) != 2*APNS_TOKEN_SIZE {
+		return fmt.Errorf("%w. Was %v bytes but should have been %v bytes", ErrInvalidTokenSize, len(hexToken)/2, APNS_TOKEN_SIZE)
+	}
+
+	for i := range token {
+		high, _ := fromHexChar(hexToken[2*i])
+		low, _ := fromHexChar(hexToken[2*i+1])
+		token[i] = high<<4 | low
+	}
+	return nil
+}
+
+//Value of a hex digit, either case
+func fromHexChar(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+//Take payload and any more payloads already waiting on sendChannel,
+//up to MAX_MARSHAL_BATCH_SIZE
+//Returns false if sendChannel was closed
+func (c *APNSConnection) receiveBatch(payload *Payload, sendChannel chan *Payload) ([]marshalledPayload, bool) {
+	n := 0
+	for {
+		c.marshalBatch[n].Payload = payload
+		n++
+		if n == len(c.marshalBatch) {
+			return c.marshalBatch[:n], true
+		}
+
+		select {
+		case payload = <-sendChannel:
+			if payload == nil {
+				//channel was closed
+				return c.marshalBatch[:n], false
+			}
+		default:
+			return c.marshalBatch[:n], true
+		}
+	}
+}
+
+//Marshal batch in place, split between sendListener and the marshalListeners
+func (c *APNSConnection) marshalPayloads(batch []marshalledPayload) {
+	workers := c.marshalWorkers
+	if maxWorkers := (len(batch) + MIN_MARSHAL_JOB_SIZE - 1) / MIN_MARSHAL_JOB_SIZE; workers > maxWorkers {
+		workers = maxWorkers
+	}
+	perWorker := (len(batch) + workers - 1) / workers
+
+	//hand off all but the first part, which is marshalled here
+	for start := perWorker; start < len(batch); start += perWorker {
+		end := start + perWorker
+		if end > len(batch) {
+			end = len(batch)
+		}
+		c.marshalWaitGroup.Add(1)
+		c.marshalChannel <- marshalJob{
+			payloads: batch[start:end],
+			done:     c.marshalWaitGroup,
+		}
+	}
+
+	for i := range batch[:perWorker] {
+		batch[i].marshal(c.config.MaxPayloadSize, c.config.TruncationPolicy)
+	}
+	c.marshalWaitGroup.Wait()
+}
+
+//go-routine to marshal payloads for sendListener
+//Returns once marshalChannel is closed
+func (c *APNSConnection) marshalListener() {
+	for job := range c.marshalChannel {
+		for i := range job.payloads {
+			job.payloads[i].marshal(c.config.MaxPayloadSize, c.config.TruncationPolicy)
+		}
+		job.done.Done()
+	}
+}
+
+//Hand the frames buffered since the last flush to writeListener
+//Only called from sendListener
+func (c *APNSConnection) flushBufferToSocket() {
+	if len(*c.frameChunk) == 0 {
+		return
+	}
+
+	c.writeChannel <- pendingWrite{
+		frames: c.frameChunk,
+		count:  c.frameChunkPayloadCount,
+		lastID: c.frameChunkLastID,
+	}
+	c.frameChunk = frameChunkPool.Get().(*[]byte)
+	*c.frameChunk = (*c.frameChunk)[:0]
+	c.frameChunkPayloadCount = 0
+}
+
+//Stop writeListener once it has written everything already flushed
+//Safe to call more than once
+func (c *APNSConnection) stopWriter() {
+	c.stopWriterOnce.Do(func() {
+		close(c.writeChannel)
+	})
+}
+
+//go-routine to write flushed chunks to the socket
+//Chunks queued while a write is in progress are written together
+//Returns once writeChannel is closed
+func (c *APNSConnection) writeListener() {
+	defer close(c.writerDoneChannel)
+
+	writes := make([]pendingWrite, 0, WRITE_QUEUE_SIZE+1)
+	buffers := make(net.Buffers, 0, WRITE_QUEUE_SIZE+1)
+	failed := false
+
+	for write := range c.writeChannel {
+		writes = append(writes[:0], write)
+	gather:
+		for len(writes) < cap(writes) {
+			select {
+			case write, ok := <-c.writeChannel:
+				if !ok {
+					break gather
+				}
+				writes = append(writes, write)
+			default:
+				break gather
+			}
+		}
+
+		//once a write fails the socket is closed, so the rest are discarded
+		if !failed {
+			failed = !c.writeFrames(writes, buffers)
+		}
+		for _, write := range writes {
+			frameChunkPool.Put(write.frames)
+		}
+	}
+}
+
+//Write the chunks to the socket with one vectored write
+//Returns false and closes the socket if the write fails
+func (c *APNSConnection) writeFrames(writes []pendingWrite, buffers net.Buffers) bool {
+	buffers = buffers[:0]
+	bufLen := 0
+	count := 0
+	for _, write := range writes {
+		buffers = append(buffers, *write.frames)
+		bufLen += len(*write.frames)
+		count += write.count
+	}
+
+	//write to socket
+	start := time.Now()
+	_, writeErr := buffers.WriteTo(c.socket)
+	if writeErr != nil {
+		c.logger.Log(LOG_ERROR, "Error while writing to socket",
+			"bytes", bufLen, "count", count, "error", writeErr)
+		c.noFlushDisconnect()
+		return false
+	}
+	c.metrics.FrameFlushed(bufLen, count, time.Since(start))
+	c.logger.Log(LOG_DEBUG, "Flushed frame to socket",
+		"bytes", bufLen, "count", count, "chunks", len(writes))
+
+	//everything up to the last payload written is now on the wire
+	flushedAt := time.Now()
+	c.inFlightBufferLock.Lock()
+	for i := c.inFlightPayloadBuffer.indexOf(writes[len(writes)-1].lastID); i >= 0; i-- {
+		idPayloadObj := c.inFlightPayloadBuffer.at(i)
+		if !idPayloadObj.FlushedAt.IsZero() {
+			break
+		}
+		idPayloadObj.FlushedAt = flushedAt
+	}
+	c.inFlightBufferLock.Unlock()
+	return true
+}
@@ -0,0 +1,294 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Socket that keeps (or discards) everything written until it's closed
+type recordingConn struct {
+	written     *bytes.Buffer
+	closeOnce   *sync.Once
+	closedChan  chan bool
+	discardData bool
+}
+
+func newRecordingConn(discard bool) *recordingConn {
+	return &recordingConn{
+		written:     new(bytes.Buffer),
+		closeOnce:   new(sync.Once),
+		closedChan:  make(chan bool),
+		discardData: discard,
+	}
+}
+
+func (conn *recordingConn) Read(b []byte) (n int, err error) {
+	<-conn.closedChan
+	return 0, errors.New("Socket Closed")
+}
+func (conn *recordingConn) Write(b []byte) (n int, err error) {
+	if !conn.discardData {
+		conn.written.Write(b)
+	}
+	return len(b), nil
+}
+func (conn *recordingConn) Close() error {
+	conn.closeOnce.Do(func() { close(conn.closedChan) })
+	return nil
+}
+func (conn *recordingConn) LocalAddr() net.Addr {
+	return nil
+}
+func (conn *recordingConn) RemoteAddr() net.Addr {
+	return nil
+}
+func (conn *recordingConn) SetDeadline(t time.Time) error {
+	return nil
+}
+func (conn *recordingConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+func (conn *recordingConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func newPipelineTestConnection(socket net.Conn, workers int) *APNSConnection {
+	config := testAPNSConfig()
+	config.MarshalWorkers = workers
+	applyConfigDefaults(config)
+	return socketAPNSConnection(socket, config)
+}
+
+//Read back every frame written to socket
+func readWrittenFrames(t *testing.T, socket *recordingConn) []*Frame {
+	frames := []*Frame{}
+	for {
+		frame, err := ReadFrame(socket.written)
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestPipelineShouldKeepSendOrder(t *testing.T) {
+	socket := newRecordingConn(false)
+	apn := newPipelineTestConnection(socket, 4)
+
+	count := 1000
+	for i := 1; i <= count; i++ {
+		apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(i)}
+	}
+	apn.Disconnect()
+
+	frames := readWrittenFrames(t, socket)
+	if len(frames) != count {
+		t.Fatalf("Expected %v frames but got %v", count, len(frames))
+	}
+	for i, frame := range frames {
+		token, _ := hex.DecodeString(testToken(i + 1))
+		if frame.ID != uint32(i+1) || !bytes.Equal(frame.Token, token) {
+			t.Fatalf("Expected payload %v with id %v but got id %v for %x", i+1, i+1, frame.ID, frame.Token)
+		}
+	}
+}
+
+func TestPipelineShouldFrameConcurrentSendsOnce(t *testing.T) {
+	socket := newRecordingConn(false)
+	apn := newPipelineTestConnection(socket, 4)
+
+	senders := 8
+	perSender := 500
+	wg := new(sync.WaitGroup)
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 1; i <= perSender; i++ {
+				apn.SendChannel <- &Payload{AlertText: "Testing", Token: testToken(s*perSender + i)}
+			}
+		}(s)
+	}
+	wg.Wait()
+	apn.Disconnect()
+
+	frames := readWrittenFrames(t, socket)
+	if len(frames) != senders*perSender {
+		t.Fatalf("Expected %v frames but got %v", senders*perSender, len(frames))
+	}
+	seen := map[string]bool{}
+	for i, frame := range frames {
+		if frame.ID != uint32(i+1) {
+			t.Fatalf("Expected consecutive ids but got %v at %v", frame.ID, i)
+		}
+		if seen[string(frame.Token)] {
+			t.Fatalf("Token %x was framed twice", frame.Token)
+		}
+		seen[string(frame.Token)] = true
+	}
+}
+
+func TestPipelineShouldDropInvalidPayloadsInBatch(t *testing.T) {
+	socket := newRecordingConn(false)
+	apn, results := newResultTestConnection(socket, 10000)
+
+	//a batch only forms while senders are waiting, so send concurrently
+	tokens := []string{testToken(1), "zz", testToken(2), "abc", testToken(3)}
+	wg := new(sync.WaitGroup)
+	for _, token := range tokens {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			apn.SendChannel <- &Payload{AlertText: "Testing", Token: token}
+		}(token)
+	}
+	wg.Wait()
+	apn.Disconnect()
+
+	dropped := map[string]error{}
+	for range tokens {
+		result := waitForPayloadResult(t, results)
+		if result.Status == PAYLOAD_DROPPED {
+			dropped[result.Payload.Token] = result.Error
+		}
+	}
+	if !errors.Is(dropped["zz"], ErrInvalidTokenEncoding) || !errors.Is(dropped["abc"], ErrInvalidTokenEncoding) || len(dropped) != 2 {
+		t.Errorf("Expected the two bad tokens to be dropped but got %v", dropped)
+	}
+	if frames := readWrittenFrames(t, socket); len(frames) != 3 {
+		t.Errorf("Expected 3 frames but got %v", len(frames))
+	}
+}
+
+func TestDecodeTokenShouldMatchHexDecoding(t *testing.T) {
+	var token [APNS_TOKEN_SIZE]byte
+	err := decodeToken(&token, "4EC500020D8350072D2417BA566FEDA10B2B266558371A65BA67FEDE21393C8F")
+	if err != nil || token[0] != 0x4e || token[31] != 0x8f {
+		t.Errorf("Expected upper case token to decode but got %x %v", token, err)
+	}
+
+	tests := map[string]error{
+		"4ec5":  ErrInvalidTokenSize,
+		"4ec":   ErrInvalidTokenEncoding,
+		"4ecx":  ErrInvalidTokenEncoding,
+		"":      ErrInvalidTokenSize,
+		"4e c5": ErrInvalidTokenEncoding,
+	}
+	for hexToken, expected := range tests {
+		if err := decodeToken(&token, hexToken); !errors.Is(err, expected) {
+			t.Errorf("Expected %v for %q but got %v", expected, hexToken, err)
+		}
+	}
+}
+
+func TestPipelineShouldNotAllocatePerPayload(t *testing.T) {
+	if raceEnabled {
+		t.Skip("Allocations are counted without the race detector")
+	}
+	socket := newRecordingConn(true)
+	apn := newPipelineTestConnection(socket, 1)
+	defer apn.Disconnect()
+
+	payload := &Payload{AlertText: "Testing this payload", Badge: NewBadgeNumber(1), Token: testToken(1)}
+	//warm up the pools
+	for i := 0; i < 100; i++ {
+		apn.SendChannel <- payload
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		apn.SendChannel <- payload
+	})
+	//leave room for timers and the odd flush
+	if allocs > 0.5 {
+		t.Errorf("Expected no allocations per payload but got %v", allocs)
+	}
+}
+
+//Send b.N payloads over a connection to a socket that discards them
+//Reports payloads/s, allocs/op is allocations per payload
+func benchmarkConnectionSend(b *testing.B, workers int, parallel bool) {
+	socket := newRecordingConn(true)
+	apn := newPipelineTestConnection(socket, workers)
+	payload := &Payload{
+		AlertText: "Testing this payload",
+		Badge:     NewBadgeNumber(2),
+		Sound:     NewSound("test.aiff"),
+		Token:     testToken(1),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	if parallel {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				apn.SendChannel <- payload
+			}
+		})
+	} else {
+		for i := 0; i < b.N; i++ {
+			apn.SendChannel <- payload
+		}
+	}
+	apn.Disconnect()
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "payloads/s")
+}
+
+func BenchmarkConnectionSendSerial(b *testing.B) {
+	benchmarkConnectionSend(b, 1, false)
+}
+
+func BenchmarkConnectionSendParallel1Worker(b *testing.B) {
+	benchmarkConnectionSend(b, 1, true)
+}
+
+func BenchmarkConnectionSendParallel4Workers(b *testing.B) {
+	benchmarkConnectionSend(b, 4, true)
+}
+
+func TestPipelineShouldDropInconsistentBackgroundPayloads(t *testing.T) {
+	socket := newRecordingConn(false)
+	apn, results := newResultTestConnection(socket, 10000)
+
+	valid := NewBackgroundPayload(testToken(1), nil)
+	valid.Priority = 0
+	withAlert := NewBackgroundPayload(testToken(2), nil)
+	withAlert.AlertText = "Testing"
+	immediate := NewBackgroundPayload(testToken(3), nil)
+	immediate.Priority = PRIORITY_IMMEDIATE
+
+	for _, payload := range []*Payload{valid, withAlert, immediate} {
+		apn.SendChannel <- payload
+	}
+	apn.Disconnect()
+
+	dropped := map[string]error{}
+	for i := 0; i < 3; i++ {
+		result := waitForPayloadResult(t, results)
+		if result.Status == PAYLOAD_DROPPED {
+			dropped[result.Payload.Token] = result.Error
+		}
+	}
+	if len(dropped) != 2 || !errors.Is(dropped[testToken(2)], ErrInvalidBackgroundPayload) ||
+		!errors.Is(dropped[testToken(3)], ErrInvalidBackgroundPayload) {
+		t.Errorf("Expected the inconsistent background payloads to be dropped but got %v", dropped)
+	}
+
+	frames := readWrittenFrames(t, socket)
+	if len(frames) != 1 {
+		t.Fatalf("Expected 1 frame but got %v", len(frames))
+	}
+	if frames[0].ID != 1 || frames[0].Priority != PRIORITY_CONSERVE_POWER {
+		t.Errorf("Expected background payload framed with id 1 at priority 5 but got %+v", frames[0])
+	}
+}
@@ -0,0 +1,165 @@
+package apns
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Struct representing the sound played for a notification
+// Marshals to the sound's name, or to a dictionary
+// for critical alerts which also carry a volume
+type Sound struct {
+	name     string
+	critical bool
+	volume   float64
+	set      bool
+}
+
+// Returns the name of the sound file, "default" for the system sound
+func (s *Sound) Name() string {
+	return s.name
+}
+
+// Returns whether this is a critical alert sound,
+// played even when the device is muted or in Focus
+func (s *Sound) IsCritical() bool {
+	return s.critical
+}
+
+// Returns the volume of a critical alert sound, between 0 and 1
+func (s *Sound) Volume() float64 {
+	return s.volume
+}
+
+// Returns whether or not this Sound
+// is set and should be sent in the APNS payload
+func (s *Sound) IsSet() bool {
+	return s.set
+}
+
+// Resets the Sound and
+// removes it from the APNS payload
+func (s *Sound) UnSet() {
+	*s = Sound{}
+}
+
+// Sets the sound and includes it in the payload to APNS
+func (s *Sound) Set(name string) error {
+	if name == "" {
+		return errors.New("Name must not be empty")
+	}
+
+	*s = NewSound(name)
+	return nil
+}
+
+// Sets a critical alert sound played at volume, between 0 and 1,
+// and includes it in the payload to APNS
+// Requires Apple's critical alerts entitlement
+func (s *Sound) SetCritical(name string, volume float64) error {
+	if name == "" {
+		return errors.New("Name must not be empty")
+	}
+	if !validSoundVolume(volume) {
+		return ErrInvalidSoundVolume
+	}
+
+	*s = NewCriticalSound(name, volume)
+	return nil
+}
+
+func validSoundVolume(volume float64) bool {
+	return volume >= 0 && volume <= 1
+}
+
+//Check a critical sound's volume before it's marshalled
+func (s *Sound) validate() error {
+	if s.critical && !validSoundVolume(s.volume) {
+		return ErrInvalidSoundVolume
+	}
+	return nil
+}
+
+func (s Sound) MarshalJSON() ([]byte, error) {
+	err := s.validate()
+	if err != nil {
+		return nil, err
+	}
+	return s.appendJSON(nil), nil
+}
+
+//Append the sound's name, or the critical alert dictionary with keys in sorted order
+func (s *Sound) appendJSON(dst []byte) []byte {
+	if !s.critical {
+		return appendJSONString(dst, s.name)
+	}
+
+	dst = append(dst, `{"critical":1,"name":`...)
+	dst = appendJSONString(dst, s.name)
+	dst = append(dst, `,"volume":`...)
+	dst = appendJSONFloat(dst, s.volume)
+	return append(dst, '}')
+}
+
+// An empty name (or null) unmarshals to an unset Sound
+func (s *Sound) UnmarshalJSON(data []byte) error {
+	var name string
+	if json.Unmarshal(data, &name) == nil {
+		s.setName(name)
+		return nil
+	}
+
+	var dictionary struct {
+		Critical int      `json:"critical"`
+		Name     string   `json:"name"`
+		Volume   *float64 `json:"volume"`
+	}
+	err := json.Unmarshal(data, &dictionary)
+	if err != nil {
+		return errors.New("Error unmarshalling Sound, should be a string or a sound dictionary")
+	}
+
+	if dictionary.Critical == 0 {
+		s.setName(dictionary.Name)
+		return nil
+	}
+	//Apple plays critical alerts at full volume unless told otherwise
+	volume := 1.0
+	if dictionary.Volume != nil {
+		volume = *dictionary.Volume
+	}
+	if !validSoundVolume(volume) {
+		return ErrInvalidSoundVolume
+	}
+	*s = NewCriticalSound(dictionary.Name, volume)
+	return nil
+}
+
+//Set the sound to name, or unset it if name is empty
+func (s *Sound) setName(name string) {
+	if name == "" {
+		s.UnSet()
+		return
+	}
+	*s = NewSound(name)
+}
+
+// Get a new sound, playing the named sound file
+// (or "default"), and included in the payload
+func NewSound(name string) Sound {
+	return Sound{
+		name: name,
+		set:  true,
+	}
+}
+
+// Get a new critical alert sound, playing the named sound
+// file at volume (between 0 and 1), and included in the payload
+func NewCriticalSound(name string, volume float64) Sound {
+	return Sound{
+		name:     name,
+		critical: true,
+		volume:   volume,
+		set:      true,
+	}
+}
@@ -0,0 +1,162 @@
+package apns
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestSoundDefaults(t *testing.T) {
+	s := Sound{}
+
+	if s.IsSet() {
+		t.Error("Sound should not be set by default")
+	}
+	if s.Name() != "" || s.IsCritical() || s.Volume() != 0 {
+		t.Errorf("Sound should be empty by default but got %+v", s)
+	}
+}
+
+func TestSoundSet(t *testing.T) {
+	s := Sound{}
+
+	err := s.Set("default")
+	if err != nil || !s.IsSet() || s.Name() != "default" || s.IsCritical() {
+		t.Errorf("Expected default sound to be set but got %+v %v", s, err)
+	}
+	if err := s.Set(""); err == nil || s.Name() != "default" {
+		t.Errorf("Expected error setting empty name but got %v", err)
+	}
+
+	s.UnSet()
+	if s.IsSet() || s.Name() != "" {
+		t.Error("UnSet should unset Sound")
+	}
+}
+
+func TestSoundSetCritical(t *testing.T) {
+	s := Sound{}
+
+	for _, volume := range []float64{0, 0.5, 1} {
+		err := s.SetCritical("alarm.aiff", volume)
+		if err != nil || !s.IsSet() || !s.IsCritical() || s.Name() != "alarm.aiff" || s.Volume() != volume {
+			t.Errorf("Expected critical sound at volume %v but got %+v %v", volume, s, err)
+		}
+	}
+
+	for _, volume := range []float64{-0.1, 1.1} {
+		if err := s.SetCritical("alarm.aiff", volume); !errors.Is(err, ErrInvalidSoundVolume) {
+			t.Errorf("Expected ErrInvalidSoundVolume for volume %v but got %v", volume, err)
+		}
+	}
+	if err := s.SetCritical("", 0.5); err == nil {
+		t.Error("Expected error setting empty name")
+	}
+	if s.Volume() != 1 {
+		t.Errorf("Expected invalid sounds to be ignored but got %+v", s)
+	}
+
+	s.Set("default")
+	if s.IsCritical() || s.Volume() != 0 {
+		t.Errorf("Expected Set to clear critical but got %+v", s)
+	}
+}
+
+func TestSoundMarshalJSON(t *testing.T) {
+	tests := map[string]Sound{
+		`{"sound":"default"}`:                                       NewSound("default"),
+		`{"sound":"\u003cbell\u003e.aiff"}`:                         NewSound("<bell>.aiff"),
+		`{"sound":{"critical":1,"name":"alarm.aiff","volume":0.8}}`: NewCriticalSound("alarm.aiff", 0.8),
+		`{"sound":{"critical":1,"name":"default","volume":0}}`:      NewCriticalSound("default", 0),
+		`{"sound":{"critical":1,"name":"default","volume":1}}`:      NewCriticalSound("default", 1),
+	}
+
+	for expected, s := range tests {
+		jsonData, err := json.Marshal(map[string]Sound{"sound": s})
+		if err != nil || string(jsonData) != expected {
+			t.Errorf("Expected %v but got %s %v", expected, jsonData, err)
+		}
+	}
+
+	_, err := json.Marshal(NewCriticalSound("alarm.aiff", 2))
+	if !errors.Is(err, ErrInvalidSoundVolume) {
+		t.Errorf("Expected ErrInvalidSoundVolume but got %v", err)
+	}
+}
+
+func TestSoundUnmarshalJSON(t *testing.T) {
+	tests := map[string]Sound{
+		`"default"`:                                       NewSound("default"),
+		`{"name":"bell.aiff"}`:                            NewSound("bell.aiff"),
+		`{"critical":0,"name":"bell.aiff"}`:               NewSound("bell.aiff"),
+		`{"critical":1,"name":"alarm.aiff","volume":0.8}`: NewCriticalSound("alarm.aiff", 0.8),
+		`{"critical":1,"name":"alarm.aiff","volume":0}`:   NewCriticalSound("alarm.aiff", 0),
+		`{"critical":1,"name":"alarm.aiff"}`:              NewCriticalSound("alarm.aiff", 1),
+		`""`:                                              {},
+		`{"name":""}`:                                     {},
+		`null`:                                            {},
+	}
+
+	for jsonStr, expected := range tests {
+		var s Sound
+		err := json.Unmarshal([]byte(jsonStr), &s)
+		if err != nil || s != expected {
+			t.Errorf("Expected %+v from %v but got %+v %v", expected, jsonStr, s, err)
+		}
+	}
+
+	for _, jsonStr := range []string{`1`, `{"critical":1,"name":"alarm.aiff","volume":1.5}`, `["a"]`} {
+		var s Sound
+		if err := json.Unmarshal([]byte(jsonStr), &s); err == nil {
+			t.Errorf("Expected error unmarshalling %v but got %+v", jsonStr, s)
+		}
+	}
+}
+
+func TestSoundShouldRoundTrip(t *testing.T) {
+	for _, s := range []Sound{NewSound("default"), NewCriticalSound("alarm.aiff", 0.25)} {
+		jsonData, _ := json.Marshal(s)
+		var unmarshalled Sound
+		err := json.Unmarshal(jsonData, &unmarshalled)
+		if err != nil || unmarshalled != s {
+			t.Errorf("Expected %+v but got %+v %v", s, unmarshalled, err)
+		}
+	}
+}
+
+func TestPayloadShouldMarshalSound(t *testing.T) {
+	tests := []struct {
+		payload  Payload
+		expected string
+	}{
+		{Payload{AlertText: "Testing"}, `{"aps":{"alert":"Testing"}}`},
+		{Payload{AlertText: "Testing", Sound: NewSound("bell.aiff")},
+			`{"aps":{"alert":"Testing","sound":"bell.aiff"}}`},
+		{Payload{AlertText: "Testing", Sound: NewCriticalSound("alarm.aiff", 0.8)},
+			`{"aps":{"alert":"Testing","sound":{"critical":1,"name":"alarm.aiff","volume":0.8}}}`},
+		{Payload{AlertBody: APSAlertBody{Body: "Testing", Title: "Title"}, Sound: NewSound("bell.aiff")},
+			`{"aps":{"alert":{"body":"Testing","title":"Title"},"sound":"bell.aiff"}}`},
+		{Payload{AlertBody: APSAlertBody{Body: "Testing", Title: "Title"}, Sound: NewCriticalSound("default", 1),
+			ThreadID: "thread"},
+			`{"aps":{"alert":{"body":"Testing","title":"Title"},"sound":{"critical":1,"name":"default","volume":1},"thread-id":"thread"}}`},
+	}
+
+	for _, test := range tests {
+		jsonStr, err := test.payload.Marshal(256)
+		if err != nil || string(jsonStr) != test.expected {
+			t.Errorf("Expected %v but got %s %v", test.expected, jsonStr, err)
+		}
+	}
+}
+
+func TestPayloadShouldRejectInvalidSoundVolume(t *testing.T) {
+	for _, p := range []Payload{
+		{AlertText: "Testing", Sound: NewCriticalSound("alarm.aiff", 1.5)},
+		{AlertBody: APSAlertBody{Body: "Testing"}, Sound: NewCriticalSound("alarm.aiff", -1)},
+	} {
+		_, err := p.Marshal(256)
+		if !errors.Is(err, ErrInvalidSoundVolume) {
+			t.Errorf("Expected ErrInvalidSoundVolume but got %v", err)
+		}
+	}
+}
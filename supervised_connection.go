@@ -0,0 +1,318 @@
+package apns
+
+import (
+	"container/list"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//Config for creating a SupervisedAPNSConnection
+type SupervisedAPNSConfig struct {
+	//config used to dial each connection : required unless Dial is supplied
+	APNSConfig *APNSConfig
+	//number of milliseconds to wait before redialing, defaults to 100
+	InitialBackoff int
+	//max number of milliseconds to wait between redials, defaults to 30000
+	MaxBackoff int
+	//factor the wait grows by after each unsuccessful connection, defaults to 2
+	BackoffMultiplier float64
+	//fraction of each wait that is randomized (0 - 1), defaults to 0 (no jitter)
+	BackoffJitter float64
+	//number of milliseconds a connection has to stay open for the wait
+	//to start from InitialBackoff again, defaults to 10000
+	StableConnectionTime int
+	//called (from the supervisor go-routine) with each payload Apple rejected
+	ErrorPayloadCallback func(*Payload, *AppleError)
+	//called (from a drain go-routine) with each payload sent on SendChannel
+	//after Disconnect, which is discarded instead of being sent
+	UnsentPayloadCallback func(*Payload)
+	//called (from the supervisor go-routine) with the error from each failed dial
+	//before waiting to redial, failures are also logged to APNSConfig's Logger
+	DialErrorCallback func(error)
+	//creates each connection, defaults to calling NewAPNSConnection with APNSConfig
+	Dial func() (*APNSConnection, error)
+}
+
+//APNS Connection that redials whenever the underlying connection closes
+//and replays any unsent payloads on the new connection
+type SupervisedAPNSConnection struct {
+	//Channel to send payloads on, survives connection closes
+	SendChannel chan *Payload
+	//config
+	config *SupervisedAPNSConfig
+	//logger filtered to APNSConfig.LogLevel
+	logger Logger
+	//wait between redials
+	backoff *backoff
+	//time the current connection was dialed
+	connectedAt time.Time
+	//payloads received but not yet handed to a connection, in send order
+	pendingPayloads *list.List
+	//closed to ask the supervisor go-routine to stop
+	stopChannel chan bool
+	//closed when the supervisor go-routine has stopped
+	doneChannel chan bool
+	//guards against stopping twice
+	stopOnce *sync.Once
+}
+
+//Exponential backoff with jitter
+type backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     float64
+	//wait returned by the next call to Next (before jitter)
+	current time.Duration
+}
+
+// Apply config defaults to given SupervisedAPNSConfig
+func applySupervisedConfigDefaults(config *SupervisedAPNSConfig) error {
+	errorStrs := ""
+
+	if config.APNSConfig == nil && config.Dial == nil {
+		errorStrs += "Invalid APNSConfig. Required when Dial isn't supplied\n"
+	}
+	if config.InitialBackoff < 0 || config.MaxBackoff < 0 {
+		errorStrs += "Invalid InitialBackoff/MaxBackoff. Should be >= 0\n"
+	}
+	if config.StableConnectionTime < 0 {
+		errorStrs += "Invalid StableConnectionTime. Should be >= 0\n"
+	}
+	if config.BackoffMultiplier != 0 && config.BackoffMultiplier < 1 {
+		errorStrs += "Invalid BackoffMultiplier. Should be >= 1\n"
+	}
+	if config.BackoffJitter < 0 || config.BackoffJitter > 1 {
+		errorStrs += "Invalid BackoffJitter. Should be between 0 and 1\n"
+	}
+
+	if errorStrs != "" {
+		return errors.New(errorStrs)
+	}
+
+	if config.InitialBackoff == 0 {
+		config.InitialBackoff = 100
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = 30000
+	}
+	if config.MaxBackoff < config.InitialBackoff {
+		config.MaxBackoff = config.InitialBackoff
+	}
+	if config.BackoffMultiplier == 0 {
+		config.BackoffMultiplier = 2
+	}
+	if config.StableConnectionTime == 0 {
+		config.StableConnectionTime = 10000
+	}
+	if config.Dial == nil {
+		apnsConfig := config.APNSConfig
+		config.Dial = func() (*APNSConnection, error) {
+			return NewAPNSConnection(apnsConfig)
+		}
+	}
+	return nil
+}
+
+//Create a new supervised apns connection with supplied config
+//If invalid config an error will be returned
+//The first connection is dialed in the background, payloads sent before it
+//is established will wait on SendChannel
+func NewSupervisedAPNSConnection(config *SupervisedAPNSConfig) (*SupervisedAPNSConnection, error) {
+	err := applySupervisedConfigDefaults(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(SupervisedAPNSConnection)
+	s.config = config
+	s.logger = nopLogger{}
+	if config.APNSConfig != nil {
+		s.logger = newLevelLogger(config.APNSConfig.Logger, config.APNSConfig.LogLevel)
+	}
+	s.backoff = newBackoff(config.InitialBackoff, config.MaxBackoff, config.BackoffMultiplier, config.BackoffJitter)
+	s.pendingPayloads = list.New()
+	s.SendChannel = make(chan *Payload)
+	s.stopChannel = make(chan bool)
+	s.doneChannel = make(chan bool)
+	s.stopOnce = new(sync.Once)
+
+	go s.supervise()
+
+	return s, nil
+}
+
+//Disconnect from the Apns Gateway and stop redialing
+//Waits for pending payloads to be handed to the current connection and flushed
+//Returns any payloads that could not be sent before the connection was closed
+//Payloads sent on SendChannel afterwards are discarded so senders never block,
+//see UnsentPayloadCallback. Close SendChannel once nothing sends on it anymore
+//to stop discarding
+func (s *SupervisedAPNSConnection) Disconnect() *list.List {
+	s.stopOnce.Do(func() {
+		close(s.stopChannel)
+	})
+	<-s.doneChannel
+
+	return s.pendingPayloads
+}
+
+//go-routine to dial connections and feed them payloads until stopped
+func (s *SupervisedAPNSConnection) supervise() {
+	defer close(s.doneChannel)
+	//senders mustn't block once stopped
+	defer func() {
+		go s.drainListener()
+	}()
+
+	firstDial := true
+	for {
+		if !firstDial && !s.wait(s.backoff.Next()) {
+			return
+		}
+		firstDial = false
+
+		conn, err := s.config.Dial()
+		if err != nil {
+			s.logger.Log(LOG_WARN, "Supervised connection failed to dial, redialing", "error", err)
+			if s.config.DialErrorCallback != nil {
+				s.config.DialErrorCallback(err)
+			}
+			continue
+		}
+		s.connectedAt = time.Now()
+
+		if !s.serve(conn) {
+			return
+		}
+	}
+}
+
+//Wait for the given duration
+//Returns false if stopped while waiting
+func (s *SupervisedAPNSConnection) wait(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stopChannel:
+		return false
+	}
+}
+
+//Feed payloads to conn until it closes
+//Returns false if stopped
+func (s *SupervisedAPNSConnection) serve(conn *APNSConnection) bool {
+	for {
+		//only accept new payloads once replayed payloads have been handed off
+		var receiveChannel chan *Payload
+		var sendChannel chan *Payload
+		var nextPayload *Payload
+		if s.pendingPayloads.Len() > 0 {
+			nextPayload = s.pendingPayloads.Front().Value.(*Payload)
+			sendChannel = conn.SendChannel
+		} else {
+			receiveChannel = s.SendChannel
+		}
+
+		select {
+		case payload := <-receiveChannel:
+			s.pendingPayloads.PushBack(payload)
+		case sendChannel <- nextPayload:
+			s.pendingPayloads.Remove(s.pendingPayloads.Front())
+		case connectionClose := <-conn.CloseChannel:
+			s.handleClose(conn, connectionClose)
+			return true
+		case <-s.stopChannel:
+			s.drain(conn)
+			return false
+		}
+	}
+}
+
+//Hand any pending payloads to conn, then disconnect and wait for it to close
+func (s *SupervisedAPNSConnection) drain(conn *APNSConnection) {
+	for s.pendingPayloads.Len() > 0 {
+		select {
+		case conn.SendChannel <- s.pendingPayloads.Front().Value.(*Payload):
+			s.pendingPayloads.Remove(s.pendingPayloads.Front())
+		case connectionClose := <-conn.CloseChannel:
+			s.handleClose(conn, connectionClose)
+			return
+		}
+	}
+
+	conn.Disconnect()
+	s.handleClose(conn, <-conn.CloseChannel)
+}
+
+//Report the rejected payload and queue unsent payloads for replay
+func (s *SupervisedAPNSConnection) handleClose(conn *APNSConnection, connectionClose *ConnectionClose) {
+	//make sure the dead socket is released and collect anything
+	//handed to it after it closed
+	drainedPayloads := conn.release()
+
+	stableTime := time.Duration(s.config.StableConnectionTime) * time.Millisecond
+	if connectionClose.ErrorPayload != nil || time.Since(s.connectedAt) >= stableTime {
+		//apple processed up to the error payload or the connection stayed
+		//up long enough, so the connection was healthy
+		s.backoff.Reset()
+	}
+	if connectionClose.ErrorPayload != nil {
+		if s.config.ErrorPayloadCallback != nil {
+			s.config.ErrorPayloadCallback(connectionClose.ErrorPayload, connectionClose.Error)
+		}
+	}
+
+	//UnsentPayloads and drainedPayloads are in send order,
+	//replay them ahead of anything still pending
+	s.pendingPayloads.PushFrontList(drainedPayloads)
+	s.pendingPayloads.PushFrontList(connectionClose.UnsentPayloads)
+}
+
+//go-routine to discard payloads sent after Disconnect
+//Returns once SendChannel is closed
+func (s *SupervisedAPNSConnection) drainListener() {
+	for payload := range s.SendChannel {
+		if s.config.UnsentPayloadCallback != nil {
+			s.config.UnsentPayloadCallback(payload)
+		}
+	}
+}
+
+//Create a backoff with the given initial and max waits (in milliseconds)
+func newBackoff(initial int, max int, multiplier float64, jitter float64) *backoff {
+	b := &backoff{
+		initial:    time.Duration(initial) * time.Millisecond,
+		max:        time.Duration(max) * time.Millisecond,
+		multiplier: multiplier,
+		jitter:     jitter,
+	}
+	b.Reset()
+	return b
+}
+
+//Returns the next wait and grows the wait after it
+func (b *backoff) Next() time.Duration {
+	wait := b.current
+
+	b.current = time.Duration(float64(b.current) * b.multiplier)
+	if b.current > b.max {
+		b.current = b.max
+	}
+
+	if b.jitter > 0 {
+		//spread the wait evenly over +/- jitter
+		wait = time.Duration(float64(wait) * (1 + b.jitter*(2*rand.Float64()-1)))
+	}
+	return wait
+}
+
+//Start waiting from the initial wait again
+func (b *backoff) Reset() {
+	b.current = b.initial
+}
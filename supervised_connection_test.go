@@ -0,0 +1,418 @@
+package apns
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Token and id of a notification written to a mock socket
+type writtenNotification struct {
+	Token string
+	ID    uint32
+}
+
+//Split command 2 frames into the notifications they contain
+func readWrittenNotifications(b []byte) []writtenNotification {
+	notifications := []writtenNotification{}
+	for len(b) >= NOTIFICATION_HEADER_SIZE {
+		frameLength := int(binary.BigEndian.Uint32(b[1:5]))
+		items := b[NOTIFICATION_HEADER_SIZE : NOTIFICATION_HEADER_SIZE+frameLength]
+		b = b[NOTIFICATION_HEADER_SIZE+frameLength:]
+
+		notification := writtenNotification{}
+		for len(items) >= 3 {
+			itemLength := int(binary.BigEndian.Uint16(items[1:3]))
+			item := items[3 : 3+itemLength]
+			switch items[0] {
+			case 1:
+				notification.Token = hex.EncodeToString(item)
+			case 3:
+				notification.ID = binary.BigEndian.Uint32(item)
+			}
+			items = items[3+itemLength:]
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications
+}
+
+/**
+ * Mock socket that records written notifications and
+ * responds with an invalid token error for RejectToken
+ */
+type MockConnRejectToken struct {
+	RejectToken   string
+	Notifications chan writtenNotification
+	ErrorChannel  chan uint32
+	CloseChannel  chan bool
+	CloseOnce     *sync.Once
+}
+
+func newMockConnRejectToken(rejectToken string, notifications chan writtenNotification) MockConnRejectToken {
+	return MockConnRejectToken{
+		RejectToken:   rejectToken,
+		Notifications: notifications,
+		ErrorChannel:  make(chan uint32, 1),
+		CloseChannel:  make(chan bool),
+		CloseOnce:     new(sync.Once),
+	}
+}
+
+func (conn MockConnRejectToken) Read(b []byte) (n int, err error) {
+	select {
+	case errorId := <-conn.ErrorChannel:
+		b[0] = uint8(8) //command
+		b[1] = uint8(8) //invalid token
+		binary.BigEndian.PutUint32(b[2:], errorId)
+		return 6, nil
+	case <-conn.CloseChannel:
+		return 0, errors.New("Socket Closed")
+	}
+}
+func (conn MockConnRejectToken) Write(b []byte) (n int, err error) {
+	for _, notification := range readWrittenNotifications(b) {
+		if notification.Token == conn.RejectToken {
+			conn.ErrorChannel <- notification.ID
+			//apple ignores anything after the error
+			break
+		}
+		conn.Notifications <- notification
+	}
+	return len(b), nil
+}
+func (conn MockConnRejectToken) Close() error {
+	conn.CloseOnce.Do(func() { close(conn.CloseChannel) })
+	return nil
+}
+func (conn MockConnRejectToken) LocalAddr() net.Addr {
+	return nil
+}
+func (conn MockConnRejectToken) RemoteAddr() net.Addr {
+	return nil
+}
+func (conn MockConnRejectToken) SetDeadline(t time.Time) error {
+	return nil
+}
+func (conn MockConnRejectToken) SetReadDeadline(t time.Time) error {
+	return nil
+}
+func (conn MockConnRejectToken) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func testAPNSConfig() *APNSConfig {
+	return &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            10,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+	}
+}
+
+func TestSupervisedConnectionShouldReplayUnsentAfterAppleError(t *testing.T) {
+	tokens := []string{
+		"4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+		"4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8e",
+		"4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8d",
+		"4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8c",
+	}
+
+	notifications := make(chan writtenNotification, 100)
+	dials := 0
+	var rejectedPayload *Payload
+	var rejectedError *AppleError
+
+	s, err := NewSupervisedAPNSConnection(&SupervisedAPNSConfig{
+		InitialBackoff: 1,
+		Dial: func() (*APNSConnection, error) {
+			dials++
+			rejectToken := ""
+			if dials == 1 {
+				rejectToken = tokens[1]
+			}
+			return socketAPNSConnection(newMockConnRejectToken(rejectToken, notifications), testAPNSConfig()), nil
+		},
+		ErrorPayloadCallback: func(payload *Payload, appleError *AppleError) {
+			rejectedPayload = payload
+			rejectedError = appleError
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range tokens {
+		s.SendChannel <- &Payload{AlertText: "Testing", Token: token}
+	}
+
+	delivered := []string{}
+	for len(delivered) < 3 {
+		select {
+		case notification := <-notifications:
+			delivered = append(delivered, notification.Token)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for delivery, delivered %v", delivered)
+		}
+	}
+
+	unsent := s.Disconnect()
+
+	expected := []string{tokens[0], tokens[2], tokens[3]}
+	for i := range expected {
+		if delivered[i] != expected[i] {
+			t.Fatalf("Expected delivery order %v but got %v", expected, delivered)
+		}
+	}
+	if len(notifications) != 0 {
+		t.Errorf("Expected no duplicate deliveries but got %v more", len(notifications))
+	}
+	if rejectedPayload == nil || rejectedPayload.Token != tokens[1] || rejectedError.ErrorCode != 8 {
+		t.Errorf("Expected rejected payload callback for %v but got %v %v", tokens[1], rejectedPayload, rejectedError)
+	}
+	if dials != 2 {
+		t.Errorf("Expected 2 dials but got %v", dials)
+	}
+	if unsent.Len() != 0 {
+		t.Errorf("Expected no unsent payloads but got %v", unsent.Len())
+	}
+}
+
+func TestSupervisedConnectionShouldBackoffBetweenFailedDials(t *testing.T) {
+	notifications := make(chan writtenNotification, 100)
+	dialTimes := []time.Time{}
+
+	s, err := NewSupervisedAPNSConnection(&SupervisedAPNSConfig{
+		InitialBackoff:    20,
+		MaxBackoff:        30,
+		BackoffMultiplier: 2,
+		Dial: func() (*APNSConnection, error) {
+			dialTimes = append(dialTimes, time.Now())
+			if len(dialTimes) < 4 {
+				return nil, errors.New("Connection refused")
+			}
+			return socketAPNSConnection(newMockConnRejectToken("", notifications), testAPNSConfig()), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f"
+	s.SendChannel <- &Payload{AlertText: "Testing", Token: token}
+
+	select {
+	case notification := <-notifications:
+		if notification.Token != token {
+			t.Errorf("Expected %v to be delivered but got %v", token, notification.Token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for delivery")
+	}
+	s.Disconnect()
+
+	//20ms, then 30ms (capped from 40ms), then 30ms
+	expectedWaits := []time.Duration{20, 30, 30}
+	for i, expected := range expectedWaits {
+		wait := dialTimes[i+1].Sub(dialTimes[i])
+		if wait < expected*time.Millisecond {
+			t.Errorf("Expected redial %v to wait at least %vms but waited %v", i+1, expected, wait)
+		}
+	}
+}
+
+func TestSupervisedConnectionShouldReportDialErrors(t *testing.T) {
+	dialErrors := make(chan error, 10)
+	dials := 0
+
+	s, err := NewSupervisedAPNSConnection(&SupervisedAPNSConfig{
+		InitialBackoff: 1,
+		Dial: func() (*APNSConnection, error) {
+			dials++
+			if dials < 3 {
+				return nil, fmt.Errorf("Connection refused %v", dials)
+			}
+			return socketAPNSConnection(newMockConnRejectToken("", nil), testAPNSConfig()), nil
+		},
+		DialErrorCallback: func(err error) {
+			dialErrors <- err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	for i := 1; i < 3; i++ {
+		select {
+		case err := <-dialErrors:
+			if err.Error() != fmt.Sprintf("Connection refused %v", i) {
+				t.Errorf("Expected dial error %v but got %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for dial error %v", i)
+		}
+	}
+}
+
+func TestSupervisedConnectionShouldRedialOnSocketClose(t *testing.T) {
+	notifications := make(chan writtenNotification, 100)
+	sockets := make(chan MockConnRejectToken, 10)
+
+	s, err := NewSupervisedAPNSConnection(&SupervisedAPNSConfig{
+		InitialBackoff: 1,
+		Dial: func() (*APNSConnection, error) {
+			socket := newMockConnRejectToken("", notifications)
+			sockets <- socket
+			return socketAPNSConnection(socket, testAPNSConfig()), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//drop the first socket out from under the connection and wait for the redial
+	(<-sockets).Close()
+	select {
+	case <-sockets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for redial")
+	}
+
+	token := "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f"
+	s.SendChannel <- &Payload{AlertText: "Testing", Token: token}
+
+	select {
+	case <-notifications:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for delivery")
+	}
+	s.Disconnect()
+
+	if len(sockets) != 0 {
+		t.Errorf("Expected exactly one redial but got %v", len(sockets)+1)
+	}
+}
+
+func TestSupervisedConnectionShouldResetBackoffAfterStableConnection(t *testing.T) {
+	notifications := make(chan writtenNotification, 100)
+	sockets := make(chan MockConnRejectToken, 10)
+	dials := 0
+
+	s, err := NewSupervisedAPNSConnection(&SupervisedAPNSConfig{
+		InitialBackoff:       20,
+		MaxBackoff:           10000,
+		BackoffMultiplier:    10,
+		StableConnectionTime: 50,
+		Dial: func() (*APNSConnection, error) {
+			dials++
+			if dials < 3 {
+				return nil, errors.New("Connection refused")
+			}
+			socket := newMockConnRejectToken("", notifications)
+			sockets <- socket
+			return socketAPNSConnection(socket, testAPNSConfig()), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	//waited 20ms then 200ms, the next wait would be 2s without a reset
+	socket := <-sockets
+	time.Sleep(100 * time.Millisecond)
+	socket.Close()
+	closedAt := time.Now()
+
+	select {
+	case <-sockets:
+		if wait := time.Since(closedAt); wait > time.Second {
+			t.Errorf("Expected backoff to be reset but redial waited %v", wait)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for redial")
+	}
+}
+
+func TestSupervisedConnectionShouldDiscardSendsAfterDisconnect(t *testing.T) {
+	discarded := make(chan *Payload, 1)
+	s, err := NewSupervisedAPNSConnection(&SupervisedAPNSConfig{
+		Dial: func() (*APNSConnection, error) {
+			return socketAPNSConnection(newMockConnRejectToken("", make(chan writtenNotification, 100)), testAPNSConfig()), nil
+		},
+		UnsentPayloadCallback: func(payload *Payload) {
+			discarded <- payload
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Disconnect()
+
+	late := &Payload{AlertText: "Testing", Token: testToken(1)}
+	select {
+	case s.SendChannel <- late:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out sending after Disconnect")
+	}
+	if payload := <-discarded; payload != late {
+		t.Errorf("Expected late payload to be discarded but got %v", payload)
+	}
+	close(s.SendChannel)
+}
+
+func TestSupervisedConnectionDisconnectShouldBeSafeToRepeat(t *testing.T) {
+	s, err := NewSupervisedAPNSConnection(&SupervisedAPNSConfig{
+		Dial: func() (*APNSConnection, error) {
+			return nil, errors.New("Connection refused")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Disconnect()
+	if s.Disconnect().Len() != 0 {
+		t.Error("Expected no unsent payloads")
+	}
+}
+
+func TestBackoffShouldGrowToMaxWithJitter(t *testing.T) {
+	b := newBackoff(100, 1000, 3, 0.5)
+
+	expected := []time.Duration{100, 300, 900, 1000, 1000}
+	for _, base := range expected {
+		wait := b.Next()
+		base = base * time.Millisecond
+		if wait < base/2 || wait > base*3/2 {
+			t.Errorf("Expected wait within 50%% of %v but was %v", base, wait)
+		}
+	}
+
+	b.Reset()
+	if wait := b.Next(); wait < 50*time.Millisecond || wait > 150*time.Millisecond {
+		t.Errorf("Expected wait to reset to ~100ms but was %v", wait)
+	}
+}
+
+func TestSupervisedConfigShouldValidate(t *testing.T) {
+	configs := []*SupervisedAPNSConfig{
+		{},
+		{APNSConfig: &APNSConfig{}, BackoffJitter: 2},
+		{APNSConfig: &APNSConfig{}, BackoffMultiplier: 0.5},
+		{APNSConfig: &APNSConfig{}, InitialBackoff: -1},
+		{APNSConfig: &APNSConfig{}, StableConnectionTime: -1},
+	}
+
+	for _, config := range configs {
+		if _, err := NewSupervisedAPNSConnection(config); err == nil {
+			t.Errorf("Expected config error for %+v", config)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"sync"
+	"time"
+)
+
+//Cached ES256 JWT provider token used to authenticate with the provider API
+type providerToken struct {
+	//signing key parsed from the .p8 file
+	signingKey *ecdsa.PrivateKey
+	//Key ID of the signing key (kid header)
+	keyID string
+	//Team ID that owns the signing key (iss claim)
+	teamID string
+	//how long a token is reused before a new one is signed
+	refreshInterval time.Duration
+	//Mutex to sync access to the cached token
+	lock *sync.Mutex
+	//cached signed token
+	token string
+	//time the cached token was issued
+	issuedAt time.Time
+	//set when Apple rejected the cached token as expired
+	expired bool
+	//clock, replaceable for testing
+	now func() time.Time
+}
+
+const (
+	//Shortest time Apple allows between provider token refreshes
+	PROVIDER_TOKEN_MIN_REFRESH_MINUTES = 20
+	//Longest time Apple will accept a provider token for
+	PROVIDER_TOKEN_MAX_REFRESH_MINUTES = 60
+)
+
+//Create a provider token signer from the contents of a .p8 file
+func newProviderToken(authKeyBytes []byte, keyID string, teamID string, refreshInterval time.Duration) (*providerToken, error) {
+	signingKey, err := parseAuthKey(authKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &providerToken{
+		signingKey:      signingKey,
+		keyID:           keyID,
+		teamID:          teamID,
+		refreshInterval: refreshInterval,
+		lock:            new(sync.Mutex),
+		now:             time.Now,
+	}, nil
+}
+
+//Parse the PKCS#8 P-256 key contained in a .p8 file
+func parseAuthKey(authKeyBytes []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(authKeyBytes)
+	if block == nil {
+		return nil, errors.New("Invalid auth key, should be the PEM contents of a .p8 file")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signingKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || signingKey.Curve != elliptic.P256() {
+		return nil, errors.New("Invalid auth key, should be a P-256 ECDSA key")
+	}
+
+	return signingKey, nil
+}
+
+//Returns the current provider token, signing a new one if the cached
+//token is missing or older than the refresh interval, or was rejected
+//by Apple and is old enough to be replaced
+//THREADSAFE
+func (t *providerToken) Bearer() (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	age := now.Sub(t.issuedAt)
+	if t.token != "" && age < t.refreshInterval &&
+		(!t.expired || age < PROVIDER_TOKEN_MIN_REFRESH_MINUTES*time.Minute) {
+		return t.token, nil
+	}
+
+	token, err := t.sign(now)
+	if err != nil {
+		return "", err
+	}
+
+	t.token = token
+	t.issuedAt = now
+	t.expired = false
+	return token, nil
+}
+
+//Mark the cached token as rejected by Apple, it's replaced by the next Bearer
+//call made once it's PROVIDER_TOKEN_MIN_REFRESH_MINUTES old
+//Apple answers refreshes more often than that with TooManyProviderTokenUpdates
+//THREADSAFE
+func (t *providerToken) Expire() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.expired = true
+}
+
+//Build and sign a JWT issued at issuedAt
+func (t *providerToken) sign(issuedAt time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "ES256",
+		"kid": t.keyID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": t.teamID,
+		"iat": issuedAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, t.signingKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	//JWS wants the raw 32 byte r and s values, not ASN.1
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
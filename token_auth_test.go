@@ -0,0 +1,226 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Generate a P-256 signing key and its .p8 pem encoding
+func generateTestAuthKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+//Verify token was signed by key and return its decoded header and claims
+func verifyTestToken(t *testing.T, token string, key *ecdsa.PrivateKey) (map[string]interface{}, map[string]interface{}) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 token segments but got %v", len(parts))
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		t.Fatalf("Expected 64 byte signature but got %v (%v)", len(signature), err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Fatal("Token signature did not verify")
+	}
+
+	segments := make([]map[string]interface{}, 2)
+	for i := range segments {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(data, &segments[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return segments[0], segments[1]
+}
+
+func TestProviderTokenShouldSignES256(t *testing.T) {
+	key, p8 := generateTestAuthKey(t)
+	issuedAt := time.Unix(1500000000, 0)
+
+	token, err := newProviderToken(p8, "ABC123DEFG", "DEF123GHIJ", 50*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.now = func() time.Time { return issuedAt }
+
+	bearer, err := token.Bearer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, claims := verifyTestToken(t, bearer, key)
+	if header["alg"] != "ES256" || header["kid"] != "ABC123DEFG" {
+		t.Errorf("Unexpected token header %v", header)
+	}
+	if claims["iss"] != "DEF123GHIJ" || claims["iat"] != float64(issuedAt.Unix()) {
+		t.Errorf("Unexpected token claims %v", claims)
+	}
+}
+
+func TestProviderTokenShouldCacheUntilRefreshInterval(t *testing.T) {
+	key, p8 := generateTestAuthKey(t)
+	now := time.Unix(1500000000, 0)
+
+	token, err := newProviderToken(p8, "ABC123DEFG", "DEF123GHIJ", 50*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.now = func() time.Time { return now }
+
+	first, _ := token.Bearer()
+
+	now = now.Add(49 * time.Minute)
+	second, _ := token.Bearer()
+	if first != second {
+		t.Error("Expected token to be reused within refresh interval")
+	}
+
+	now = now.Add(time.Minute)
+	third, _ := token.Bearer()
+	if third == second {
+		t.Error("Expected token to be refreshed after refresh interval")
+	}
+	_, claims := verifyTestToken(t, third, key)
+	if claims["iat"] != float64(now.Unix()) {
+		t.Errorf("Expected refreshed token to be issued at %v but was %v", now.Unix(), claims["iat"])
+	}
+
+	token.Expire()
+	now = now.Add(19 * time.Minute)
+	fourth, _ := token.Bearer()
+	if fourth != third {
+		t.Error("Expected expired token to be reused until it's 20 minutes old")
+	}
+
+	now = now.Add(time.Minute)
+	fifth, _ := token.Bearer()
+	if fifth == fourth {
+		t.Error("Expected expired token to be re-signed once it's 20 minutes old")
+	}
+
+	now = now.Add(20 * time.Minute)
+	sixth, _ := token.Bearer()
+	if sixth != fifth {
+		t.Error("Expected re-signed token to be reused within refresh interval")
+	}
+}
+
+func TestProviderTokenShouldRejectInvalidKeys(t *testing.T) {
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(p384Key)
+
+	invalidKeys := [][]byte{
+		[]byte("not a pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("garbage")}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+	}
+
+	for _, p8 := range invalidKeys {
+		if _, err := parseAuthKey(p8); err == nil {
+			t.Errorf("Expected error parsing auth key %q", p8)
+		}
+	}
+}
+
+func TestHTTP2ConfigShouldValidateTokenAuth(t *testing.T) {
+	_, p8 := generateTestAuthKey(t)
+
+	configs := []*APNSHTTP2Config{
+		{AuthKeyBytes: p8, KeyID: "ABC123DEFG"},
+		{AuthKeyBytes: p8, TeamID: "DEF123GHIJ"},
+		{AuthKeyBytes: p8, KeyID: "ABC123DEFG", TeamID: "DEF123GHIJ", TokenRefreshInterval: 61},
+		{AuthKeyBytes: p8, KeyID: "ABC123DEFG", TeamID: "DEF123GHIJ", TokenRefreshInterval: 19},
+	}
+
+	for _, config := range configs {
+		if _, err := NewAPNSHTTP2Client(config); err == nil {
+			t.Errorf("Expected config error for %+v", config)
+		}
+	}
+}
+
+func TestHTTP2ClientShouldSendProviderToken(t *testing.T) {
+	key, p8 := generateTestAuthKey(t)
+
+	authorizations := []string{}
+	config, server := newTestHTTP2Server(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("authorization"))
+		if len(authorizations) == 1 {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("{\"reason\":\"ExpiredProviderToken\"}"))
+		}
+	})
+	defer server.Close()
+
+	config.AuthKeyBytes = p8
+	config.KeyID = "ABC123DEFG"
+	config.TeamID = "DEF123GHIJ"
+	client, err := NewAPNSHTTP2Client(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	now := time.Now()
+	client.token.now = func() time.Time { return now }
+
+	payload := &Payload{
+		AlertText: "Testing",
+		Token:     "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+	}
+
+	response := client.Push(payload)
+	if response.Reason != "ExpiredProviderToken" {
+		t.Fatalf("Expected ExpiredProviderToken rejection but received %+v", response)
+	}
+	//a token younger than 20 minutes isn't replaced
+	now = now.Add(time.Minute)
+	response = client.Push(payload)
+	if !response.Accepted() {
+		t.Fatalf("Expected payload to be accepted but received %+v", response)
+	}
+	now = now.Add(PROVIDER_TOKEN_MIN_REFRESH_MINUTES * time.Minute)
+	response = client.Push(payload)
+	if !response.Accepted() {
+		t.Fatalf("Expected payload to be accepted but received %+v", response)
+	}
+
+	for _, authorization := range authorizations {
+		if !strings.HasPrefix(authorization, "bearer ") {
+			t.Fatalf("Expected bearer authorization but got %q", authorization)
+		}
+		verifyTestToken(t, strings.TrimPrefix(authorization, "bearer "), key)
+	}
+	if authorizations[0] != authorizations[1] {
+		t.Error("Expected provider token to be kept until it's 20 minutes old")
+	}
+	if authorizations[1] == authorizations[2] {
+		t.Error("Expected a new provider token after ExpiredProviderToken once it's 20 minutes old")
+	}
+}
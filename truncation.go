@@ -0,0 +1,255 @@
+package apns
+
+import (
+	"fmt"
+	"slices"
+)
+
+//A field of a payload that can give up space when the payload is too large
+type TruncationField int
+
+const (
+	//AlertText, or AlertBody.Body
+	TRUNCATE_BODY TruncationField = iota
+	//AlertBody.Title
+	TRUNCATE_TITLE
+	//Each of AlertBody.LocArgs, last argument first
+	TRUNCATE_LOC_ARGS
+	//Each of AlertBody.TitleLocArgs, last argument first
+	TRUNCATE_TITLE_LOC_ARGS
+	//The custom field named by TruncationStep.CustomField, dropped rather than shortened
+	//Only if TruncationPolicy.DropCustomFields is set
+	TRUNCATE_CUSTOM_FIELD
+	//AlertBody.Subtitle
+	TRUNCATE_SUBTITLE
+	//Each of AlertBody.SubtitleLocArgs, last argument first
+	TRUNCATE_SUBTITLE_LOC_ARGS
+	//AlertBody.SummaryArg
+	TRUNCATE_SUMMARY_ARG
+)
+
+//One field for a TruncationPolicy to take space from
+type TruncationStep struct {
+	//field to shorten
+	Field TruncationField
+	//min number of characters (grapheme clusters) text is kept to, not counting the ellipsis
+	//text is never shortened to nothing unless there's an ellipsis to send instead
+	MinLength int
+	//custom field to drop for TRUNCATE_CUSTOM_FIELD
+	CustomField string
+}
+
+//How a payload that marshals to more than the max payload size is truncated
+//Text is cut between grapheme clusters so a character, emoji or flag is never split
+type TruncationPolicy struct {
+	//appended to truncated text, may be empty
+	//DefaultTruncationPolicy uses "...", "\u2026" saves 2 bytes where every byte counts
+	Ellipsis string
+	//fields that give up space, in order, until the payload fits
+	//each field is shortened only as much as needed, or to its MinLength before moving on
+	//defaults to shortening the body with no min length
+	Steps []TruncationStep
+	//whether TRUNCATE_CUSTOM_FIELD steps drop custom fields
+	//if false custom fields are kept and payloads that only fit without them fail
+	DropCustomFields bool
+}
+
+//What truncation changed to make a payload fit
+type TruncationResult struct {
+	//keys of the text fields that were shortened, in order: "alert" (AlertText),
+	//"body", "title", "subtitle", "loc-args", "title-loc-args", "subtitle-loc-args" or "summary-arg"
+	Shortened []string
+	//custom fields that were dropped, in order
+	DroppedCustomFields []string
+}
+
+//Policy used when none is configured
+var DefaultTruncationPolicy = &TruncationPolicy{Ellipsis: "..."}
+
+var defaultTruncationSteps = []TruncationStep{{Field: TRUNCATE_BODY}}
+
+//policy, or DefaultTruncationPolicy if nil
+func truncationPolicyOrDefault(policy *TruncationPolicy) *TruncationPolicy {
+	if policy == nil {
+		return DefaultTruncationPolicy
+	}
+	return policy
+}
+
+//Append p truncated to fit in maxPayloadSize according to policy to dst
+//jsonStr is p already appended to dst without truncation
+//p isn't changed, the shortened fields are marshalled from a copy
+func (e *payloadEncoder) appendTruncated(dst []byte, jsonStr []byte, p *Payload, maxPayloadSize int,
+	policy *TruncationPolicy) ([]byte, *TruncationResult, error) {
+	policy = truncationPolicyOrDefault(policy)
+	steps := policy.Steps
+	if steps == nil {
+		steps = defaultTruncationSteps
+	}
+
+	truncated := *p
+	result := new(TruncationResult)
+	for _, step := range steps {
+		overflow := len(jsonStr) - len(dst) - maxPayloadSize
+		if overflow <= 0 {
+			break
+		}
+
+		var key string
+		var changed bool
+		if step.Field == TRUNCATE_CUSTOM_FIELD {
+			key = step.CustomField
+			changed = policy.DropCustomFields && e.dropKey(key)
+		} else {
+			key, changed = truncated.shorten(step, overflow, policy.Ellipsis)
+		}
+		if !changed {
+			continue
+		}
+
+		var err error
+		jsonStr, err = e.appendPayload(dst, &truncated)
+		if err != nil {
+			return dst, nil, err
+		}
+		if step.Field == TRUNCATE_CUSTOM_FIELD {
+			result.DroppedCustomFields = append(result.DroppedCustomFields, key)
+		} else if !slices.Contains(result.Shortened, key) {
+			result.Shortened = append(result.Shortened, key)
+		}
+	}
+
+	if len(jsonStr)-len(dst) > maxPayloadSize {
+		if p.isSimple() {
+			return dst, nil, fmt.Errorf("%w to successfully marshall to less than %v", ErrPayloadTooLarge, maxPayloadSize)
+		}
+		return dst, nil, fmt.Errorf("%w to successfully marshall %v or less bytes", ErrPayloadTooLarge, maxPayloadSize)
+	}
+	return jsonStr, result, nil
+}
+
+//Shorten the text field for step to save overflow bytes once marshalled
+//Returns the field's json key and whether it changed
+func (p *Payload) shorten(step TruncationStep, overflow int, ellipsis string) (string, bool) {
+	var changed bool
+	switch step.Field {
+	case TRUNCATE_BODY:
+		if p.isSimple() {
+			p.AlertText, changed = shortenText(p.AlertText, overflow, step.MinLength, ellipsis)
+			return "alert", changed
+		}
+		p.AlertBody.Body, changed = shortenText(p.AlertBody.Body, overflow, step.MinLength, ellipsis)
+		return "body", changed
+	case TRUNCATE_TITLE:
+		if p.isSimple() {
+			//only sent with a body
+			return "title", false
+		}
+		p.AlertBody.Title, changed = shortenText(p.AlertBody.Title, overflow, step.MinLength, ellipsis)
+		return "title", changed
+	case TRUNCATE_LOC_ARGS:
+		if p.isSimple() {
+			return "loc-args", false
+		}
+		p.AlertBody.LocArgs, changed = shortenTexts(p.AlertBody.LocArgs, overflow, step.MinLength, ellipsis)
+		return "loc-args", changed
+	case TRUNCATE_TITLE_LOC_ARGS:
+		if p.isSimple() {
+			return "title-loc-args", false
+		}
+		p.AlertBody.TitleLocArgs, changed = shortenTexts(p.AlertBody.TitleLocArgs, overflow, step.MinLength, ellipsis)
+		return "title-loc-args", changed
+	case TRUNCATE_SUBTITLE:
+		if p.isSimple() {
+			return "subtitle", false
+		}
+		p.AlertBody.Subtitle, changed = shortenText(p.AlertBody.Subtitle, overflow, step.MinLength, ellipsis)
+		return "subtitle", changed
+	case TRUNCATE_SUBTITLE_LOC_ARGS:
+		if p.isSimple() {
+			return "subtitle-loc-args", false
+		}
+		p.AlertBody.SubtitleLocArgs, changed = shortenTexts(p.AlertBody.SubtitleLocArgs, overflow, step.MinLength, ellipsis)
+		return "subtitle-loc-args", changed
+	case TRUNCATE_SUMMARY_ARG:
+		if p.isSimple() {
+			return "summary-arg", false
+		}
+		p.AlertBody.SummaryArg, changed = shortenText(p.AlertBody.SummaryArg, overflow, step.MinLength, ellipsis)
+		return "summary-arg", changed
+	}
+	return "", false
+}
+
+//Remove the custom field key from the keys being marshalled
+func (e *payloadEncoder) dropKey(key string) bool {
+	i := slices.Index(e.keys, key)
+	if i < 0 || key == "aps" {
+		return false
+	}
+	e.keys = slices.Delete(e.keys, i, i+1)
+	return true
+}
+
+//Shorten s to save overflow bytes once escaped as json, keeping at least
+//minLength grapheme clusters and appending ellipsis
+//Returns s and false if it can't be made any shorter
+func shortenText(s string, overflow int, minLength int, ellipsis string) (string, bool) {
+	if ellipsis == "" && minLength < 1 {
+		minLength = 1
+	}
+	minEnd := 0
+	for i := 0; i < minLength && minEnd < len(s); i++ {
+		minEnd += graphemeLen(s[minEnd:])
+	}
+	if minEnd == len(s) {
+		return s, false
+	}
+
+	escapedLen := jsonStringLen(s)
+	ellipsisLen := jsonStringLen(ellipsis)
+	budget := escapedLen - overflow - ellipsisLen - jsonStringLen(s[:minEnd])
+	end := minEnd + len(truncateJSONString(s[minEnd:], budget))
+	if jsonStringLen(s[:end])+ellipsisLen >= escapedLen {
+		//the ellipsis takes as much room as it saves
+		return s, false
+	}
+	return s[:end] + ellipsis, true
+}
+
+//Shorten the strings in s, last first, until overflow bytes are saved
+//s is copied rather than changed
+func shortenTexts(s []string, overflow int, minLength int, ellipsis string) ([]string, bool) {
+	var shortened []string
+	for i := len(s) - 1; i >= 0 && overflow > 0; i-- {
+		text, changed := shortenText(s[i], overflow, minLength, ellipsis)
+		if !changed {
+			continue
+		}
+		if shortened == nil {
+			shortened = slices.Clone(s)
+		}
+		shortened[i] = text
+		overflow -= jsonStringLen(s[i]) - jsonStringLen(text)
+	}
+	if shortened == nil {
+		return s, false
+	}
+	return shortened, true
+}
+
+//Longest prefix of s, cut between grapheme clusters, taking no more than
+//budget bytes once escaped as json
+func truncateJSONString(s string, budget int) string {
+	end := 0
+	for end < len(s) {
+		n := graphemeLen(s[end:])
+		escapedLen := jsonStringLen(s[end : end+n])
+		if escapedLen > budget {
+			break
+		}
+		budget -= escapedLen
+		end += n
+	}
+	return s[:end]
+}
@@ -0,0 +1,303 @@
+package apns
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestGraphemeLenShouldKeepClustersTogether(t *testing.T) {
+	tests := map[string]string{
+		"CJK":              "日",
+		"combining accent": "e\u0301",
+		"emoji ZWJ family": "\U0001F468\u200d\U0001F469\u200d\U0001F467\u200d\U0001F466",
+		"emoji skin tone":  "\U0001F44D\U0001F3FD",
+		"emoji variation":  "❤\ufe0f",
+		"ZWJ rainbow flag": "\U0001F3F3\ufe0f\u200d\U0001F308",
+		"flag":             "\U0001F1EF\U0001F1F5",
+		"subdivision flag": "\U0001F3F4\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F",
+		"hangul jamo":      "\u1112\u1161\u11ab",
+		"hangul LV + T":    "\ud558\u11ab",
+		"CRLF":             "\r\n",
+		"invalid utf-8":    "\xff",
+		"spacing mark":     "\u0915\u093f",
+	}
+
+	for name, cluster := range tests {
+		//followed by something that starts a new cluster
+		for _, next := range []string{"a", "日", "\U0001F1FA\U0001F1F8", "\n"} {
+			if n := graphemeLen(cluster + next); n != len(cluster) {
+				t.Errorf("Expected %v cluster %q to be %v bytes followed by %q but got %v",
+					name, cluster, len(cluster), next, n)
+			}
+		}
+	}
+}
+
+func TestJSONStringLenShouldMatchAppendJSONString(t *testing.T) {
+	tests := []string{
+		"",
+		"plain text",
+		`quotes " and \ backslashes`,
+		"control \b\f\n\r\t\x00\x1f\x7f characters",
+		"html <b>&amp;</b>",
+		"unicode ☃ 日本語 \U0001F600",
+		"separators \u2028 \u2029",
+		"invalid \xff utf-8 \xe2\x82",
+	}
+
+	for _, s := range tests {
+		if n, expected := jsonStringLen(s), len(appendJSONString(nil, s))-2; n != expected {
+			t.Errorf("Expected %v bytes for %q but got %v", expected, s, n)
+		}
+	}
+}
+
+//Marshal a payload with the clusters as its alert text at every size
+//that needs truncating, checking the alert is cut between clusters, is valid
+//utf-8 and keeps as much text as fits
+func testTruncateClusters(t *testing.T, clusters []string, policy *TruncationPolicy, simple bool) {
+	alert := strings.Join(clusters, "")
+	payload := &Payload{Badge: NewBadgeNumber(1)}
+	if simple {
+		payload.AlertText = alert
+	} else {
+		payload.AlertBody = APSAlertBody{Body: alert, Title: "Title"}
+	}
+	ellipsis := truncationPolicyOrDefault(policy).Ellipsis
+
+	//the payload with a given alert, never truncated
+	fullSize := func(text string) int {
+		sized := *payload
+		if simple {
+			sized.AlertText = text
+		} else {
+			sized.AlertBody.Body = text
+		}
+		jsonStr, _ := sized.Marshal(1 << 20)
+		return len(jsonStr)
+	}
+
+	for maxSize := fullSize(alert) - 1; maxSize >= fullSize(clusters[0]+ellipsis); maxSize-- {
+		jsonStr, _, err := payload.MarshalWithPolicy(maxSize, policy)
+		if err != nil {
+			t.Fatalf("Expected %q to truncate to %v bytes but got %v", alert, maxSize, err)
+		}
+		if len(jsonStr) > maxSize || !utf8.Valid(jsonStr) {
+			t.Fatalf("Expected valid utf-8 of at most %v bytes but got %v bytes: %s", maxSize, len(jsonStr), jsonStr)
+		}
+
+		var decoded struct {
+			Aps struct {
+				Alert json.RawMessage `json:"alert"`
+			} `json:"aps"`
+		}
+		err = json.Unmarshal(jsonStr, &decoded)
+		if err != nil {
+			t.Fatalf("Expected valid json but got %v: %s", err, jsonStr)
+		}
+		var text string
+		if simple {
+			json.Unmarshal(decoded.Aps.Alert, &text)
+		} else {
+			var body APSAlertBody
+			json.Unmarshal(decoded.Aps.Alert, &body)
+			text = body.Body
+		}
+
+		if !strings.HasSuffix(text, ellipsis) {
+			t.Fatalf("Expected %q to end with %q", text, ellipsis)
+		}
+		text = strings.TrimSuffix(text, ellipsis)
+		kept := 0
+		for kept < len(clusters) && strings.HasPrefix(text, strings.Join(clusters[:kept+1], "")) {
+			kept++
+		}
+		if text != strings.Join(clusters[:kept], "") {
+			t.Fatalf("Expected %q to be cut between clusters of %q", text, alert)
+		}
+		if fullSize(text+clusters[kept]+ellipsis) <= maxSize {
+			t.Fatalf("Expected %q to keep %q at %v bytes", text, clusters[kept], maxSize)
+		}
+	}
+}
+
+func TestMarshalTruncateShouldNotSplitCJK(t *testing.T) {
+	clusters := strings.Split("通知のテキストが長すぎる場合は切り詰められます。한국어텍스트도", "")
+	testTruncateClusters(t, clusters, nil, true)
+	testTruncateClusters(t, clusters, &TruncationPolicy{Ellipsis: "…"}, false)
+}
+
+func TestMarshalTruncateShouldNotSplitEmojiSequences(t *testing.T) {
+	clusters := []string{
+		"G", "o", "a", "l", "!", " ",
+		"⚽\ufe0f",
+		"\U0001F468\u200d\U0001F469\u200d\U0001F467\u200d\U0001F466",
+		"\U0001F1EF\U0001F1F5",
+		"\U0001F44D\U0001F3FD",
+		"\U0001F3F3\ufe0f\u200d\U0001F308",
+		"e\u0301",
+		"\U0001F3F4\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F",
+		"\U0001F9D1\U0001F3FF\u200d\U0001F680",
+	}
+	testTruncateClusters(t, clusters, nil, true)
+	testTruncateClusters(t, clusters, &TruncationPolicy{Ellipsis: "…"}, false)
+	testTruncateClusters(t, clusters, &TruncationPolicy{}, true)
+}
+
+func TestMarshalTruncateShouldBudgetForEscapes(t *testing.T) {
+	clusters := strings.Split(`<a href="x">Tom & "Jerry"</a>`+"\n\t\\\x01\u2028", "")
+	testTruncateClusters(t, clusters, nil, true)
+	testTruncateClusters(t, clusters, &TruncationPolicy{Ellipsis: "<&>"}, false)
+}
+
+func TestMarshalTruncateShouldUseEllipsis(t *testing.T) {
+	p := Payload{AlertText: "Café ☕ ouvert 日本"}
+	policy := &TruncationPolicy{Ellipsis: "…"}
+
+	jsonStr, _, err := p.MarshalWithPolicy(32, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"aps":{"alert":"Café ☕…"}}`
+	if string(jsonStr) != expected {
+		t.Errorf("Expected %s but got %s", expected, jsonStr)
+	}
+
+	jsonStr, _, err = p.MarshalWithPolicy(32, &TruncationPolicy{})
+	expected = `{"aps":{"alert":"Café ☕ ou"}}`
+	if err != nil || string(jsonStr) != expected {
+		t.Errorf("Expected %s but got %s %v", expected, jsonStr, err)
+	}
+}
+
+func TestMarshalTruncateShouldFailWithoutRoomForText(t *testing.T) {
+	p := Payload{AlertText: "\U0001F468\u200d\U0001F469\u200d\U0001F467"}
+
+	//no room for the emoji, and no ellipsis to send instead
+	_, _, err := p.MarshalWithPolicy(30, &TruncationPolicy{})
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Expected ErrPayloadTooLarge but got %v", err)
+	}
+
+	jsonStr, _, err := p.MarshalWithPolicy(30, nil)
+	expected := `{"aps":{"alert":"..."}}`
+	if err != nil || string(jsonStr) != expected {
+		t.Errorf("Expected %s but got %s %v", expected, jsonStr, err)
+	}
+}
+
+func TestTruncationPolicyShouldShortenFieldsInOrder(t *testing.T) {
+	p := Payload{
+		AlertBody: APSAlertBody{
+			Body:    "The match between the home team and the away team has kicked off",
+			Title:   "Kick off at the stadium",
+			LocKey:  "GOAL",
+			LocArgs: []string{"Home team name", "Away team name"},
+		},
+	}
+	policy := &TruncationPolicy{
+		Ellipsis: "…",
+		Steps: []TruncationStep{
+			{Field: TRUNCATE_TITLE, MinLength: 8},
+			{Field: TRUNCATE_LOC_ARGS, MinLength: 4},
+			{Field: TRUNCATE_BODY, MinLength: 10},
+		},
+	}
+
+	//just the title
+	expected := `{"aps":{"alert":{"body":"The match between the home team and the away team has kicked off",` +
+		`"loc-key":"GOAL","loc-args":["Home team name","Away team name"],"title":"Kick off at t…"}}}`
+	jsonStr, result, err := p.MarshalWithPolicy(len(expected), policy)
+	if err != nil || string(jsonStr) != expected || !slices.Equal(result.Shortened, []string{"title"}) {
+		t.Errorf("Expected %s but got %s %+v %v", expected, jsonStr, result, err)
+	}
+
+	//the title down to its min length, then the last loc arg, then the first
+	expected = `{"aps":{"alert":{"body":"The match between the home team and the away team has kicked off",` +
+		`"loc-key":"GOAL","loc-args":["Home tea…","Away…"],"title":"Kick off…"}}}`
+	jsonStr, result, err = p.MarshalWithPolicy(len(expected), policy)
+	if err != nil || string(jsonStr) != expected || !slices.Equal(result.Shortened, []string{"title", "loc-args"}) {
+		t.Errorf("Expected %s but got %s %+v %v", expected, jsonStr, result, err)
+	}
+
+	//everything down to its min length
+	expected = `{"aps":{"alert":{"body":"The match …","loc-key":"GOAL","loc-args":["Home…","Away…"],"title":"Kick off…"}}}`
+	jsonStr, result, err = p.MarshalWithPolicy(len(expected), policy)
+	if err != nil || string(jsonStr) != expected ||
+		!slices.Equal(result.Shortened, []string{"title", "loc-args", "body"}) {
+		t.Errorf("Expected %s but got %s %+v %v", expected, jsonStr, result, err)
+	}
+
+	//no more room to give
+	_, _, err = p.MarshalWithPolicy(len(expected)-1, policy)
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Expected ErrPayloadTooLarge but got %v", err)
+	}
+
+	if p.AlertBody.Title != "Kick off at the stadium" || p.AlertBody.LocArgs[1] != "Away team name" {
+		t.Errorf("Expected payload to be left alone but got %+v", p.AlertBody)
+	}
+}
+
+func TestTruncationPolicyShouldDropCustomFields(t *testing.T) {
+	p := Payload{
+		AlertText: "Your order has shipped",
+		CustomFields: map[string]interface{}{
+			"order":   "A-1234",
+			"debug":   strings.Repeat("x", 100),
+			"tracing": strings.Repeat("y", 100),
+		},
+	}
+	policy := &TruncationPolicy{
+		Ellipsis: "...",
+		Steps: []TruncationStep{
+			{Field: TRUNCATE_CUSTOM_FIELD, CustomField: "missing"},
+			{Field: TRUNCATE_CUSTOM_FIELD, CustomField: "debug"},
+			{Field: TRUNCATE_CUSTOM_FIELD, CustomField: "tracing"},
+			{Field: TRUNCATE_BODY, MinLength: 4},
+		},
+		DropCustomFields: true,
+	}
+
+	jsonStr, result, err := p.MarshalWithPolicy(180, policy)
+	expected := `{"aps":{"alert":"Your order has shipped"},"order":"A-1234","tracing":"` + strings.Repeat("y", 100) + `"}`
+	if err != nil || string(jsonStr) != expected || len(result.Shortened) != 0 ||
+		!slices.Equal(result.DroppedCustomFields, []string{"debug"}) {
+		t.Errorf("Expected %s but got %s %+v %v", expected, jsonStr, result, err)
+	}
+
+	expected = `{"aps":{"alert":"Your order..."},"order":"A-1234"}`
+	jsonStr, result, err = p.MarshalWithPolicy(len(expected), policy)
+	if err != nil || string(jsonStr) != expected || !slices.Equal(result.Shortened, []string{"alert"}) ||
+		!slices.Equal(result.DroppedCustomFields, []string{"debug", "tracing"}) {
+		t.Errorf("Expected %s but got %s %+v %v", expected, jsonStr, result, err)
+	}
+
+	//custom fields are kept, so it can't fit
+	policy.DropCustomFields = false
+	_, _, err = p.MarshalWithPolicy(180, policy)
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Expected ErrPayloadTooLarge but got %v", err)
+	}
+	if len(p.CustomFields) != 3 {
+		t.Errorf("Expected custom fields to be left alone but got %v", p.CustomFields)
+	}
+}
+
+func TestTruncationPolicyShouldReportDefaultTruncation(t *testing.T) {
+	p := Payload{AlertText: strings.Repeat("a", 100)}
+
+	_, result, err := p.MarshalWithPolicy(50, nil)
+	if err != nil || !slices.Equal(result.Shortened, []string{"alert"}) || len(result.DroppedCustomFields) != 0 {
+		t.Errorf("Expected alert to be shortened but got %+v %v", result, err)
+	}
+
+	_, result, err = p.MarshalWithPolicy(200, nil)
+	if err != nil || result != nil {
+		t.Errorf("Expected no truncation but got %+v %v", result, err)
+	}
+}
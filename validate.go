@@ -0,0 +1,145 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+)
+
+//Problem with one field of a Payload, see Payload.Validate
+type FieldError struct {
+	//Name of the Payload field, e.g. "Token" or "AlertBody.LocArgs",
+	//empty when the problem is with the payload as a whole
+	Field string
+	//Why the field is invalid, one of the Err* values or the error from encoding/json
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	if e.Field == "" {
+		return e.Err.Error()
+	}
+	return e.Field + " : " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+//Check the payload for problems before it's sent on an APNSConnection
+//Returns every problem found, nil if the payload is valid
+//Payloads larger than maxPayloadSize are reported even though sending them
+//would try to truncate them
+//The binary gateway needs a Token of APNS_TOKEN_SIZE bytes and can't send Live Activities
+func (p *Payload) Validate(maxPayloadSize int) []*FieldError {
+	return p.validate(maxPayloadSize, true)
+}
+
+//Check the payload for problems before it's sent with an APNSHTTP2Client
+//Same as Validate except the Token can be any length, as the provider API
+//doesn't limit tokens to APNS_TOKEN_SIZE bytes, and Live Activities are allowed
+//(they still need token authentication)
+func (p *Payload) ValidateHTTP2(maxPayloadSize int) []*FieldError {
+	return p.validate(maxPayloadSize, false)
+}
+
+//Validate, only checking the token's size and rejecting Live Activities for the binary gateway
+func (p *Payload) validate(maxPayloadSize int, binary bool) []*FieldError {
+	var errs []*FieldError
+	add := func(field string, err error) {
+		errs = append(errs, &FieldError{Field: field, Err: err})
+	}
+
+	if binary {
+		var token [APNS_TOKEN_SIZE]byte
+		if err := decodeToken(&token, p.Token); err != nil {
+			add("Token", err)
+		}
+	} else if !validHTTP2Token(p.Token) {
+		add("Token", ErrInvalidTokenEncoding)
+	}
+	if p.Priority != 0 && p.Priority != PRIORITY_IMMEDIATE && p.Priority != PRIORITY_CONSERVE_POWER {
+		add("Priority", ErrInvalidPriority)
+	}
+	if _, ok := p.CustomFields["aps"]; ok {
+		add("CustomFields", ErrApsCustomField)
+	}
+
+	a := &p.AlertBody
+	if len(a.LocArgs) > 0 && a.LocKey == "" {
+		add("AlertBody.LocArgs", ErrLocArgsWithoutLocKey)
+	}
+	if len(a.TitleLocArgs) > 0 && a.TitleLocKey == "" {
+		add("AlertBody.TitleLocArgs", ErrLocArgsWithoutLocKey)
+	}
+	if len(a.SubtitleLocArgs) > 0 && a.SubtitleLocKey == "" {
+		add("AlertBody.SubtitleLocArgs", ErrLocArgsWithoutLocKey)
+	}
+	if p.isSimple() {
+		//only the body decides whether the alert dictionary is sent
+		ignored := []struct {
+			field string
+			set   bool
+		}{
+			{"AlertBody.ActionLocKey", a.ActionLocKey != ""},
+			{"AlertBody.LocKey", a.LocKey != ""},
+			{"AlertBody.LocArgs", len(a.LocArgs) > 0},
+			{"AlertBody.LaunchImage", a.LaunchImage != ""},
+			{"AlertBody.Title", a.Title != ""},
+			{"AlertBody.TitleLocKey", a.TitleLocKey != ""},
+			{"AlertBody.TitleLocArgs", len(a.TitleLocArgs) > 0},
+			{"AlertBody.Subtitle", a.Subtitle != ""},
+			{"AlertBody.SubtitleLocKey", a.SubtitleLocKey != ""},
+			{"AlertBody.SubtitleLocArgs", len(a.SubtitleLocArgs) > 0},
+			{"AlertBody.SummaryArg", a.SummaryArg != ""},
+			{"AlertBody.SummaryArgCount", a.SummaryArgCount != 0},
+		}
+		for _, field := range ignored {
+			if field.set {
+				add(field.field, ErrAlertBodyWithSimpleAlert)
+			}
+		}
+	}
+
+	if err := p.Sound.validate(); err != nil {
+		add("Sound", err)
+	}
+	if err := p.RelevanceScore.validate(); err != nil {
+		add("RelevanceScore", err)
+	}
+	if err := p.validateBackground(); err != nil {
+		add("Background", err)
+	}
+	if p.LiveActivity != nil {
+		if binary {
+			add("LiveActivity", ErrLiveActivityUnsupported)
+		}
+		if err := p.LiveActivity.validate(); err != nil {
+			add("LiveActivity", err)
+		}
+	}
+
+	size, err := p.untruncatedSize()
+	switch {
+	case errors.Is(err, ErrApsCustomField):
+		//already reported
+	case err != nil:
+		add("", err)
+	case size > maxPayloadSize:
+		add("", fmt.Errorf("%w. Was %v bytes but max is %v bytes", ErrPayloadTooLarge, size, maxPayloadSize))
+	}
+
+	return errs
+}
+
+//Number of bytes in the payload's json before any truncation
+func (p *Payload) untruncatedSize() (int, error) {
+	e := payloadEncoderPool.Get().(*payloadEncoder)
+	defer payloadEncoderPool.Put(e)
+
+	err := e.sortKeys(p)
+	if err != nil {
+		return 0, err
+	}
+	jsonStr, err := e.appendPayload(nil, p)
+	return len(jsonStr), err
+}
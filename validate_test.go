@@ -0,0 +1,173 @@
+package apns
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateShouldAcceptValidPayload(t *testing.T) {
+	p := Payload{
+		AlertBody: APSAlertBody{
+			Body:         "Testing",
+			LocKey:       "GAME_PLAY_REQUEST_FORMAT",
+			LocArgs:      []string{"Jenna", "Frank"},
+			Title:        "Title",
+			TitleLocKey:  "TITLE_FORMAT",
+			TitleLocArgs: []string{"Jenna"},
+		},
+		CustomFields: map[string]interface{}{"game": 1},
+		Priority:     PRIORITY_IMMEDIATE,
+		Token:        testToken(1),
+	}
+
+	if errs := p.Validate(256); errs != nil {
+		t.Errorf("Expected no errors but got %v", errs)
+	}
+}
+
+func TestValidateShouldReportEachField(t *testing.T) {
+	cases := []struct {
+		payload  Payload
+		field    string
+		expected error
+	}{
+		{Payload{AlertText: "Testing", Token: "not hex"}, "Token", ErrInvalidTokenEncoding},
+		{Payload{AlertText: "Testing", Token: "abcd"}, "Token", ErrInvalidTokenSize},
+		{Payload{AlertText: "Testing", Token: testToken(1), Priority: 7}, "Priority", ErrInvalidPriority},
+		{Payload{AlertText: "Testing", Token: testToken(1),
+			CustomFields: map[string]interface{}{"aps": 1}}, "CustomFields", ErrApsCustomField},
+		{Payload{Token: testToken(1),
+			AlertBody: APSAlertBody{Body: "Testing", LocArgs: []string{"a"}}}, "AlertBody.LocArgs", ErrLocArgsWithoutLocKey},
+		{Payload{Token: testToken(1),
+			AlertBody: APSAlertBody{Body: "Testing", TitleLocArgs: []string{"a"}}}, "AlertBody.TitleLocArgs", ErrLocArgsWithoutLocKey},
+		{Payload{Token: testToken(1),
+			AlertBody: APSAlertBody{Body: "Testing", SubtitleLocArgs: []string{"a"}}}, "AlertBody.SubtitleLocArgs", ErrLocArgsWithoutLocKey},
+		{Payload{AlertText: "Testing", Token: testToken(1),
+			AlertBody: APSAlertBody{Title: "Title"}}, "AlertBody.Title", ErrAlertBodyWithSimpleAlert},
+		{Payload{AlertText: "Testing", Token: testToken(1),
+			AlertBody: APSAlertBody{SubtitleLocKey: "SUBTITLE"}}, "AlertBody.SubtitleLocKey", ErrAlertBodyWithSimpleAlert},
+		{Payload{AlertText: "Testing", Token: testToken(1),
+			AlertBody: APSAlertBody{LocKey: "GAME_PLAY_REQUEST_FORMAT"}}, "AlertBody.LocKey", ErrAlertBodyWithSimpleAlert},
+		{Payload{AlertText: "Testing", Token: testToken(1),
+			AlertBody: APSAlertBody{ActionLocKey: "PLAY"}}, "AlertBody.ActionLocKey", ErrAlertBodyWithSimpleAlert},
+		{Payload{AlertText: "Testing", Token: testToken(1),
+			AlertBody: APSAlertBody{LaunchImage: "launch.png"}}, "AlertBody.LaunchImage", ErrAlertBodyWithSimpleAlert},
+		{Payload{AlertText: "Testing", Token: testToken(1),
+			AlertBody: APSAlertBody{SummaryArg: "Jenna"}}, "AlertBody.SummaryArg", ErrAlertBodyWithSimpleAlert},
+		{Payload{AlertText: "Testing", Token: testToken(1),
+			AlertBody: APSAlertBody{SummaryArgCount: 2}}, "AlertBody.SummaryArgCount", ErrAlertBodyWithSimpleAlert},
+		{Payload{AlertText: "Testing", Token: testToken(1),
+			Sound: NewCriticalSound("alarm.aiff", 2)}, "Sound", ErrInvalidSoundVolume},
+		{Payload{AlertText: "Testing", Token: testToken(1),
+			RelevanceScore: NewRelevanceScore(1.5)}, "RelevanceScore", ErrInvalidRelevanceScore},
+		{Payload{AlertText: "Testing", Token: testToken(1), Background: true}, "Background", ErrInvalidBackgroundPayload},
+		{Payload{AlertText: strings.Repeat("a", 300), Token: testToken(1)}, "", ErrPayloadTooLarge},
+	}
+
+	for i, c := range cases {
+		errs := c.payload.Validate(256)
+		if len(errs) != 1 || errs[0].Field != c.field || !errors.Is(errs[0], c.expected) {
+			t.Errorf("Case %v: expected %v for %q but got %v", i, c.expected, c.field, errs)
+		}
+	}
+}
+
+func TestValidateShouldReturnEveryError(t *testing.T) {
+	p := Payload{
+		AlertText: "Testing",
+		AlertBody: APSAlertBody{
+			TitleLocKey:  "TITLE_FORMAT",
+			TitleLocArgs: []string{"Jenna"},
+		},
+		CustomFields: map[string]interface{}{"aps": 1},
+		Priority:     1,
+		Token:        "abc",
+	}
+
+	errs := p.Validate(256)
+	expected := []struct {
+		field string
+		err   error
+	}{
+		{"Token", ErrInvalidTokenEncoding},
+		{"Priority", ErrInvalidPriority},
+		{"CustomFields", ErrApsCustomField},
+		{"AlertBody.TitleLocKey", ErrAlertBodyWithSimpleAlert},
+		{"AlertBody.TitleLocArgs", ErrAlertBodyWithSimpleAlert},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %v errors but got %v", len(expected), errs)
+	}
+	for i, e := range expected {
+		if errs[i].Field != e.field || !errors.Is(errs[i], e.err) {
+			t.Errorf("Expected %v for %v but got %v", e.err, e.field, errs[i])
+		}
+	}
+}
+
+func TestValidateShouldCheckSizeBeforeTruncation(t *testing.T) {
+	p := Payload{AlertText: strings.Repeat("a", 300), Token: testToken(1)}
+
+	//Marshal truncates it to fit
+	if _, err := p.Marshal(256); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := p.Validate(256)
+	if len(errs) != 1 || errs[0].Error() != "Payload was too long. Was 320 bytes but max is 256 bytes" {
+		t.Errorf("Expected payload to be too long but got %v", errs)
+	}
+	if errs := p.Validate(320); errs != nil {
+		t.Errorf("Expected payload to fit but got %v", errs)
+	}
+}
+
+func TestValidateHTTP2ShouldAllowAnyTokenLength(t *testing.T) {
+	for _, token := range []string{testToken(1), "abcd", testToken(1) + testToken(2)} {
+		p := Payload{AlertText: "Testing", Token: token}
+		if errs := p.ValidateHTTP2(256); errs != nil {
+			t.Errorf("Expected %v to be valid for HTTP/2 but got %v", token, errs)
+		}
+	}
+
+	for _, token := range []string{"", "not hex", "abc"} {
+		p := Payload{AlertText: "Testing", Token: token}
+		errs := p.ValidateHTTP2(256)
+		if len(errs) != 1 || errs[0].Field != "Token" || !errors.Is(errs[0], ErrInvalidTokenEncoding) {
+			t.Errorf("Expected ErrInvalidTokenEncoding for %q but got %v", token, errs)
+		}
+	}
+
+	//everything else is checked the same way
+	p := Payload{AlertText: "Testing", Token: "abcd", Priority: 7}
+	errs := p.ValidateHTTP2(256)
+	if len(errs) != 1 || errs[0].Field != "Priority" {
+		t.Errorf("Expected only a priority error but got %v", errs)
+	}
+}
+
+func TestFieldErrorMessage(t *testing.T) {
+	err := &FieldError{Field: "Priority", Err: ErrInvalidPriority}
+	if err.Error() != "Priority : Invalid priority, should be 5 or 10" {
+		t.Errorf("Unexpected message %v", err.Error())
+	}
+}
+
+func TestValidateShouldOnlyAllowLiveActivitiesForHTTP2(t *testing.T) {
+	p := NewLiveActivityPayload(testToken(1), LIVE_ACTIVITY_EVENT_UPDATE, 1700000000, testScore{})
+
+	errs := p.Validate(256)
+	if len(errs) != 1 || errs[0].Field != "LiveActivity" || !errors.Is(errs[0], ErrLiveActivityUnsupported) {
+		t.Errorf("Expected ErrLiveActivityUnsupported for the binary gateway but got %v", errs)
+	}
+	if errs := p.ValidateHTTP2(256); errs != nil {
+		t.Errorf("Expected live activity to be valid for HTTP/2 but got %v", errs)
+	}
+
+	p.LiveActivity.ContentState = nil
+	errs = p.ValidateHTTP2(256)
+	if len(errs) != 1 || errs[0].Field != "LiveActivity" || !errors.Is(errs[0], ErrMissingContentState) {
+		t.Errorf("Expected ErrMissingContentState but got %v", errs)
+	}
+}